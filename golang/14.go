@@ -2,29 +2,50 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"cmp"
+	"container/list"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"math"
+	"math/rand"
 	"os"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 	"unsafe"
 )
 
 const (
-	COLUMN_USERNAME_SIZE = 32
-	COLUMN_EMAIL_SIZE    = 255
-	ID_SIZE              = 4
-	USERNAME_SIZE        = COLUMN_USERNAME_SIZE + 1
-	EMAIL_SIZE           = COLUMN_EMAIL_SIZE + 1
-	ID_OFFSET            = 0
-	USERNAME_OFFSET      = ID_OFFSET + ID_SIZE
-	EMAIL_OFFSET         = USERNAME_OFFSET + USERNAME_SIZE
-	ROW_SIZE             = ID_SIZE + USERNAME_SIZE + EMAIL_SIZE
-	PAGE_SIZE            = 4096
-	TABLE_MAX_PAGES      = 100
+	PAGE_SIZE = 4096
 )
 
+/*
+ * Record Layout
+ * 记录开头是列数，然后依次是每一列的类型和值：NULL 没有值，INTEGER 和 REAL 占8字节，
+ * BOOLEAN 占1字节，TEXT 和 BLOB 是长度加上内容。记录的长度不固定。
+ * INTEGER PRIMARY KEY 列的值就是 B 树中的 key，不保存在记录中。
+ */
+const (
+	RECORD_NUM_COLUMNS_SIZE = 2
+	RECORD_TYPE_SIZE        = 1
+	RECORD_INTEGER_SIZE     = 8
+	RECORD_REAL_SIZE        = 8
+	RECORD_BOOLEAN_SIZE     = 1
+	RECORD_TEXT_LENGTH_SIZE = 4
+)
+
+/* 页缓存默认最多保留的页数，可以用 .cache_size 修改 */
+const PAGER_DEFAULT_CACHE_SIZE = 100
+
+/* ORDER BY 排序时内存中最多保留的记录字节数，超过之后写入临时文件，可以用 .sort_buffer_size 修改 */
+const SORTER_DEFAULT_BUFFER_SIZE = 1 << 20
+
 type NodeType uint8
 
 const (
@@ -49,25 +70,82 @@ const (
 	LEAF_NODE_NUM_CELLS_OFFSET = COMMON_NODE_HEADER_SIZE
 	LEAF_NODE_NEXT_LEAF_SIZE   = 4
 	LEAF_NODE_NEXT_LEAF_OFFSET = LEAF_NODE_NUM_CELLS_OFFSET + LEAF_NODE_NUM_CELLS_SIZE
-	LEAF_NODE_HEADER_SIZE      = COMMON_NODE_HEADER_SIZE + LEAF_NODE_NUM_CELLS_SIZE + LEAF_NODE_NEXT_LEAF_SIZE
+	// 单元格内容区的起始位置，内容区从这里一直到页的末尾
+	LEAF_NODE_CELL_CONTENT_START_SIZE   = 2
+	LEAF_NODE_CELL_CONTENT_START_OFFSET = LEAF_NODE_NEXT_LEAF_OFFSET + LEAF_NODE_NEXT_LEAF_SIZE
+	// 内容区中第一个空闲块的偏移，0 表示没有空闲块
+	LEAF_NODE_FIRST_FREEBLOCK_SIZE   = 2
+	LEAF_NODE_FIRST_FREEBLOCK_OFFSET = LEAF_NODE_CELL_CONTENT_START_OFFSET + LEAF_NODE_CELL_CONTENT_START_SIZE
+	// 内容区中放不下空闲块的碎片字节数
+	LEAF_NODE_FRAGMENTED_BYTES_SIZE   = 2
+	LEAF_NODE_FRAGMENTED_BYTES_OFFSET = LEAF_NODE_FIRST_FREEBLOCK_OFFSET + LEAF_NODE_FIRST_FREEBLOCK_SIZE
+	LEAF_NODE_HEADER_SIZE             = LEAF_NODE_FRAGMENTED_BYTES_OFFSET + LEAF_NODE_FRAGMENTED_BYTES_SIZE
+)
+
+/*
+ * Key Layout
+ * B 树中的 key 是变长的字节串，直接按字节比较大小。表的 key 是翻转符号位之后8字节大端序的 rowid，
+ * 和 INTEGER 值编码之后去掉类型标记相同。有 PRIMARY KEY 的表的 key 是主键列的值编码之后连在一起，
+ * 索引的 key 是列的值编码之后再加上表的 key。
+ */
+const (
+	ROW_KEY_SIZE = 8
+	// 编码之后的 key 最多占用的字节数
+	BTREE_MAX_KEY_SIZE = 512
+)
+
+/*
+ * 列值的编码以类型标记开头，NULL 最小。INTEGER 是翻转符号位之后的8字节大端序，
+ * REAL 是变换之后按字节比较保持大小顺序的8字节，TEXT 和 BLOB 中的 0x00 转义成 0x00 0xFF，
+ * 以 0x00 0x00 结尾，所以一个值的编码不会是另一个值的编码的前缀。
+ */
+const (
+	KEY_TAG_NULL    = 0x00
+	KEY_TAG_INTEGER = 0x10
+	KEY_TAG_REAL    = 0x20
+	KEY_TAG_BOOLEAN = 0x30
+	KEY_TAG_TEXT    = 0x40
+	KEY_TAG_BLOB    = 0x50
+)
+
+/*
+ * Leaf Node Body Layout
+ * 头部之后是按 key 排序的单元格指针数组，每个指针是单元格在页内的偏移，单元格的内容从页的末尾向前存放。
+ * 单元格依次是 key 的长度、记录的长度、key 和保存在本页的那部分记录。记录太长时剩下的部分保存在
+ * 溢出页链表中，单元格的最后是第一个溢出页的页码。key 总是完整地保存在本页。
+ */
+const (
+	LEAF_NODE_CELL_POINTER_SIZE   = 2
+	LEAF_NODE_KEY_SIZE_SIZE       = 2
+	LEAF_NODE_KEY_SIZE_OFFSET     = 0
+	LEAF_NODE_PAYLOAD_SIZE_SIZE   = 4
+	LEAF_NODE_PAYLOAD_SIZE_OFFSET = LEAF_NODE_KEY_SIZE_OFFSET + LEAF_NODE_KEY_SIZE_SIZE
+	LEAF_NODE_KEY_OFFSET          = LEAF_NODE_PAYLOAD_SIZE_OFFSET + LEAF_NODE_PAYLOAD_SIZE_SIZE
+	LEAF_NODE_OVERFLOW_PAGE_SIZE  = 4
+	LEAF_NODE_SPACE_FOR_CELLS     = PAGE_SIZE - LEAF_NODE_HEADER_SIZE
+	// 保存在本页的 key 和记录最多占用的字节数，保证每页至少能放下4个单元格
+	LEAF_NODE_MAX_LOCAL = LEAF_NODE_SPACE_FOR_CELLS/4 - LEAF_NODE_CELL_POINTER_SIZE - LEAF_NODE_KEY_OFFSET - LEAF_NODE_OVERFLOW_PAGE_SIZE
+	// 记录溢出时至少保存在本页的字节数
+	LEAF_NODE_MIN_LOCAL = LEAF_NODE_SPACE_FOR_CELLS / 16
 )
 
-// Leaf Node Body Layout
+/*
+ * Leaf Node Freeblock Layout
+ * 删除单元格留下的空洞按偏移顺序串成空闲块链表，每个空闲块开头是下一个空闲块的偏移和本块的字节数。
+ * 小于 LEAF_NODE_MIN_FREEBLOCK_SIZE 的空洞记为碎片，整理页面时才能回收。
+ */
 const (
-	LEAF_NODE_KEY_SIZE        = 4
-	LEAF_NODE_KEY_OFFSET      = 0
-	LEAF_NODE_VALUE_SIZE      = ROW_SIZE
-	LEAF_NODE_VALUE_OFFSET    = LEAF_NODE_KEY_OFFSET + LEAF_NODE_KEY_SIZE
-	LEAF_NODE_CELL_SIZE       = LEAF_NODE_KEY_SIZE + LEAF_NODE_VALUE_SIZE
-	LEAF_NODE_SPACE_FOR_CELLS = PAGE_SIZE - LEAF_NODE_HEADER_SIZE
-	LEAF_NODE_MAX_CELLS       = LEAF_NODE_SPACE_FOR_CELLS / LEAF_NODE_CELL_SIZE
+	LEAF_NODE_FREEBLOCK_NEXT_OFFSET = 0
+	LEAF_NODE_FREEBLOCK_SIZE_OFFSET = 2
+	LEAF_NODE_MIN_FREEBLOCK_SIZE    = 4
 )
 
 /*
- * Leaf Node Split
+ * Leaf Node Merge
+ * 已用空间少于该值的非根叶子节点需要与兄弟节点合并，或者和兄弟节点重新分配单元格。
+ * 一个单元格最多占用四分之一页，分裂之后两边都不会少于该值。
  */
-const LEAF_NODE_RIGHT_SPLIT_COUNT = (LEAF_NODE_MAX_CELLS + 1) / 2
-const LEAF_NODE_LEFT_SPLIT_COUNT = LEAF_NODE_MAX_CELLS + 1 - LEAF_NODE_RIGHT_SPLIT_COUNT
+const LEAF_NODE_MIN_USED = LEAF_NODE_SPACE_FOR_CELLS / 4
 
 /*
  * Internal Node Header Layout
@@ -76,20 +154,146 @@ const INTERNAL_NODE_NUM_KEYS_SIZE = 4
 const INTERNAL_NODE_NUM_KEYS_OFFSET = COMMON_NODE_HEADER_SIZE
 const INTERNAL_NODE_RIGHT_CHILD_SIZE = 4
 const INTERNAL_NODE_RIGHT_CHILD_OFFSET = INTERNAL_NODE_NUM_KEYS_OFFSET + INTERNAL_NODE_NUM_KEYS_SIZE
-const INTERNAL_NODE_HEADER_SIZE = COMMON_NODE_HEADER_SIZE + INTERNAL_NODE_NUM_KEYS_SIZE + INTERNAL_NODE_RIGHT_CHILD_SIZE
+const INTERNAL_NODE_CELL_CONTENT_START_SIZE = 2
+const INTERNAL_NODE_CELL_CONTENT_START_OFFSET = INTERNAL_NODE_RIGHT_CHILD_OFFSET + INTERNAL_NODE_RIGHT_CHILD_SIZE
+const INTERNAL_NODE_HEADER_SIZE = INTERNAL_NODE_CELL_CONTENT_START_OFFSET + INTERNAL_NODE_CELL_CONTENT_START_SIZE
 
 /*
  * Internal Node Body Layout
+ * 和叶子节点一样，头部之后是按 key 排序的单元格指针数组，单元格的内容从页的末尾向前存放。
+ * 单元格依次是子节点的页码、key 的长度和 key，占用的空间随 key 的长度变化。
+ * 内部节点修改时重新排列所有的单元格，内容区中没有空闲块。
  */
-const INTERNAL_NODE_KEY_SIZE = 4
+const INTERNAL_NODE_CELL_POINTER_SIZE = 2
 const INTERNAL_NODE_CHILD_SIZE = 4
-const INTERNAL_NODE_CELL_SIZE = INTERNAL_NODE_CHILD_SIZE + INTERNAL_NODE_KEY_SIZE
+const INTERNAL_NODE_KEY_SIZE_SIZE = 2
+const INTERNAL_NODE_KEY_OFFSET = INTERNAL_NODE_CHILD_SIZE + INTERNAL_NODE_KEY_SIZE_SIZE
+const INTERNAL_NODE_SPACE_FOR_CELLS = PAGE_SIZE - INTERNAL_NODE_HEADER_SIZE
 
-/* 为了测试，保持较小 */
+/* 为了测试，保持较小。键数没有达到上限，但是本页放不下新的单元格时也需要分裂 */
 const INTERNAL_NODE_MAX_CELLS = 3
 
+/* 非根内部节点至少需要的键数 */
+const INTERNAL_NODE_MIN_CELLS = INTERNAL_NODE_MAX_CELLS / 2
+
+/* 键数少于 INTERNAL_NODE_MIN_CELLS 并且已用空间少于该值的非根内部节点需要和兄弟节点合并或者借一个子节点 */
+const INTERNAL_NODE_MIN_USED = INTERNAL_NODE_SPACE_FOR_CELLS / 4
+
 const INVALID_PAGE_NUM = math.MaxUint32
 
+/*
+ * File Header Layout
+ * 第0页是文件头，文件头中的根节点是系统表的根节点
+ */
+const (
+	HEADER_PAGE_NUM              = 0
+	HEADER_MAGIC                 = "baby-db format"
+	HEADER_MAGIC_SIZE            = 16
+	HEADER_MAGIC_OFFSET          = 0
+	HEADER_VERSION_SIZE          = 4
+	HEADER_VERSION_OFFSET        = HEADER_MAGIC_OFFSET + HEADER_MAGIC_SIZE
+	HEADER_PAGE_SIZE_SIZE        = 4
+	HEADER_PAGE_SIZE_OFFSET      = HEADER_VERSION_OFFSET + HEADER_VERSION_SIZE
+	HEADER_ROOT_PAGE_SIZE        = 4
+	HEADER_ROOT_PAGE_OFFSET      = HEADER_PAGE_SIZE_OFFSET + HEADER_PAGE_SIZE_SIZE
+	HEADER_FREELIST_HEAD_SIZE    = 4
+	HEADER_FREELIST_HEAD_OFFSET  = HEADER_ROOT_PAGE_OFFSET + HEADER_ROOT_PAGE_SIZE
+	HEADER_FREELIST_COUNT_SIZE   = 4
+	HEADER_FREELIST_COUNT_OFFSET = HEADER_FREELIST_HEAD_OFFSET + HEADER_FREELIST_HEAD_SIZE
+	HEADER_SCHEMA_COOKIE_SIZE    = 4
+	HEADER_SCHEMA_COOKIE_OFFSET  = HEADER_FREELIST_COUNT_OFFSET + HEADER_FREELIST_COUNT_SIZE
+	HEADER_JOURNAL_MODE_SIZE     = 4
+	HEADER_JOURNAL_MODE_OFFSET   = HEADER_SCHEMA_COOKIE_OFFSET + HEADER_SCHEMA_COOKIE_SIZE
+	HEADER_SIZE                  = HEADER_JOURNAL_MODE_OFFSET + HEADER_JOURNAL_MODE_SIZE
+)
+
+/* 日志模式：回滚日志或者预写日志(WAL) */
+const (
+	JOURNAL_MODE_DELETE = 0
+	JOURNAL_MODE_WAL    = 1
+)
+
+/* 文件格式版本，页面布局不兼容时递增 */
+const FILE_FORMAT_VERSION = 8
+const ROOT_PAGE_NUM = 1
+
+/* 系统表，保存每张表和索引的名字、根节点和创建语句 */
+const CATALOG_TABLE_NAME = "baby_master"
+
+/* UNIQUE 列自动创建的唯一索引的名字前缀，后面是表名和序号，用户不能使用这个前缀 */
+const AUTOINDEX_PREFIX = "baby_autoindex_"
+
+/*
+ * Rollback Journal Layout
+ * 日志文件头之后是若干条记录，每条记录是事务开始前某一页的原始内容
+ */
+const (
+	JOURNAL_MAGIC              = "baby-db journal"
+	JOURNAL_MAGIC_SIZE         = 16
+	JOURNAL_NUM_PAGES_SIZE     = 4
+	JOURNAL_NUM_PAGES_OFFSET   = JOURNAL_MAGIC_SIZE
+	JOURNAL_PAGE_SIZE_SIZE     = 4
+	JOURNAL_PAGE_SIZE_OFFSET   = JOURNAL_NUM_PAGES_OFFSET + JOURNAL_NUM_PAGES_SIZE
+	JOURNAL_HEADER_SIZE        = JOURNAL_PAGE_SIZE_OFFSET + JOURNAL_PAGE_SIZE_SIZE
+	JOURNAL_RECORD_PAGE_OFFSET = 0
+	JOURNAL_RECORD_DATA_OFFSET = JOURNAL_RECORD_PAGE_OFFSET + 4
+	JOURNAL_RECORD_SUM_OFFSET  = JOURNAL_RECORD_DATA_OFFSET + PAGE_SIZE
+	JOURNAL_RECORD_SIZE        = JOURNAL_RECORD_SUM_OFFSET + 4
+)
+
+/*
+ * Write-Ahead Log Layout
+ * WAL 文件头之后是若干帧，每帧是一页提交后的内容。
+ * 提交帧记录提交后数据库的页数，只有最后一个提交帧之前的帧是有效的。
+ */
+const (
+	WAL_MAGIC                 = "baby-db wal"
+	WAL_MAGIC_SIZE            = 16
+	WAL_PAGE_SIZE_OFFSET      = WAL_MAGIC_SIZE
+	WAL_CHECKPOINT_SEQ_OFFSET = WAL_PAGE_SIZE_OFFSET + 4
+	WAL_SALT_OFFSET           = WAL_CHECKPOINT_SEQ_OFFSET + 4
+	WAL_HEADER_SUM_OFFSET     = WAL_SALT_OFFSET + 4
+	WAL_HEADER_SIZE           = WAL_HEADER_SUM_OFFSET + 4
+	WAL_FRAME_PAGE_OFFSET     = 0
+	WAL_FRAME_COMMIT_OFFSET   = WAL_FRAME_PAGE_OFFSET + 4
+	WAL_FRAME_SALT_OFFSET     = WAL_FRAME_COMMIT_OFFSET + 4
+	WAL_FRAME_SUM_OFFSET      = WAL_FRAME_SALT_OFFSET + 4
+	WAL_FRAME_HEADER_SIZE     = WAL_FRAME_SUM_OFFSET + 4
+	WAL_FRAME_SIZE            = WAL_FRAME_HEADER_SIZE + PAGE_SIZE
+)
+
+/*
+ * 同步级别，和 SQLite 的 PRAGMA synchronous 一样
+ * OFF: 从不调用 fsync，操作系统崩溃或者断电时数据库可能损坏
+ * NORMAL: WAL 模式下提交时不同步 WAL，只在检查点之前同步，断电时可能丢失最近提交的事务，但数据库不会损坏
+ * FULL: 每次提交都同步，提交之后的事务不会丢失
+ */
+const (
+	SYNCHRONOUS_OFF    = 0
+	SYNCHRONOUS_NORMAL = 1
+	SYNCHRONOUS_FULL   = 2
+)
+
+/* WAL 中已提交的帧数达到该值时自动执行检查点 */
+const WAL_AUTOCHECKPOINT = 1000
+
+/*
+ * Free Page Layout
+ * 空闲页开头记录下一个空闲页的页码，0 表示链表结束
+ */
+const FREE_PAGE_NEXT_OFFSET = 0
+
+/*
+ * Overflow Page Layout
+ * 溢出页开头记录链表中下一个溢出页的页码，0 表示最后一页，之后是记录的数据
+ */
+const (
+	OVERFLOW_PAGE_NEXT_OFFSET = 0
+	OVERFLOW_PAGE_NEXT_SIZE   = 4
+	OVERFLOW_PAGE_DATA_OFFSET = OVERFLOW_PAGE_NEXT_OFFSET + OVERFLOW_PAGE_NEXT_SIZE
+	OVERFLOW_PAGE_DATA_SIZE   = PAGE_SIZE - OVERFLOW_PAGE_DATA_OFFSET
+)
+
 type InputBuffer struct {
 	buffer       string
 	bufferLength int
@@ -107,10 +311,10 @@ type PrepareResult int
 
 const (
 	PREPARE_SUCCESS PrepareResult = iota
-	PREPARE_NEGATIVE_ID
 	PREPARE_STRING_TOO_LONG
 	PREPARE_SYNTAX_ERROR
 	PREPARE_UNRECOGNIZED_STATEMENT
+	PREPARE_INVALID_STATEMENT
 )
 
 type StatementType int
@@ -118,36 +322,210 @@ type StatementType int
 const (
 	STATEMENT_INSERT StatementType = iota
 	STATEMENT_SELECT
+	STATEMENT_DELETE
+	STATEMENT_UPDATE
+	STATEMENT_BEGIN
+	STATEMENT_COMMIT
+	STATEMENT_ROLLBACK
+	STATEMENT_CREATE_TABLE
+	STATEMENT_DROP_TABLE
+	STATEMENT_ALTER_TABLE
+	STATEMENT_CREATE_INDEX
+	STATEMENT_DROP_INDEX
+)
+
+type ValueType int
+
+// 也是记录中每一列的类型标记
+const (
+	VALUE_NULL ValueType = iota
+	VALUE_INTEGER
+	VALUE_REAL
+	VALUE_TEXT
+	VALUE_BLOB
+	VALUE_BOOLEAN
 )
 
+// 类型错误时的提示
+var valueTypeDescriptions = map[ValueType]string{
+	VALUE_INTEGER: "an integer",
+	VALUE_REAL:    "a real number",
+	VALUE_TEXT:    "a string",
+	VALUE_BLOB:    "a blob",
+	VALUE_BOOLEAN: "a boolean",
+}
+
+// 一列的值，typ 决定使用哪个字段
+type Value struct {
+	typ        ValueType
+	intValue   int64 // INTEGER，BOOLEAN 是 0 或者 1
+	floatValue float64
+	strValue   string // TEXT 和 BLOB
+}
+
 type Row struct {
-	id       uint32
-	username [COLUMN_USERNAME_SIZE + 1]byte
-	email    [COLUMN_EMAIL_SIZE + 1]byte
+	key    int64   // B 树中的 key
+	values []Value // 按照表中列的顺序
+}
+
+type Column struct {
+	name         string
+	typ          ValueType
+	size         int // TEXT 和 BLOB 的最大长度，0 表示不限制
+	primaryKey   bool
+	notNull      bool
+	unique       bool  // 由自动创建的唯一索引保证
+	defaultValue Value // insert 没有指定这一列，或者 alter table 之前写入的行，使用默认值
+}
+
+// CHECK 约束，表达式的结果是 false 时违反约束，NULL 不违反
+type Check struct {
+	name string // CONSTRAINT 指定的名字，没有名字时是表达式的原文
+	expr *Expr
 }
 
 type Statement struct {
-	typ         StatementType
-	rowToInsert Row
+	typ StatementType
+	// 语法树
+	tableName     string
+	columns       []string  // insert 指定的列
+	values        [][]*Expr // insert 的每一行
+	resultColumns []*Expr
+	resultAliases []string // select 中 AS 之后的别名，没有别名时是空字符串
+	where         *Expr
+	groupBy       []*Expr
+	having        *Expr
+	orderBy       []OrderTerm
+	limitExpr     *Expr
+	offsetExpr    *Expr
+	assignments   []Assignment
+	columnDefs    []ColumnDef // create table 的所有列，alter table 新加的列
+	primaryKey    []string    // create table 中 PRIMARY KEY (column, ...) 的列
+	indexName     string
+	indexColumn   string
+	unique        bool   // create unique index
+	sql           string // create table 和 create index 的原始语句
+	// 语义检查之后的结果
+	table        *Table
+	rowsToInsert []Row
+	// select、update 和 delete 只需要扫描 key 在 [lowKey, highKey] 之间的行，由 WHERE 中主键的条件确定
+	lowKey  int64
+	highKey int64
+	// 用索引扫描 WHERE 中索引列的值在 [seekLow, seekHigh] 之间的行，这时不使用 lowKey 和 highKey。
+	// 有 PRIMARY KEY 的表没有使用索引时用 [seekLow, seekHigh] 扫描表的 B 树。
+	// seekLow 和 seekHigh 是编码之后的值，以 seekHigh 为前缀的 key 也在范围内，seekHigh 为 nil 表示没有上界
+	index    *Index
+	seekLow  []byte
+	seekHigh []byte
+	// 结果需要按 orderBy 排序。只按主键排序时不需要排序，升序时向后扫描，降序时从 highKey 向前扫描
+	needSort bool
+	reverse  bool
+	limit    int64 // 没有 LIMIT 时是 -1
+	offset   int64
+	// select 中的聚合函数。有聚合函数、GROUP BY 或 HAVING 时先分组再输出每一组
+	aggregates      []*Expr
+	grouped         bool
+	minMaxKey       bool // 只有主键的 min 和 max，直接从最左边和最右边的叶子节点读取
+	allowAggregates bool // 语义检查时是否允许聚合函数，WHERE 和 GROUP BY 中不允许
+	// rowToUpdate 中只有 updateColumns 中的列会被覆盖
+	rowToUpdate   Row
+	updateColumns []int
+	errorMessage  string // PREPARE_SYNTAX_ERROR 和 PREPARE_INVALID_STATEMENT 的错误信息
+}
+
+// 缓存中的一页，element 是它在 LRU 链表中的位置
+type CachedPage struct {
+	pageNum uint32
+	data    []byte
+	element *list.Element
+	dirty   bool   // 页被修改过，还没有写回文件
+	epoch   uint64 // 最后一次使用时 pager.epoch 的值，等于当前的 epoch 说明调用者可能还持有这一页
 }
 
 type Pager struct {
+	filename       string
 	fileDescriptor *os.File
-	fileLength     uint32
+	fileLength     int64
 	numPages       uint32
-	pages          [TABLE_MAX_PAGES][]byte
+	pages          map[uint32]*CachedPage
+	lru            *list.List // 链表头部是最近使用的页
+	cacheSize      int
+	epoch          uint64 // 每次 pagerEvict 加一
+	numDirty       int
+	pagesRead      uint64
+	pagesWritten   uint64
+	// 回滚日志，journalFile 为 nil 表示当前没有写事务
+	journalFile      *os.File
+	journaled        map[uint32]bool // 原始内容已经写入日志的页
+	journalNeedsSync bool
+	origNumPages     uint32 // 事务开始时文件的页数，回滚时截断到这个大小
+	// 预写日志，页码到页数据在 WAL 文件中的偏移
+	journalMode  uint32
+	walFile      *os.File
+	walIndex     map[uint32]int64 // 已提交的帧
+	walPending   map[uint32]int64 // 当前事务中被淘汰写入 WAL、还没有提交的帧
+	walSalt      uint32
+	walSeq       uint32
+	walEnd       int64 // 下一帧写入的位置
+	walCommitEnd int64 // 最后一个提交帧之后的位置
+	// 执行了 begin，还没有 commit 或者 rollback
+	inTransaction bool
+	synchronous   int
 }
 
 type Table struct {
+	name        string
 	rootPageNum uint32
 	pager       *Pager
+	columns     []Column
+	keyColumn   int    // INTEGER PRIMARY KEY 列的下标，-1 表示使用隐藏的 rowid 作为 key
+	catalogKey  int64  // 这张表在系统表中的 key
+	sql         string // 系统表中的建表语句
+	checks      []Check
+	indexes     []*Index
+	// 其他类型的主键和多列的主键按顺序保存主键列的下标，B 树的 key 是这些列的值编码之后连在一起。
+	// 这样的表没有 rowid，keyColumn 是-1
+	primaryKey []int
+}
+
+// 二级索引是一棵单独的 B 树，key 是列的值加上表的 key，没有记录
+type Index struct {
+	name       string
+	tableName  string
+	column     int // 索引的列在表中的下标
+	unique     bool
+	tree       *Table // 只用到 rootPageNum 和 pager
+	catalogKey int64
+	sql        string
+}
+
+type Database struct {
+	pager          *Pager
+	catalog        *Table
+	tables         map[string]*Table // 从系统表中加载的表
+	indexes        map[string]*Index // 表和索引的名字不能相同
+	sortBufferSize int
 }
 
 type Cursor struct {
 	table      *Table
 	pageNum    uint32
 	cellNum    uint32
-	endOfTable bool // 表示最后一个元素之后的位置
+	endOfTable bool // 表示最后一个元素之后的位置，cursorRetreat 退到第一个元素之前时也设置
+}
+
+/*
+ * ORDER BY 的排序器。每条记录是排序键加上输出的列，先保存在内存中，
+ * 超过 bufferSize 之后排好序写入临时文件成为一个有序段，最后归并所有的段。
+ * 临时文件中的记录是长度加上 serializeRow 的结果。
+ */
+type Sorter struct {
+	terms      []OrderTerm
+	format     *Table // 记录的格式，每一列对应记录中的一个值
+	records    []Row
+	memory     int // records 序列化之后的字节数
+	bufferSize int
+	runs       []*os.File
 }
 
 type ExecuteResult int
@@ -156,6 +534,13 @@ const (
 	EXECUTE_SUCCESS ExecuteResult = iota
 	EXECUTE_TABLE_FULL
 	EXECUTE_DUPLICATE_KEY
+	EXECUTE_ROW_NOT_FOUND
+	EXECUTE_NO_TRANSACTION
+	EXECUTE_TRANSACTION_ACTIVE
+	EXECUTE_UNIQUE_CONSTRAINT
+	EXECUTE_NOT_NULL_CONSTRAINT
+	EXECUTE_CHECK_CONSTRAINT
+	EXECUTE_KEY_TOO_LARGE
 )
 
 func newInputBuffer() *InputBuffer {
@@ -171,36 +556,180 @@ func leafNodeNumCells(node []byte) *uint32 {
 	return (*uint32)(unsafe.Pointer(&node[LEAF_NODE_NUM_CELLS_OFFSET]))
 }
 
-func leafNodeCell(node []byte, cellNum uint32) []byte {
-	offset := LEAF_NODE_HEADER_SIZE + cellNum*LEAF_NODE_CELL_SIZE
-	return node[offset : offset+LEAF_NODE_CELL_SIZE]
+func leafNodeCellContentStart(node []byte) *uint16 {
+	return (*uint16)(unsafe.Pointer(&node[LEAF_NODE_CELL_CONTENT_START_OFFSET]))
 }
 
-func leafNodeKey(node []byte, cellNum uint32) *uint32 {
-	offset := LEAF_NODE_HEADER_SIZE + cellNum*LEAF_NODE_CELL_SIZE
-	return (*uint32)(unsafe.Pointer(&node[offset]))
+func leafNodeCellPointer(node []byte, cellNum uint32) *uint16 {
+	offset := LEAF_NODE_HEADER_SIZE + cellNum*LEAF_NODE_CELL_POINTER_SIZE
+	return (*uint16)(unsafe.Pointer(&node[offset]))
 }
 
-func leafNodeValue(node []byte, cellNum uint32) []byte {
-	offset := LEAF_NODE_HEADER_SIZE + cellNum*LEAF_NODE_CELL_SIZE + LEAF_NODE_KEY_SIZE
-	return node[offset : offset+LEAF_NODE_VALUE_SIZE]
+func leafNodeCell(node []byte, cellNum uint32) []byte {
+	offset := uint32(*leafNodeCellPointer(node, cellNum))
+	return node[offset : offset+leafCellSize(node[offset:])]
+}
+
+func leafNodeKey(node []byte, cellNum uint32) []byte {
+	offset := uint32(*leafNodeCellPointer(node, cellNum))
+	return leafCellKey(node[offset:])
 }
 
 func leafNodeNextLeaf(node []byte) *uint32 {
 	return (*uint32)(unsafe.Pointer(&node[LEAF_NODE_NEXT_LEAF_OFFSET]))
 }
 
+func leafNodeFirstFreeblock(node []byte) *uint16 {
+	return (*uint16)(unsafe.Pointer(&node[LEAF_NODE_FIRST_FREEBLOCK_OFFSET]))
+}
+
+func leafNodeFragmentedBytes(node []byte) *uint16 {
+	return (*uint16)(unsafe.Pointer(&node[LEAF_NODE_FRAGMENTED_BYTES_OFFSET]))
+}
+
+func freeblockNext(node []byte, offset uint16) *uint16 {
+	return (*uint16)(unsafe.Pointer(&node[offset+LEAF_NODE_FREEBLOCK_NEXT_OFFSET]))
+}
+
+func freeblockSize(node []byte, offset uint16) *uint16 {
+	return (*uint16)(unsafe.Pointer(&node[offset+LEAF_NODE_FREEBLOCK_SIZE_OFFSET]))
+}
+
+// 指针数组和单元格内容区之间连续的空闲字节数
+func leafNodeGapSpace(node []byte) uint32 {
+	return uint32(*leafNodeCellContentStart(node)) - LEAF_NODE_HEADER_SIZE - *leafNodeNumCells(node)*LEAF_NODE_CELL_POINTER_SIZE
+}
+
+// 本页所有的空闲字节数，包括空闲块和碎片，整理页面之后都能连成一片
+func leafNodeFreeSpace(node []byte) uint32 {
+	free := leafNodeGapSpace(node) + uint32(*leafNodeFragmentedBytes(node))
+	for offset := *leafNodeFirstFreeblock(node); offset != 0; offset = *freeblockNext(node, offset) {
+		free += uint32(*freeblockSize(node, offset))
+	}
+	return free
+}
+
+// 单元格和单元格指针占用的字节数
+func leafNodeUsedSpace(node []byte) uint32 {
+	return LEAF_NODE_SPACE_FOR_CELLS - leafNodeFreeSpace(node)
+}
+
+func leafCellKeySize(cell []byte) *uint16 {
+	return (*uint16)(unsafe.Pointer(&cell[LEAF_NODE_KEY_SIZE_OFFSET]))
+}
+
+func leafCellPayloadSize(cell []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&cell[LEAF_NODE_PAYLOAD_SIZE_OFFSET]))
+}
+
+func leafCellKey(cell []byte) []byte {
+	return cell[LEAF_NODE_KEY_OFFSET : LEAF_NODE_KEY_OFFSET+uint32(*leafCellKeySize(cell))]
+}
+
+// 记录在单元格中的偏移，紧跟在 key 之后
+func leafCellPayloadOffset(cell []byte) uint32 {
+	return LEAF_NODE_KEY_OFFSET + uint32(*leafCellKeySize(cell))
+}
+
+// key 的长度为 keySize 时，本页最多能保存的记录字节数
+func leafMaxLocal(keySize uint32) uint32 {
+	return LEAF_NODE_MAX_LOCAL - keySize
+}
+
+// 长度为 payloadSize 的记录保存在本页的字节数
+func leafLocalSize(keySize, payloadSize uint32) uint32 {
+	maxLocal := leafMaxLocal(keySize)
+	if payloadSize <= maxLocal {
+		return payloadSize
+	}
+	// 尽量让最后一个溢出页是满的
+	local := LEAF_NODE_MIN_LOCAL + (payloadSize-LEAF_NODE_MIN_LOCAL)%OVERFLOW_PAGE_DATA_SIZE
+	if local > maxLocal {
+		local = LEAF_NODE_MIN_LOCAL
+	}
+	return local
+}
+
+// 单元格占用的字节数，cell 从单元格的开头开始
+func leafCellSize(cell []byte) uint32 {
+	keySize := uint32(*leafCellKeySize(cell))
+	payloadSize := *leafCellPayloadSize(cell)
+	size := LEAF_NODE_KEY_OFFSET + keySize + leafLocalSize(keySize, payloadSize)
+	if payloadSize > leafMaxLocal(keySize) {
+		size += LEAF_NODE_OVERFLOW_PAGE_SIZE
+	}
+	return size
+}
+
+// 单元格的第一个溢出页，记录没有溢出时返回 nil
+func leafCellOverflowPage(cell []byte) *uint32 {
+	if *leafCellPayloadSize(cell) <= leafMaxLocal(uint32(*leafCellKeySize(cell))) {
+		return nil
+	}
+	return (*uint32)(unsafe.Pointer(&cell[len(cell)-LEAF_NODE_OVERFLOW_PAGE_SIZE]))
+}
+
+func overflowPageNext(page []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&page[OVERFLOW_PAGE_NEXT_OFFSET]))
+}
+
+func headerMagic(header []byte) []byte {
+	return header[HEADER_MAGIC_OFFSET : HEADER_MAGIC_OFFSET+HEADER_MAGIC_SIZE]
+}
+
+func headerVersion(header []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&header[HEADER_VERSION_OFFSET]))
+}
+
+func headerPageSize(header []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&header[HEADER_PAGE_SIZE_OFFSET]))
+}
+
+func headerRootPage(header []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&header[HEADER_ROOT_PAGE_OFFSET]))
+}
+
+func headerSchemaCookie(header []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&header[HEADER_SCHEMA_COOKIE_OFFSET]))
+}
+
+func headerJournalMode(header []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&header[HEADER_JOURNAL_MODE_OFFSET]))
+}
+
+func headerFreelistHead(header []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&header[HEADER_FREELIST_HEAD_OFFSET]))
+}
+
+func headerFreelistCount(header []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&header[HEADER_FREELIST_COUNT_OFFSET]))
+}
+
+func freePageNext(page []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&page[FREE_PAGE_NEXT_OFFSET]))
+}
+
 func nodeParent(node []byte) *uint32 {
 	return (*uint32)(unsafe.Pointer(&node[PARENT_POINTER_OFFSET]))
 }
 
 func printConstants() {
-	fmt.Printf("ROW_SIZE: %d\n", ROW_SIZE)
 	fmt.Printf("COMMON_NODE_HEADER_SIZE: %d\n", COMMON_NODE_HEADER_SIZE)
 	fmt.Printf("LEAF_NODE_HEADER_SIZE: %d\n", LEAF_NODE_HEADER_SIZE)
-	fmt.Printf("LEAF_NODE_CELL_SIZE: %d\n", LEAF_NODE_CELL_SIZE)
 	fmt.Printf("LEAF_NODE_SPACE_FOR_CELLS: %d\n", LEAF_NODE_SPACE_FOR_CELLS)
-	fmt.Printf("LEAF_NODE_MAX_CELLS: %d\n", LEAF_NODE_MAX_CELLS)
+	fmt.Printf("LEAF_NODE_MAX_LOCAL: %d\n", LEAF_NODE_MAX_LOCAL)
+	fmt.Printf("LEAF_NODE_MIN_LOCAL: %d\n", LEAF_NODE_MIN_LOCAL)
+	fmt.Printf("LEAF_NODE_MIN_FREEBLOCK_SIZE: %d\n", LEAF_NODE_MIN_FREEBLOCK_SIZE)
+	fmt.Printf("OVERFLOW_PAGE_DATA_SIZE: %d\n", OVERFLOW_PAGE_DATA_SIZE)
+	fmt.Printf("BTREE_MAX_KEY_SIZE: %d\n", BTREE_MAX_KEY_SIZE)
+}
+
+func printPagerStats(pager *Pager) {
+	fmt.Printf("pages: %d\n", pager.numPages)
+	fmt.Printf("cached_pages: %d\n", len(pager.pages))
+	fmt.Printf("dirty_pages: %d\n", pager.numDirty)
+	fmt.Printf("pages_read: %d\n", pager.pagesRead)
+	fmt.Printf("pages_written: %d\n", pager.pagesWritten)
 }
 
 func indent(level uint32) {
@@ -209,21 +738,118 @@ func indent(level uint32) {
 	}
 }
 
+// 值的文本形式，输出和 || 连接时使用
+func formatValue(value *Value) string {
+	switch value.typ {
+	case VALUE_INTEGER:
+		return strconv.FormatInt(value.intValue, 10)
+	case VALUE_REAL:
+		// 整数值的 REAL 也带上小数点，和 INTEGER 区分开
+		text := strconv.FormatFloat(value.floatValue, 'g', -1, 64)
+		if !strings.ContainsAny(text, ".eIN") {
+			text += ".0"
+		}
+		return text
+	case VALUE_TEXT:
+		return value.strValue
+	case VALUE_BLOB:
+		return fmt.Sprintf("X'%X'", value.strValue)
+	case VALUE_BOOLEAN:
+		return strconv.FormatBool(value.intValue != 0)
+	}
+	return "NULL"
+}
+
 func printRow(row *Row) {
-	//fmt.Printf("(%d, %s, %s)\n", row.id, row.username, row.email)
-	fmt.Printf("(%d, %s, %s)\n", row.id, strings.TrimRight(string(row.username[:]), "\x00"), strings.TrimRight(string(row.email[:]), "\x00"))
+	fields := make([]string, len(row.values))
+	for i := range row.values {
+		fields[i] = formatValue(&row.values[i])
+	}
+	fmt.Printf("(%s)\n", strings.Join(fields, ", "))
+}
+
+// 一行序列化之后的字节数
+func recordSize(table *Table, row *Row) int {
+	size := RECORD_NUM_COLUMNS_SIZE
+	for i := range table.columns {
+		if i == table.keyColumn {
+			continue
+		}
+		size += RECORD_TYPE_SIZE
+		switch row.values[i].typ {
+		case VALUE_INTEGER:
+			size += RECORD_INTEGER_SIZE
+		case VALUE_REAL:
+			size += RECORD_REAL_SIZE
+		case VALUE_BOOLEAN:
+			size += RECORD_BOOLEAN_SIZE
+		case VALUE_TEXT, VALUE_BLOB:
+			size += RECORD_TEXT_LENGTH_SIZE + len(row.values[i].strValue)
+		}
+	}
+	return size
 }
 
-func serializeRow(source *Row, destination []byte) {
-	copy(destination[ID_OFFSET:], (*(*[ID_SIZE]byte)(unsafe.Pointer(&source.id)))[:])
-	copy(destination[USERNAME_OFFSET:], source.username[:])
-	copy(destination[EMAIL_OFFSET:], source.email[:])
+func serializeRow(table *Table, source *Row) []byte {
+	record := make([]byte, RECORD_NUM_COLUMNS_SIZE, recordSize(table, source))
+	binary.LittleEndian.PutUint16(record, uint16(len(table.columns)))
+	for i := range table.columns {
+		if i == table.keyColumn {
+			continue
+		}
+		value := &source.values[i]
+		record = append(record, byte(value.typ))
+		switch value.typ {
+		case VALUE_INTEGER:
+			record = binary.LittleEndian.AppendUint64(record, uint64(value.intValue))
+		case VALUE_REAL:
+			record = binary.LittleEndian.AppendUint64(record, math.Float64bits(value.floatValue))
+		case VALUE_BOOLEAN:
+			record = append(record, byte(value.intValue))
+		case VALUE_TEXT, VALUE_BLOB:
+			record = binary.LittleEndian.AppendUint32(record, uint32(len(value.strValue)))
+			record = append(record, value.strValue...)
+		}
+	}
+	return record
 }
 
-func deserializeRow(source []byte, destination *Row) {
-	destination.id = *(*uint32)(unsafe.Pointer(&source[ID_OFFSET]))
-	copy(destination.username[:], source[USERNAME_OFFSET:USERNAME_OFFSET+USERNAME_SIZE])
-	copy(destination.email[:], source[EMAIL_OFFSET:EMAIL_OFFSET+EMAIL_SIZE])
+// destination.key 需要由调用者设置
+func deserializeRow(table *Table, source []byte, destination *Row) {
+	destination.values = make([]Value, len(table.columns))
+	numColumns := int(binary.LittleEndian.Uint16(source))
+	offset := RECORD_NUM_COLUMNS_SIZE
+	for i, column := range table.columns {
+		value := &destination.values[i]
+		if i == table.keyColumn {
+			value.typ = VALUE_INTEGER
+			value.intValue = destination.key
+			continue
+		}
+		if i >= numColumns {
+			// 写入这一行之后 alter table 新加的列
+			*value = column.defaultValue
+			continue
+		}
+		value.typ = ValueType(source[offset])
+		offset += RECORD_TYPE_SIZE
+		switch value.typ {
+		case VALUE_INTEGER:
+			value.intValue = int64(binary.LittleEndian.Uint64(source[offset:]))
+			offset += RECORD_INTEGER_SIZE
+		case VALUE_REAL:
+			value.floatValue = math.Float64frombits(binary.LittleEndian.Uint64(source[offset:]))
+			offset += RECORD_REAL_SIZE
+		case VALUE_BOOLEAN:
+			value.intValue = int64(source[offset])
+			offset += RECORD_BOOLEAN_SIZE
+		case VALUE_TEXT, VALUE_BLOB:
+			length := int(binary.LittleEndian.Uint32(source[offset:]))
+			offset += RECORD_TEXT_LENGTH_SIZE
+			value.strValue = string(source[offset : offset+length])
+			offset += length
+		}
+	}
 }
 
 func getNodeType(node []byte) NodeType {
@@ -255,9 +881,72 @@ func internalNodeRightChild(node []byte) *uint32 {
 	return (*uint32)(unsafe.Pointer(&node[INTERNAL_NODE_RIGHT_CHILD_OFFSET]))
 }
 
-func internalNodeCell(node []byte, cellNum uint32) *uint32 {
-	offset := INTERNAL_NODE_HEADER_SIZE + cellNum*INTERNAL_NODE_CELL_SIZE
-	return (*uint32)(unsafe.Pointer(&node[offset]))
+func internalNodeCellContentStart(node []byte) *uint16 {
+	return (*uint16)(unsafe.Pointer(&node[INTERNAL_NODE_CELL_CONTENT_START_OFFSET]))
+}
+
+func internalNodeCellPointer(node []byte, cellNum uint32) *uint16 {
+	offset := INTERNAL_NODE_HEADER_SIZE + cellNum*INTERNAL_NODE_CELL_POINTER_SIZE
+	return (*uint16)(unsafe.Pointer(&node[offset]))
+}
+
+func internalNodeCell(node []byte, cellNum uint32) []byte {
+	offset := uint32(*internalNodeCellPointer(node, cellNum))
+	return node[offset : offset+internalCellSize(node[offset:])]
+}
+
+func internalCellChild(cell []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&cell[0]))
+}
+
+func internalCellSize(cell []byte) uint32 {
+	return INTERNAL_NODE_KEY_OFFSET + uint32(binary.LittleEndian.Uint16(cell[INTERNAL_NODE_CHILD_SIZE:]))
+}
+
+func internalCellKey(cell []byte) []byte {
+	return cell[INTERNAL_NODE_KEY_OFFSET:internalCellSize(cell)]
+}
+
+func buildInternalCell(child uint32, key []byte) []byte {
+	cell := binary.LittleEndian.AppendUint32(nil, child)
+	cell = binary.LittleEndian.AppendUint16(cell, uint16(len(key)))
+	return append(cell, key...)
+}
+
+// 单元格指针数组和内容区之间的空闲字节数，内部节点的单元格总是紧挨着存放
+func internalNodeFreeSpace(node []byte) uint32 {
+	return uint32(*internalNodeCellContentStart(node)) - INTERNAL_NODE_HEADER_SIZE - *internalNodeNumKeys(node)*INTERNAL_NODE_CELL_POINTER_SIZE
+}
+
+func internalNodeUsedSpace(node []byte) uint32 {
+	return INTERNAL_NODE_SPACE_FOR_CELLS - internalNodeFreeSpace(node)
+}
+
+// 复制出内部节点中的所有单元格，不包括右子节点
+func internalNodeCells(node []byte) [][]byte {
+	cells := make([][]byte, *internalNodeNumKeys(node))
+	for i := range cells {
+		cells[i] = slices.Clone(internalNodeCell(node, uint32(i)))
+	}
+	return cells
+}
+
+// 用 cells 重新填充内部节点，右子节点不变。调用者保证放得下
+func internalNodeSetCells(node []byte, cells [][]byte) {
+	start := uint32(PAGE_SIZE)
+	for i, cell := range cells {
+		start -= uint32(len(cell))
+		copy(node[start:], cell)
+		*internalNodeCellPointer(node, uint32(i)) = uint16(start)
+	}
+	*internalNodeCellContentStart(node) = uint16(start)
+	*internalNodeNumKeys(node) = uint32(len(cells))
+}
+
+// 内部节点能否再放下一个单元格
+func internalNodeHasRoom(node []byte, cell []byte) bool {
+	return *internalNodeNumKeys(node) < INTERNAL_NODE_MAX_CELLS &&
+		internalNodeFreeSpace(node) >= uint32(len(cell))+INTERNAL_NODE_CELL_POINTER_SIZE
 }
 
 func initializeLeafNode(node []byte) {
@@ -265,12 +954,16 @@ func initializeLeafNode(node []byte) {
 	setNodeRoot(node, false)
 	*leafNodeNumCells(node) = 0
 	*leafNodeNextLeaf(node) = 0 // 0 表示无兄弟节点
+	*leafNodeCellContentStart(node) = PAGE_SIZE
+	*leafNodeFirstFreeblock(node) = 0
+	*leafNodeFragmentedBytes(node) = 0
 }
 
 func initializeInternalNode(node []byte) {
 	setNodeType(node, NODE_INTERNAL)
 	setNodeRoot(node, false)
 	*internalNodeNumKeys(node) = 0
+	*internalNodeCellContentStart(node) = PAGE_SIZE
 	/*
 	  由于根页码是0，因此在初始化内部节点时，如果不将其右子节点初始化为无效的页码，可能会导致右子节点为0，这将使该节点成为根节点的父节点。
 	*/
@@ -278,115 +971,448 @@ func initializeInternalNode(node []byte) {
 }
 
 func getPage(pager *Pager, pageNum uint32) []byte {
-	if pageNum > TABLE_MAX_PAGES {
-		fmt.Printf("Tried to fetch page number out of bounds. %d > %d\n", pageNum, TABLE_MAX_PAGES)
-		os.Exit(1)
+	cached, ok := pager.pages[pageNum]
+	if ok {
+		pager.lru.MoveToFront(cached.element)
+		cached.epoch = pager.epoch
+		return cached.data
 	}
 
-	if pager.pages[pageNum] == nil {
-		// Cache miss. Allocate memory and load from file.
-		page := make([]byte, PAGE_SIZE)
-		numPages := pager.fileLength / PAGE_SIZE
-
-		// We might save a partial page at the end of the file
-		if pager.fileLength%PAGE_SIZE != 0 {
-			numPages++
+	// 缓存已满时淘汰最久未使用的页。上一次 pagerEvict 之后用过的页都在链表的前面，
+	// 链表尾部的页也用过说明所有的页都可能还被调用者持有，这时只能暂时超出上限
+	if len(pager.pages) >= pager.cacheSize {
+		if back := pager.lru.Back().Value.(*CachedPage); back.epoch != pager.epoch {
+			pagerEvictPage(pager, back)
 		}
+	}
 
-		if pageNum <= numPages {
-			_, err := pager.fileDescriptor.Seek(int64(pageNum*PAGE_SIZE), os.SEEK_SET)
-			if err != nil {
-				fmt.Printf("Error seeking: %v\n", err)
-				os.Exit(1)
-			}
+	// Cache miss. Allocate memory and load from file.
+	page := make([]byte, PAGE_SIZE)
+	numPages := pager.fileLength / PAGE_SIZE
 
-			_, err = pager.fileDescriptor.Read(page)
-			if err != nil && err != io.EOF {
-				fmt.Printf("Error reading file: %v\n", err)
-				os.Exit(1)
-			}
+	// We might save a partial page at the end of the file
+	if pager.fileLength%PAGE_SIZE != 0 {
+		numPages++
+	}
+
+	if offset, ok := walFindFrame(pager, pageNum); ok {
+		// WAL 中的帧比数据库文件中的页更新
+		_, err := pager.walFile.ReadAt(page, offset)
+		if err != nil {
+			fmt.Printf("Error reading wal: %v\n", err)
+			os.Exit(1)
+		}
+		pager.pagesRead++
+	} else if int64(pageNum) <= numPages {
+		_, err := pager.fileDescriptor.Seek(int64(pageNum)*PAGE_SIZE, io.SeekStart)
+		if err != nil {
+			fmt.Printf("Error seeking: %v\n", err)
+			os.Exit(1)
 		}
 
-		pager.pages[pageNum] = page
-		if pageNum >= pager.numPages {
-			pager.numPages = pageNum + 1
+		_, err = pager.fileDescriptor.Read(page)
+		if err != nil && err != io.EOF {
+			fmt.Printf("Error reading file: %v\n", err)
+			os.Exit(1)
 		}
+		pager.pagesRead++
+	}
+
+	cached = &CachedPage{pageNum: pageNum, data: page, epoch: pager.epoch}
+	cached.element = pager.lru.PushFront(cached)
+	pager.pages[pageNum] = cached
+	if pageNum >= pager.numPages {
+		pager.numPages = pageNum + 1
 	}
 
-	return pager.pages[pageNum]
+	return page
 }
 
-func internalNodeChild(node []byte, childNum uint32) *uint32 {
-	numKeys := *internalNodeNumKeys(node)
-	if childNum > numKeys {
-		fmt.Printf("Tried to access childNum %d > numKeys %d\n", childNum, numKeys)
-		os.Exit(1)
-	}
-	if childNum == numKeys {
-		rightChild := internalNodeRightChild(node)
-		if *rightChild == INVALID_PAGE_NUM {
-			fmt.Printf("Tried to access right child of node, but was invalid page\n")
-			os.Exit(1)
+// 获取将要被修改的页并把它标记为脏页，只有脏页会在淘汰或者提交时写回文件
+func getPageForWrite(pager *Pager, pageNum uint32) []byte {
+	page := getPage(pager, pageNum)
+	cached := pager.pages[pageNum]
+	if !cached.dirty {
+		// 第一次修改前把原始内容写入日志，WAL 模式下原始内容还在数据库文件或 WAL 中
+		if pager.journalMode == JOURNAL_MODE_DELETE {
+			pagerJournalPage(pager, pageNum, page)
 		}
-		return rightChild
-	}
-	child := internalNodeCell(node, childNum)
-	if *child == INVALID_PAGE_NUM {
-		fmt.Printf("Tried to access child %d of node, but was invalid page\n", childNum)
-		os.Exit(1)
+		cached.dirty = true
+		pager.numDirty++
 	}
-	return child
+	return page
 }
 
-func internalNodeKey(node []byte, keyNum uint32) *uint32 {
-	offset := INTERNAL_NODE_HEADER_SIZE + keyNum*INTERNAL_NODE_CELL_SIZE + INTERNAL_NODE_CHILD_SIZE
-	return (*uint32)(unsafe.Pointer(&node[offset]))
+func journalFilename(pager *Pager) string {
+	return pager.filename + "-journal"
 }
 
-// 返回应包含给定键的子节点的索引。
-func internalNodeFindChild(node []byte, key uint32) uint32 {
-	numKeys := *internalNodeNumKeys(node)
-
-	// Binary search
-	minIndex := uint32(0)
-	maxIndex := numKeys // there is one more child than key
+// 开始一个写事务：创建日志文件并写入日志头
+func pagerBeginJournal(pager *Pager) {
+	if pager.journalFile != nil {
+		return
+	}
 
-	for minIndex != maxIndex {
-		index := (minIndex + maxIndex) / 2
-		keyToRight := *internalNodeKey(node, index)
+	journalFile, err := os.OpenFile(journalFilename(pager), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		fmt.Printf("Unable to open journal file: %v\n", err)
+		os.Exit(1)
+	}
 
-		if keyToRight >= key {
-			maxIndex = index
-		} else {
-			minIndex = index + 1
-		}
+	header := make([]byte, JOURNAL_HEADER_SIZE)
+	copy(header[:JOURNAL_MAGIC_SIZE], JOURNAL_MAGIC)
+	binary.LittleEndian.PutUint32(header[JOURNAL_NUM_PAGES_OFFSET:], pager.origNumPages)
+	binary.LittleEndian.PutUint32(header[JOURNAL_PAGE_SIZE_OFFSET:], PAGE_SIZE)
+	_, err = journalFile.Write(header)
+	if err != nil {
+		fmt.Printf("Error writing journal: %v\n", err)
+		os.Exit(1)
 	}
 
-	return minIndex
+	pager.journalFile = journalFile
+	pager.journaled = make(map[uint32]bool)
+	pager.journalNeedsSync = true
 }
 
-func updateInternalNodeKey(node []byte, oldKey, newKey uint32) {
-	oldChildIndex := internalNodeFindChild(node, oldKey)
-	*internalNodeKey(node, oldChildIndex) = newKey
-}
+// 把一页的原始内容追加到日志中，事务开始后新分配的页不需要记录
+func pagerJournalPage(pager *Pager, pageNum uint32, page []byte) {
+	pagerBeginJournal(pager)
+	if pageNum >= pager.origNumPages || pager.journaled[pageNum] {
+		return
+	}
 
-func getNodeMaxKey(pager *Pager, node []byte) uint32 {
-	if getNodeType(node) == NODE_LEAF {
-		return *leafNodeKey(node, *leafNodeNumCells(node)-1)
+	record := make([]byte, JOURNAL_RECORD_SIZE)
+	binary.LittleEndian.PutUint32(record[JOURNAL_RECORD_PAGE_OFFSET:], pageNum)
+	copy(record[JOURNAL_RECORD_DATA_OFFSET:JOURNAL_RECORD_SUM_OFFSET], page)
+	binary.LittleEndian.PutUint32(record[JOURNAL_RECORD_SUM_OFFSET:], crc32.ChecksumIEEE(record[:JOURNAL_RECORD_SUM_OFFSET]))
+	_, err := pager.journalFile.Write(record)
+	if err != nil {
+		fmt.Printf("Error writing journal: %v\n", err)
+		os.Exit(1)
 	}
-	rightChild := getPage(pager, *internalNodeRightChild(node))
-	return getNodeMaxKey(pager, rightChild)
+
+	pager.journaled[pageNum] = true
+	pager.journalNeedsSync = true
 }
 
-// 处理根节点的拆分。
-// 将旧根复制到新页，成为左子节点。
+// 覆盖数据库文件中的页之前，日志必须已经落盘
+func pagerSyncJournal(pager *Pager) {
+	if pager.journalFile == nil || !pager.journalNeedsSync {
+		return
+	}
+	if pager.synchronous == SYNCHRONOUS_OFF {
+		pager.journalNeedsSync = false
+		return
+	}
+	err := pager.journalFile.Sync()
+	if err != nil {
+		fmt.Printf("Error syncing journal: %v\n", err)
+		os.Exit(1)
+	}
+	pager.journalNeedsSync = false
+}
+
+// 提交当前事务：把脏页写回数据库文件并同步，删除日志文件是提交完成的标志
+func pagerCommit(pager *Pager) {
+	if pager.journalMode == JOURNAL_MODE_WAL {
+		walCommit(pager)
+		return
+	}
+	if pager.journalFile == nil {
+		return
+	}
+
+	pagerFlushAll(pager)
+
+	// .vacuum 之后文件需要截断
+	if pager.fileLength > int64(pager.numPages)*PAGE_SIZE {
+		pager.fileLength = int64(pager.numPages) * PAGE_SIZE
+		err := pager.fileDescriptor.Truncate(pager.fileLength)
+		if err != nil {
+			fmt.Printf("Error truncating db file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if pager.synchronous != SYNCHRONOUS_OFF {
+		err := pager.fileDescriptor.Sync()
+		if err != nil {
+			fmt.Printf("Error syncing db file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	pager.journalFile.Close()
+	err := os.Remove(journalFilename(pager))
+	if err != nil {
+		fmt.Printf("Error deleting journal: %v\n", err)
+		os.Exit(1)
+	}
+
+	pager.journalFile = nil
+	pager.journaled = nil
+	pager.origNumPages = pager.numPages
+}
+
+// 打开数据库时发现日志文件，说明上次的事务没有提交完成。
+// 把日志中的原始页写回数据库文件，并截断到事务开始时的大小。
+func pagerRollbackHotJournal(pager *Pager) {
+	journalFile, err := os.Open(journalFilename(pager))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return
+		}
+		fmt.Printf("Unable to open journal file: %v\n", err)
+		os.Exit(1)
+	}
+
+	pagerPlaybackJournal(pager, journalFile)
+	journalFile.Close()
+
+	err = os.Remove(journalFilename(pager))
+	if err != nil {
+		fmt.Printf("Error deleting journal: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// 把日志中的原始页写回数据库文件，并截断到事务开始时的大小
+func pagerPlaybackJournal(pager *Pager, journalFile *os.File) {
+	// 日志头不完整或者不合法时，数据库文件还没有被修改过
+	header := make([]byte, JOURNAL_HEADER_SIZE)
+	var magic [JOURNAL_MAGIC_SIZE]byte
+	copy(magic[:], JOURNAL_MAGIC)
+	_, err := journalFile.ReadAt(header, 0)
+	if err == nil && string(header[:JOURNAL_MAGIC_SIZE]) == string(magic[:]) &&
+		binary.LittleEndian.Uint32(header[JOURNAL_PAGE_SIZE_OFFSET:]) == PAGE_SIZE {
+		record := make([]byte, JOURNAL_RECORD_SIZE)
+		for offset := int64(JOURNAL_HEADER_SIZE); ; offset += JOURNAL_RECORD_SIZE {
+			// 最后一条记录可能只写了一部分
+			_, err = journalFile.ReadAt(record, offset)
+			if err != nil {
+				break
+			}
+			checksum := binary.LittleEndian.Uint32(record[JOURNAL_RECORD_SUM_OFFSET:])
+			if crc32.ChecksumIEEE(record[:JOURNAL_RECORD_SUM_OFFSET]) != checksum {
+				break
+			}
+			pageNum := binary.LittleEndian.Uint32(record[JOURNAL_RECORD_PAGE_OFFSET:])
+			_, err = pager.fileDescriptor.WriteAt(record[JOURNAL_RECORD_DATA_OFFSET:JOURNAL_RECORD_SUM_OFFSET], int64(pageNum)*PAGE_SIZE)
+			if err != nil {
+				fmt.Printf("Error writing: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		origNumPages := binary.LittleEndian.Uint32(header[JOURNAL_NUM_PAGES_OFFSET:])
+		err = pager.fileDescriptor.Truncate(int64(origNumPages) * PAGE_SIZE)
+		if err != nil {
+			fmt.Printf("Error truncating db file: %v\n", err)
+			os.Exit(1)
+		}
+		err = pager.fileDescriptor.Sync()
+		if err != nil {
+			fmt.Printf("Error syncing db file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// 回滚当前事务：丢弃缓存中的所有页，被淘汰写回数据库文件的页用日志中的原始内容恢复，
+// WAL 模式下丢弃没有提交的帧。缓存中干净的页也可能是从这些页读出来的，所以一起丢弃。
+func pagerRollback(pager *Pager) {
+	for pageNum := range pager.pages {
+		pagerDropPage(pager, pageNum)
+	}
+
+	if pager.journalMode == JOURNAL_MODE_WAL {
+		pager.walPending = make(map[uint32]int64)
+		pager.walEnd = pager.walCommitEnd
+		err := pager.walFile.Truncate(pager.walEnd)
+		if err != nil {
+			fmt.Printf("Error truncating wal: %v\n", err)
+			os.Exit(1)
+		}
+	} else if pager.journalFile != nil {
+		pagerPlaybackJournal(pager, pager.journalFile)
+		pager.journalFile.Close()
+		err := os.Remove(journalFilename(pager))
+		if err != nil {
+			fmt.Printf("Error deleting journal: %v\n", err)
+			os.Exit(1)
+		}
+		pager.journalFile = nil
+		pager.journaled = nil
+		pager.fileLength = int64(pager.origNumPages) * PAGE_SIZE
+	}
+
+	pager.numPages = pager.origNumPages
+}
+
+// 从缓存中移除一页，不写回文件
+func pagerDropPage(pager *Pager, pageNum uint32) {
+	cached, ok := pager.pages[pageNum]
+	if !ok {
+		return
+	}
+	if cached.dirty {
+		pager.numDirty--
+	}
+	pager.lru.Remove(cached.element)
+	delete(pager.pages, pageNum)
+}
+
+// 把所有脏页写回文件，页仍然留在缓存中
+func pagerFlushAll(pager *Pager) {
+	if pager.numDirty == 0 {
+		return
+	}
+	for pageNum, cached := range pager.pages {
+		if cached.dirty {
+			pagerFlush(pager, pageNum)
+		}
+	}
+}
+
+// 淘汰最久未使用的页，直到缓存不超过 cacheSize。
+// 调用者可能还持有 getPage 返回的切片并继续修改它，所以只在不会再用这些切片的
+// 安全点调用（每条语句执行完之后，或者逐行处理的循环中每一行处理完之后）。
+// 之后所有的页都可以被 getPage 淘汰，直到再次被使用。
+func pagerEvict(pager *Pager) {
+	for len(pager.pages) > pager.cacheSize {
+		pagerEvictPage(pager, pager.lru.Back().Value.(*CachedPage))
+	}
+	pager.epoch++
+}
+
+// 从缓存中移除一页，脏页先写回文件
+func pagerEvictPage(pager *Pager, cached *CachedPage) {
+	if cached.dirty {
+		pagerFlush(pager, cached.pageNum)
+	}
+	pagerDropPage(pager, cached.pageNum)
+}
+
+func internalNodeChild(node []byte, childNum uint32) *uint32 {
+	numKeys := *internalNodeNumKeys(node)
+	if childNum > numKeys {
+		fmt.Printf("Tried to access childNum %d > numKeys %d\n", childNum, numKeys)
+		os.Exit(1)
+	}
+	if childNum == numKeys {
+		rightChild := internalNodeRightChild(node)
+		if *rightChild == INVALID_PAGE_NUM {
+			fmt.Printf("Tried to access right child of node, but was invalid page\n")
+			os.Exit(1)
+		}
+		return rightChild
+	}
+	child := internalCellChild(internalNodeCell(node, childNum))
+	if *child == INVALID_PAGE_NUM {
+		fmt.Printf("Tried to access child %d of node, but was invalid page\n", childNum)
+		os.Exit(1)
+	}
+	return child
+}
+
+func internalNodeKey(node []byte, keyNum uint32) []byte {
+	return internalCellKey(internalNodeCell(node, keyNum))
+}
+
+// key 的长度变化时重新排列单元格，调用者保证放得下
+func setInternalNodeKey(node []byte, keyNum uint32, key []byte) {
+	cells := internalNodeCells(node)
+	cells[keyNum] = buildInternalCell(*internalCellChild(cells[keyNum]), key)
+	internalNodeSetCells(node, cells)
+}
+
+// 替换内部节点中下标为 keyNum 的键。新的键更长、本页放不下时先分裂节点，再到键所在的节点中替换，
+// 分裂时中间的键已经移到父节点中
+func internalNodeReplaceKey(table *Table, pageNum, keyNum uint32, key []byte) {
+	node := getPageForWrite(table.pager, pageNum)
+	oldKey := internalNodeKey(node, keyNum)
+	if len(key) <= len(oldKey) || internalNodeFreeSpace(node) >= uint32(len(key)-len(oldKey)) {
+		setInternalNodeKey(node, keyNum, key)
+		return
+	}
+
+	leftPageNum, rightPageNum, splitPoint := internalNodeSplitAndInsert(table, pageNum, INVALID_PAGE_NUM)
+	switch {
+	case keyNum < splitPoint:
+		setInternalNodeKey(getPageForWrite(table.pager, leftPageNum), keyNum, key)
+	case keyNum > splitPoint:
+		setInternalNodeKey(getPageForWrite(table.pager, rightPageNum), keyNum-splitPoint-1, key)
+	default:
+		parentPageNum := *nodeParent(getPage(table.pager, leftPageNum))
+		index := internalNodeChildIndex(getPage(table.pager, parentPageNum), leftPageNum)
+		internalNodeReplaceKey(table, parentPageNum, index, key)
+	}
+}
+
+// 返回应包含给定键的子节点的索引。
+func internalNodeFindChild(node []byte, key []byte) uint32 {
+	numKeys := *internalNodeNumKeys(node)
+
+	// Binary search
+	minIndex := uint32(0)
+	maxIndex := numKeys // there is one more child than key
+
+	for minIndex != maxIndex {
+		index := (minIndex + maxIndex) / 2
+		keyToRight := internalNodeKey(node, index)
+
+		if bytes.Compare(keyToRight, key) >= 0 {
+			maxIndex = index
+		} else {
+			minIndex = index + 1
+		}
+	}
+
+	return minIndex
+}
+
+func updateInternalNodeKey(table *Table, pageNum uint32, oldKey, newKey []byte) {
+	node := getPage(table.pager, pageNum)
+	oldChildIndex := internalNodeFindChild(node, oldKey)
+	// 右子节点没有对应的键，其最大键由祖先节点记录
+	if oldChildIndex < *internalNodeNumKeys(node) {
+		internalNodeReplaceKey(table, pageNum, oldChildIndex, newKey)
+	}
+}
+
+// 返回子节点在父节点中的下标，右子节点的下标为numKeys
+func internalNodeChildIndex(node []byte, childPageNum uint32) uint32 {
+	numKeys := *internalNodeNumKeys(node)
+	for i := uint32(0); i < numKeys; i++ {
+		if *internalNodeChild(node, i) == childPageNum {
+			return i
+		}
+	}
+	if *internalNodeRightChild(node) != childPageNum {
+		fmt.Printf("Tried to find child %d of node, but it was not a child\n", childPageNum)
+		os.Exit(1)
+	}
+	return numKeys
+}
+
+// 返回 key 的副本，修改节点之后仍然有效
+func getNodeMaxKey(pager *Pager, node []byte) []byte {
+	if getNodeType(node) == NODE_LEAF {
+		return slices.Clone(leafNodeKey(node, *leafNodeNumCells(node)-1))
+	}
+	rightChild := getPage(pager, *internalNodeRightChild(node))
+	return getNodeMaxKey(pager, rightChild)
+}
+
+// 处理根节点的拆分。
+// 将旧根复制到新页，成为左子节点。
 // 重新初始化根页以包含新根节点。
 // 新根节点指向两个子节点。
 func createNewRoot(table *Table, rightChildPageNum uint32) {
-	root := getPage(table.pager, table.rootPageNum)
-	rightChild := getPage(table.pager, rightChildPageNum)
+	root := getPageForWrite(table.pager, table.rootPageNum)
+	rightChild := getPageForWrite(table.pager, rightChildPageNum)
 	leftChildPageNum := getUnusedPageNum(table.pager)
-	leftChild := getPage(table.pager, leftChildPageNum)
+	leftChild := getPageForWrite(table.pager, leftChildPageNum)
 
 	if getNodeType(root) == NODE_INTERNAL {
 		initializeInternalNode(rightChild)
@@ -400,21 +1426,18 @@ func createNewRoot(table *Table, rightChildPageNum uint32) {
 	if getNodeType(leftChild) == NODE_INTERNAL {
 		var child []byte
 		for i := uint32(0); i < *internalNodeNumKeys(leftChild); i++ {
-			child = getPage(table.pager, *internalNodeChild(leftChild, i))
+			child = getPageForWrite(table.pager, *internalNodeChild(leftChild, i))
 			*nodeParent(child) = leftChildPageNum
 		}
-		child = getPage(table.pager, *internalNodeRightChild(leftChild))
+		child = getPageForWrite(table.pager, *internalNodeRightChild(leftChild))
 		*nodeParent(child) = leftChildPageNum
 	}
 
 	// Root becomes a new internal node with one key and two children
 	initializeInternalNode(root)
 	setNodeRoot(root, true)
-	*internalNodeNumKeys(root) = 1
-	*internalNodeChild(root, 0) = leftChildPageNum
 	leftChildMaxKey := getNodeMaxKey(table.pager, leftChild)
-
-	*internalNodeKey(root, 0) = leftChildMaxKey
+	internalNodeSetCells(root, [][]byte{buildInternalCell(leftChildPageNum, leftChildMaxKey)})
 	*internalNodeRightChild(root) = rightChildPageNum
 	*nodeParent(leftChild) = table.rootPageNum
 	*nodeParent(rightChild) = table.rootPageNum
@@ -422,17 +1445,11 @@ func createNewRoot(table *Table, rightChildPageNum uint32) {
 
 // 向父节点添加一个新的子节点/键对，对应于子节点
 func internalNodeInsert(table *Table, parentPageNum, childPageNum uint32) {
-	parent := getPage(table.pager, parentPageNum)
+	parent := getPageForWrite(table.pager, parentPageNum)
 	child := getPage(table.pager, childPageNum)
 	childMaxKey := getNodeMaxKey(table.pager, child)
 	index := internalNodeFindChild(parent, childMaxKey)
 
-	originalNumKeys := *internalNodeNumKeys(parent)
-	if originalNumKeys >= INTERNAL_NODE_MAX_CELLS {
-		internalNodeSplitAndInsert(table, parentPageNum, childPageNum)
-		return
-	}
-
 	rightChildPageNum := *internalNodeRightChild(parent)
 	// 具有右子节点为INVALID_PAGE_NUM的内部节点为空
 	if rightChildPageNum == INVALID_PAGE_NUM {
@@ -440,108 +1457,109 @@ func internalNodeInsert(table *Table, parentPageNum, childPageNum uint32) {
 		return
 	}
 
+	// 新的子节点比右子节点大时，原来的右子节点用单元格记录，新的子节点成为右子节点
 	rightChild := getPage(table.pager, rightChildPageNum)
-	/*
-	  如果我们已经达到节点的最大单元格数，就不能在分裂之前递增。
-	  在没有插入新的键/子节点对的情况下递增，并立即调用
-	  `internal_node_split_and_insert` 会导致在 `(max_cells + 1)`
-	  处创建一个新的键，其值未初始化。
-	*/
-	*internalNodeNumKeys(parent) = originalNumKeys + 1
+	rightChildMaxKey := getNodeMaxKey(table.pager, rightChild)
+	replaceRightChild := bytes.Compare(childMaxKey, rightChildMaxKey) > 0
+	cell := buildInternalCell(childPageNum, childMaxKey)
+	if replaceRightChild {
+		index = *internalNodeNumKeys(parent)
+		cell = buildInternalCell(rightChildPageNum, rightChildMaxKey)
+	}
+	if !internalNodeHasRoom(parent, cell) {
+		internalNodeSplitAndInsert(table, parentPageNum, childPageNum)
+		return
+	}
 
-	if childMaxKey > getNodeMaxKey(table.pager, rightChild) {
-		// Replace right child
-		*internalNodeChild(parent, originalNumKeys) = rightChildPageNum
-		*internalNodeKey(parent, originalNumKeys) = getNodeMaxKey(table.pager, rightChild)
+	cells := internalNodeCells(parent)
+	internalNodeSetCells(parent, slices.Insert(cells, int(index), cell))
+	if replaceRightChild {
 		*internalNodeRightChild(parent) = childPageNum
-	} else {
-		// Make space for the new cell
-		for i := originalNumKeys; i > index; i-- {
-			destination := internalNodeCell(parent, i)
-			source := internalNodeCell(parent, i-1)
-			// c: memcpy(destination, source, INTERNAL_NODE_CELL_SIZE);
-			copy((*(*[INTERNAL_NODE_CELL_SIZE]byte)(unsafe.Pointer(destination)))[:], (*(*[INTERNAL_NODE_CELL_SIZE]byte)(unsafe.Pointer(source)))[:])
-			//*internalNodeCell(parent, i) = *internalNodeCell(parent, i-1)
+	}
+}
+
+// 按照占用的空间选择分裂内部节点时上移到父节点的键，两边都至少留下一个键
+func internalNodeSplitPoint(cells [][]byte) uint32 {
+	total := 0
+	for _, cell := range cells {
+		total += len(cell) + INTERNAL_NODE_CELL_POINTER_SIZE
+	}
+	used := 0
+	for i, cell := range cells {
+		size := len(cell) + INTERNAL_NODE_CELL_POINTER_SIZE
+		if (used+size)*2 >= total+size {
+			return uint32(max(1, min(i, len(cells)-2)))
 		}
-		*internalNodeChild(parent, index) = childPageNum
-		*internalNodeKey(parent, index) = childMaxKey
+		used += size
 	}
+	return uint32(len(cells) - 2)
 }
-func internalNodeSplitAndInsert(table *Table, parentPageNum, childPageNum uint32) {
+
+// 把内部节点分成两半，右半部分移动到新的页中，中间的键成为父节点中左半部分的键。
+// childPageNum 不是 INVALID_PAGE_NUM 时把它插入到应该包含它的一半中，之后才修改父节点，
+// 插入的子节点可能比分裂之前的节点中所有的 key 都大。
+// 分裂根节点时树的高度加一，左半部分在新的页中。返回左右两半的页码和中间的键的下标
+func internalNodeSplitAndInsert(table *Table, parentPageNum, childPageNum uint32) (uint32, uint32, uint32) {
 	oldPageNum := parentPageNum
-	oldNode := getPage(table.pager, parentPageNum)
+	oldNode := getPageForWrite(table.pager, parentPageNum)
 	oldMax := getNodeMaxKey(table.pager, oldNode)
-
-	child := getPage(table.pager, childPageNum)
-	childMax := getNodeMaxKey(table.pager, child)
-
 	newPageNum := getUnusedPageNum(table.pager)
 
 	// Flag to indicate if we are splitting the root node
 	// 这个简短的注释是chatGPT总结后加上的...
 	splittingRoot := isNodeRoot(oldNode)
 
-	var parent, newNode []byte
+	var newNode []byte
 	if splittingRoot {
 		createNewRoot(table, newPageNum)
-		parent = getPage(table.pager, table.rootPageNum)
 		// If splitting root, update oldNode to point to the left child of the new root
-		oldPageNum = *internalNodeChild(parent, 0)
-		oldNode = getPage(table.pager, oldPageNum)
+		oldPageNum = *internalNodeChild(getPage(table.pager, table.rootPageNum), 0)
+		oldNode = getPageForWrite(table.pager, oldPageNum)
+		newNode = getPageForWrite(table.pager, newPageNum)
 	} else {
-		parent = getPage(table.pager, *nodeParent(oldNode))
-		newNode = getPage(table.pager, newPageNum)
+		newNode = getPageForWrite(table.pager, newPageNum)
 		initializeInternalNode(newNode)
+		*nodeParent(newNode) = *nodeParent(oldNode)
 	}
 
-	oldNumKeys := internalNodeNumKeys(oldNode)
-
-	curPageNum := *internalNodeRightChild(oldNode)
-	cur := getPage(table.pager, curPageNum)
-
-	// Move the right child into the new node and set the right child of old node to INVALID_PAGE_NUM
-	internalNodeInsert(table, newPageNum, curPageNum)
-	*nodeParent(cur) = newPageNum
-	*internalNodeRightChild(oldNode) = INVALID_PAGE_NUM
-
-	// Move keys and child nodes to the new node until the middle key
-	for i := INTERNAL_NODE_MAX_CELLS - 1; i > INTERNAL_NODE_MAX_CELLS/2; i-- {
-		curPageNum = *internalNodeChild(oldNode, uint32(i))
-		cur = getPage(table.pager, curPageNum)
-
-		internalNodeInsert(table, newPageNum, curPageNum)
-		*nodeParent(cur) = newPageNum
-
-		(*oldNumKeys)--
+	// 中间的键之后的单元格和右子节点移动到新节点，中间的键对应的子节点成为旧节点的右子节点
+	cells := internalNodeCells(oldNode)
+	splitPoint := internalNodeSplitPoint(cells)
+	internalNodeSetCells(newNode, cells[splitPoint+1:])
+	*internalNodeRightChild(newNode) = *internalNodeRightChild(oldNode)
+	internalNodeSetCells(oldNode, cells[:splitPoint])
+	*internalNodeRightChild(oldNode) = *internalCellChild(cells[splitPoint])
+	for i := uint32(0); i <= *internalNodeNumKeys(newNode); i++ {
+		*nodeParent(getPageForWrite(table.pager, *internalNodeChild(newNode, i))) = newPageNum
 	}
 
-	// Set the right child of old node to the highest key before the middle key and decrement the number of keys
-	*internalNodeRightChild(oldNode) = *internalNodeChild(oldNode, *oldNumKeys-1)
-	(*oldNumKeys)--
-
-	// Determine which of the split nodes should contain the child to be inserted
-	maxAfterSplit := getNodeMaxKey(table.pager, oldNode)
-	destinationPageNum := newPageNum
-
-	if childMax < maxAfterSplit {
-		destinationPageNum = oldPageNum
+	// Insert the child node into the appropriate split node.
+	// 分裂之后两边大约各占一半的空间，一定放得下
+	if childPageNum != INVALID_PAGE_NUM {
+		child := getPageForWrite(table.pager, childPageNum)
+		destinationPageNum := newPageNum
+		if bytes.Compare(getNodeMaxKey(table.pager, child), getNodeMaxKey(table.pager, oldNode)) < 0 {
+			destinationPageNum = oldPageNum
+		}
+		internalNodeInsert(table, destinationPageNum, childPageNum)
+		*nodeParent(child) = destinationPageNum
 	}
 
-	// Insert the child node into the appropriate split node
-	internalNodeInsert(table, destinationPageNum, childPageNum)
-	*nodeParent(child) = destinationPageNum
-
 	// Update the parent node's key to reflect the new highest key in the old node
-	updateInternalNodeKey(parent, oldMax, getNodeMaxKey(table.pager, oldNode))
-
-	// If not splitting the root, insert the new node into its parent
-	if !splittingRoot {
-		internalNodeInsert(table, *nodeParent(oldNode), newPageNum)
+	newMax := getNodeMaxKey(table.pager, oldNode)
+	if splittingRoot {
+		setInternalNodeKey(getPageForWrite(table.pager, table.rootPageNum), 0, newMax)
+	} else {
+		// 父节点修改键时可能分裂，新节点插入到旧节点当前的父节点中
+		updateInternalNodeKey(table, *nodeParent(oldNode), oldMax, newMax)
 		*nodeParent(newNode) = *nodeParent(oldNode)
+		internalNodeInsert(table, *nodeParent(oldNode), newPageNum)
 	}
+	return oldPageNum, newPageNum, splitPoint
 }
 
-func printTree(pager *Pager, pageNum, indentationLevel uint32) {
+// formatKey 把 key 转换成打印的文本
+func printTree(pager *Pager, pageNum, indentationLevel uint32, formatKey func([]byte) string) {
 	node := getPage(pager, pageNum)
 	numKeys, child := uint32(0), uint32(0)
 
@@ -552,8 +1570,9 @@ func printTree(pager *Pager, pageNum, indentationLevel uint32) {
 		fmt.Printf("- leaf (size %d)\n", numKeys)
 		for i := uint32(0); i < numKeys; i++ {
 			indent(indentationLevel + 1)
-			fmt.Printf("- %d\n", *leafNodeKey(node, i))
+			fmt.Printf("- %s\n", formatKey(leafNodeKey(node, i)))
 		}
+		pagerEvict(pager)
 	case NODE_INTERNAL:
 		numKeys = *internalNodeNumKeys(node)
 		indent(indentationLevel)
@@ -561,18 +1580,18 @@ func printTree(pager *Pager, pageNum, indentationLevel uint32) {
 		if numKeys > 0 {
 			for i := uint32(0); i < numKeys; i++ {
 				child = *internalNodeChild(node, i)
-				printTree(pager, child, indentationLevel+1)
+				printTree(pager, child, indentationLevel+1, formatKey)
 
 				indent(indentationLevel + 1)
-				fmt.Printf("- key %d\n", *internalNodeKey(node, i))
+				fmt.Printf("- key %s\n", formatKey(internalNodeKey(node, i)))
 			}
 			child = *internalNodeRightChild(node)
-			printTree(pager, child, indentationLevel+1)
+			printTree(pager, child, indentationLevel+1, formatKey)
 		}
 	}
 }
 
-func leafNodeFind(table *Table, pageNum, key uint32) *Cursor {
+func leafNodeFind(table *Table, pageNum uint32, key []byte) *Cursor {
 	node := getPage(table.pager, pageNum)
 	numCells := *leafNodeNumCells(node)
 	cursor := &Cursor{table: table, pageNum: pageNum}
@@ -582,12 +1601,12 @@ func leafNodeFind(table *Table, pageNum, key uint32) *Cursor {
 	onePastMaxIndex := numCells
 	for onePastMaxIndex != minIndex {
 		index := (minIndex + onePastMaxIndex) / 2
-		keyAtIndex := *leafNodeKey(node, index)
-		if key == keyAtIndex {
+		c := bytes.Compare(key, leafNodeKey(node, index))
+		if c == 0 {
 			cursor.cellNum = index
 			return cursor
 		}
-		if key < keyAtIndex {
+		if c < 0 {
 			onePastMaxIndex = index
 		} else {
 			minIndex = index + 1
@@ -598,7 +1617,7 @@ func leafNodeFind(table *Table, pageNum, key uint32) *Cursor {
 	return cursor
 }
 
-func internalNodeFind(table *Table, pageNum, key uint32) *Cursor {
+func internalNodeFind(table *Table, pageNum uint32, key []byte) *Cursor {
 	node := getPage(table.pager, pageNum)
 	numKeys := *internalNodeNumKeys(node)
 
@@ -608,8 +1627,8 @@ func internalNodeFind(table *Table, pageNum, key uint32) *Cursor {
 
 	for minIndex != maxIndex {
 		index := (minIndex + maxIndex) / 2
-		keyToRight := *internalNodeKey(node, index)
-		if keyToRight >= key {
+		keyToRight := internalNodeKey(node, index)
+		if bytes.Compare(keyToRight, key) >= 0 {
 			maxIndex = index
 		} else {
 			minIndex = index + 1
@@ -630,23 +1649,165 @@ func internalNodeFind(table *Table, pageNum, key uint32) *Cursor {
 	}
 }
 
-func tableFind(table *Table, key uint32) *Cursor {
-	rootPageNum := table.rootPageNum
-	rootNode := getPage(table.pager, rootPageNum)
+// 表的 key 是 rowid 翻转符号位之后的8字节大端序编码，按字节比较的顺序和按数值比较的顺序相同
+func encodeRowKey(key int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(key)^(1<<63))
+}
+
+func decodeRowKey(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key) ^ (1 << 63))
+}
+
+func formatRowKey(key []byte) string {
+	return strconv.FormatInt(decodeRowKey(key), 10)
+}
+
+// 把值编码之后追加到 key 的末尾
+func appendKeyValue(key []byte, value *Value) []byte {
+	switch value.typ {
+	case VALUE_INTEGER:
+		key = append(key, KEY_TAG_INTEGER)
+		return binary.BigEndian.AppendUint64(key, uint64(value.intValue)^(1<<63))
+	case VALUE_REAL:
+		// 负数翻转所有的位，正数翻转符号位，-0 和 0 相等
+		bits := math.Float64bits(value.floatValue)
+		if value.floatValue == 0 {
+			bits = 0
+		}
+		if bits>>63 == 1 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		key = append(key, KEY_TAG_REAL)
+		return binary.BigEndian.AppendUint64(key, bits)
+	case VALUE_BOOLEAN:
+		return append(key, KEY_TAG_BOOLEAN, byte(value.intValue))
+	case VALUE_TEXT, VALUE_BLOB:
+		if value.typ == VALUE_TEXT {
+			key = append(key, KEY_TAG_TEXT)
+		} else {
+			key = append(key, KEY_TAG_BLOB)
+		}
+		for i := 0; i < len(value.strValue); i++ {
+			key = append(key, value.strValue[i])
+			if value.strValue[i] == 0 {
+				key = append(key, 0xFF)
+			}
+		}
+		return append(key, 0, 0)
+	default:
+		return append(key, KEY_TAG_NULL)
+	}
+}
+
+// 解码 key 开头的一个值，返回剩下的部分
+func decodeKeyValue(key []byte, value *Value) []byte {
+	tag := key[0]
+	key = key[1:]
+	switch tag {
+	case KEY_TAG_INTEGER:
+		*value = Value{typ: VALUE_INTEGER, intValue: int64(binary.BigEndian.Uint64(key) ^ (1 << 63))}
+		return key[8:]
+	case KEY_TAG_REAL:
+		bits := binary.BigEndian.Uint64(key)
+		if bits>>63 == 1 {
+			bits &^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		*value = Value{typ: VALUE_REAL, floatValue: math.Float64frombits(bits)}
+		return key[8:]
+	case KEY_TAG_BOOLEAN:
+		*value = Value{typ: VALUE_BOOLEAN, intValue: int64(key[0])}
+		return key[1:]
+	case KEY_TAG_TEXT, KEY_TAG_BLOB:
+		var text []byte
+		i := 0
+		for ; key[i] != 0 || key[i+1] != 0; i++ {
+			text = append(text, key[i])
+			if key[i] == 0 {
+				i++
+			}
+		}
+		*value = Value{typ: VALUE_TEXT, strValue: string(text)}
+		if tag == KEY_TAG_BLOB {
+			value.typ = VALUE_BLOB
+		}
+		return key[i+2:]
+	default:
+		*value = Value{typ: VALUE_NULL}
+		return key
+	}
+}
+
+// 编码之后的 key 打印成其中的值，有多个值时打印成 (值, ...)。
+// rowKeySize 是 key 末尾 rowid 的字节数，没有 rowid 时是0
+func formatEncodedKey(key []byte, rowKeySize int) string {
+	var fields []string
+	for len(key) > rowKeySize {
+		var value Value
+		key = decodeKeyValue(key, &value)
+		fields = append(fields, formatValue(&value))
+	}
+	if rowKeySize > 0 {
+		fields = append(fields, formatRowKey(key))
+	}
+	if len(fields) == 1 {
+		return fields[0]
+	}
+	return "(" + strings.Join(fields, ", ") + ")"
+}
+
+// 返回指向给定 key 的游标，key 不存在时指向应该插入的位置
+func btreeFind(tree *Table, key []byte) *Cursor {
+	rootPageNum := tree.rootPageNum
+	rootNode := getPage(tree.pager, rootPageNum)
 	nodeType := getNodeType(rootNode)
 
 	if nodeType == NODE_LEAF {
-		return leafNodeFind(table, rootPageNum, key)
-	} else {
-		return internalNodeFind(table, rootPageNum, key)
+		return leafNodeFind(tree, rootPageNum, key)
 	}
-	return nil
+	return internalNodeFind(tree, rootPageNum, key)
 }
 
-func cursorValue(cursor *Cursor) []byte {
-	pageNum := cursor.pageNum
-	page := getPage(cursor.table.pager, pageNum)
-	return leafNodeValue(page, cursor.cellNum)
+func tableFind(table *Table, key int64) *Cursor {
+	return btreeFind(table, encodeRowKey(key))
+}
+
+// 返回指向第一个 key >= 给定 key 的行的游标，没有这样的行时游标在表的末尾
+func btreeSeek(tree *Table, key []byte) *Cursor {
+	cursor := btreeFind(tree, key)
+	node := getPage(tree.pager, cursor.pageNum)
+	if cursor.cellNum >= *leafNodeNumCells(node) {
+		// key 比这个叶子节点中所有的 key 都大，下一行在右边的兄弟节点中
+		nextPageNum := *leafNodeNextLeaf(node)
+		if nextPageNum == 0 {
+			cursor.endOfTable = true
+		} else {
+			cursor.pageNum = nextPageNum
+			cursor.cellNum = 0
+		}
+	}
+	return cursor
+}
+
+func tableSeek(table *Table, key int64) *Cursor {
+	return btreeSeek(table, encodeRowKey(key))
+}
+
+// 游标指向的行的 key，返回的切片在页被换出之前有效
+func cursorKey(cursor *Cursor) []byte {
+	return leafNodeKey(getPage(cursor.table.pager, cursor.pageNum), cursor.cellNum)
+}
+
+// 读出游标指向的行
+func cursorRow(cursor *Cursor, row *Row) {
+	page := getPage(cursor.table.pager, cursor.pageNum)
+	if cursor.table.primaryKey == nil {
+		row.key = decodeRowKey(leafNodeKey(page, cursor.cellNum))
+	}
+	deserializeRow(cursor.table, leafCellPayload(cursor.table.pager, leafNodeCell(page, cursor.cellNum)), row)
 }
 
 func cursorAdvance(cursor *Cursor) {
@@ -666,323 +1827,4691 @@ func cursorAdvance(cursor *Cursor) {
 	}
 }
 
-func pagerOpen(filename string) *Pager {
-	fileDescriptor, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		fmt.Printf("Unable to open file: %v\n", err)
-		os.Exit(1)
+// 退回到上一行，已经在第一行时设置 endOfTable
+func cursorRetreat(cursor *Cursor) {
+	if cursor.cellNum > 0 {
+		cursor.cellNum -= 1
+		return
+	}
+	/* 叶子节点之间只有向右的链表，沿着父节点向上找到第一个不是最左子节点的祖先，
+	   它左边的兄弟子树中最右边的叶子节点就是前一个叶子节点 */
+	pager := cursor.table.pager
+	pageNum := cursor.pageNum
+	for {
+		node := getPage(pager, pageNum)
+		if isNodeRoot(node) {
+			/* 这是最左边的叶子节点 */
+			cursor.endOfTable = true
+			return
+		}
+		parentPageNum := *nodeParent(node)
+		parent := getPage(pager, parentPageNum)
+		index := internalNodeChildIndex(parent, pageNum)
+		if index > 0 {
+			cursorToRightmost(cursor, *internalNodeChild(parent, index-1))
+			return
+		}
+		pageNum = parentPageNum
 	}
+}
 
-	fileLength, err := fileDescriptor.Seek(0, os.SEEK_END)
+// 游标指向以 pageNum 为根的子树中最后一行，子树为空时设置 endOfTable
+func cursorToRightmost(cursor *Cursor, pageNum uint32) {
+	node := getPage(cursor.table.pager, pageNum)
+	for getNodeType(node) == NODE_INTERNAL {
+		pageNum = *internalNodeRightChild(node)
+		node = getPage(cursor.table.pager, pageNum)
+	}
+	numCells := *leafNodeNumCells(node)
+	cursor.pageNum = pageNum
+	if numCells == 0 {
+		cursor.endOfTable = true
+	} else {
+		cursor.cellNum = numCells - 1
+	}
+}
+
+// 返回指向最后一个以给定 key 为前缀或者 <= 给定 key 的行的游标，没有这样的行时设置 endOfTable
+func btreeSeekLast(tree *Table, prefix []byte) *Cursor {
+	// 第一个比所有以 prefix 开头的 key 都大的 key 是去掉末尾的 0xFF 之后把最后一个字节加一
+	successor := slices.Clone(prefix)
+	for len(successor) > 0 && successor[len(successor)-1] == 0xFF {
+		successor = successor[:len(successor)-1]
+	}
+	if len(successor) > 0 {
+		successor[len(successor)-1]++
+		cursor := btreeSeek(tree, successor)
+		if !cursor.endOfTable {
+			cursorRetreat(cursor)
+			return cursor
+		}
+	}
+	cursor := &Cursor{table: tree}
+	cursorToRightmost(cursor, tree.rootPageNum)
+	return cursor
+}
+
+func tableSeekLast(table *Table, key int64) *Cursor {
+	return btreeSeekLast(table, encodeRowKey(key))
+}
+
+func pagerOpen(filename string) *Pager {
+	fileDescriptor, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		fmt.Printf("Unable to open file: %v\n", err)
+		os.Exit(1)
+	}
+
+	pager := &Pager{
+		filename:       filename,
+		fileDescriptor: fileDescriptor,
+		pages:          make(map[uint32]*CachedPage),
+		lru:            list.New(),
+		cacheSize:      PAGER_DEFAULT_CACHE_SIZE,
+		synchronous:    SYNCHRONOUS_FULL,
+	}
+
+	pagerRollbackHotJournal(pager)
+
+	fileLength, err := fileDescriptor.Seek(0, io.SeekEnd)
+	if err != nil {
+		fmt.Printf("Error seeking: %v\n", err)
+		os.Exit(1)
+	}
+	pager.fileLength = fileLength
+	pager.numPages = uint32(fileLength / PAGE_SIZE)
+
+	if fileLength%PAGE_SIZE != 0 {
+		fmt.Printf("Db file is not a whole number of pages. Corrupt file.\n")
+		os.Exit(1)
+	}
+
+	// WAL 中已提交的帧决定了数据库当前的大小
+	walNumPages := walOpen(pager, false)
+	if walNumPages != 0 {
+		pager.numPages = walNumPages
+	}
+	pager.origNumPages = pager.numPages
+
+	return pager
+}
+
+func initializeHeader(header []byte) {
+	copy(headerMagic(header), HEADER_MAGIC)
+	*headerVersion(header) = FILE_FORMAT_VERSION
+	*headerPageSize(header) = PAGE_SIZE
+	*headerRootPage(header) = ROOT_PAGE_NUM
+	*headerFreelistHead(header) = 0
+	*headerFreelistCount(header) = 0
+	*headerSchemaCookie(header) = 0
+}
+
+// 拒绝不是本程序创建的文件，以及格式不兼容的数据库文件
+func validateHeader(pager *Pager, header []byte) {
+	var magic [HEADER_MAGIC_SIZE]byte
+	copy(magic[:], HEADER_MAGIC)
+	if string(headerMagic(header)) != string(magic[:]) {
+		fmt.Printf("Error: file is not a database.\n")
+		os.Exit(1)
+	}
+
+	if *headerVersion(header) != FILE_FORMAT_VERSION {
+		fmt.Printf("Error: unsupported file format version %d, expected %d.\n", *headerVersion(header), FILE_FORMAT_VERSION)
+		os.Exit(1)
+	}
+
+	if *headerPageSize(header) != PAGE_SIZE {
+		fmt.Printf("Error: database page size %d does not match %d.\n", *headerPageSize(header), PAGE_SIZE)
+		os.Exit(1)
+	}
+
+	journalMode := *headerJournalMode(header)
+	if journalMode != JOURNAL_MODE_DELETE && journalMode != JOURNAL_MODE_WAL {
+		fmt.Printf("Error: unsupported journal mode %d.\n", journalMode)
+		os.Exit(1)
+	}
+
+	rootPageNum := *headerRootPage(header)
+	if rootPageNum == HEADER_PAGE_NUM || rootPageNum >= pager.numPages {
+		fmt.Printf("Error: root page %d is out of range. Corrupt file.\n", rootPageNum)
+		os.Exit(1)
+	}
+}
+
+func dbOpen(filename string) *Database {
+	pager := pagerOpen(filename)
+
+	db := &Database{
+		pager: pager,
+		catalog: &Table{
+			name:        CATALOG_TABLE_NAME,
+			rootPageNum: ROOT_PAGE_NUM,
+			pager:       pager,
+			columns: []Column{
+				{name: "name", typ: VALUE_TEXT},
+				{name: "rootpage", typ: VALUE_INTEGER},
+				{name: "sql", typ: VALUE_TEXT},
+			},
+			keyColumn: -1,
+		},
+		tables:         make(map[string]*Table),
+		indexes:        make(map[string]*Index),
+		sortBufferSize: SORTER_DEFAULT_BUFFER_SIZE,
+	}
+
+	if pager.numPages == 0 {
+		// New database file. Page 0 is the file header, initialize page 1 as the catalog's leaf node.
+		initializeHeader(getPageForWrite(pager, HEADER_PAGE_NUM))
+		rootNode := getPageForWrite(pager, ROOT_PAGE_NUM)
+		initializeLeafNode(rootNode)
+		setNodeRoot(rootNode, true)
+		return db
+	}
+
+	header := getPage(pager, HEADER_PAGE_NUM)
+	validateHeader(pager, header)
+
+	pager.journalMode = *headerJournalMode(header)
+	if pager.journalMode == JOURNAL_MODE_WAL && pager.walFile == nil {
+		walOpen(pager, true)
+	}
+
+	loadSchema(db)
+	return db
+}
+
+// 从系统表中加载所有表和索引的结构，建表和建索引的语句重新解析一遍。
+// 索引总是在它的表之后创建，加载索引时表已经加载了
+func loadSchema(db *Database) {
+	db.catalog.rootPageNum = *headerRootPage(getPage(db.pager, HEADER_PAGE_NUM))
+	db.tables = make(map[string]*Table)
+	db.indexes = make(map[string]*Index)
+
+	var row Row
+	cursor := tableStart(db.catalog)
+	for !cursor.endOfTable {
+		cursorRow(cursor, &row)
+		sql := row.values[2].strValue
+		rootPageNum := uint32(row.values[1].intValue)
+
+		var parser Parser
+		var statement Statement
+		result := PREPARE_SYNTAX_ERROR
+		if tokenize(&parser, sql) && parseStatement(&parser, &statement) == PREPARE_SUCCESS {
+			switch statement.typ {
+			case STATEMENT_CREATE_TABLE:
+				table := &Table{pager: db.pager, sql: sql}
+				if result = buildTable(&statement, table); result == PREPARE_SUCCESS {
+					table.rootPageNum = rootPageNum
+					table.catalogKey = row.key
+					db.tables[table.name] = table
+				}
+			case STATEMENT_CREATE_INDEX:
+				index := &Index{sql: sql}
+				if table := db.tables[statement.tableName]; table != nil {
+					if result = buildIndex(&statement, table, index); result == PREPARE_SUCCESS {
+						index.tree.rootPageNum = rootPageNum
+						index.catalogKey = row.key
+						table.indexes = append(table.indexes, index)
+						db.indexes[index.name] = index
+					}
+				}
+			}
+		}
+		if result != PREPARE_SUCCESS {
+			fmt.Printf("Error: malformed database schema (%s).\n", row.values[0].strValue)
+			os.Exit(1)
+		}
+
+		cursorAdvance(cursor)
+	}
+}
+
+// 按照创建的顺序返回所有的表
+func sortedTables(db *Database) []*Table {
+	var tables []*Table
+	for _, table := range db.tables {
+		tables = append(tables, table)
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].catalogKey < tables[j].catalogKey })
+	return tables
+}
+
+func pagerFlush(pager *Pager, pageNum uint32) {
+	cached, ok := pager.pages[pageNum]
+	if !ok {
+		fmt.Printf("Tried to flush null page\n")
+		os.Exit(1)
+	}
+
+	if pager.journalMode == JOURNAL_MODE_WAL {
+		// 没有提交的页不能覆盖数据库文件，先作为未提交的帧写入 WAL
+		walWriteFrame(pager, pageNum, cached.data, 0)
+		pagerMarkClean(pager, cached)
+		return
+	}
+
+	pagerSyncJournal(pager)
+
+	offset, err := pager.fileDescriptor.Seek(int64(pageNum)*PAGE_SIZE, io.SeekStart)
 	if err != nil {
 		fmt.Printf("Error seeking: %v\n", err)
 		os.Exit(1)
 	}
 
-	pager := &Pager{
-		fileDescriptor: fileDescriptor,
-		fileLength:     uint32(fileLength),
-		numPages:       uint32(fileLength / PAGE_SIZE),
+	if offset != int64(pageNum)*PAGE_SIZE {
+		fmt.Printf("Seek offset does not match page start\n")
+		os.Exit(1)
+	}
+
+	_, err = pager.fileDescriptor.Write(cached.data[:PAGE_SIZE])
+	if err != nil {
+		fmt.Printf("Error writing: %v\n", err)
+		os.Exit(1)
+	}
+	pagerMarkClean(pager, cached)
+
+	// 被淘汰的页可能写在文件末尾之后，之后需要从文件中重新读取
+	if offset+PAGE_SIZE > pager.fileLength {
+		pager.fileLength = offset + PAGE_SIZE
+	}
+}
+
+func pagerMarkClean(pager *Pager, cached *CachedPage) {
+	pager.pagesWritten++
+	if cached.dirty {
+		cached.dirty = false
+		pager.numDirty--
+	}
+}
+
+func walFilename(pager *Pager) string {
+	return pager.filename + "-wal"
+}
+
+func walFindFrame(pager *Pager, pageNum uint32) (int64, bool) {
+	if offset, ok := pager.walPending[pageNum]; ok {
+		return offset, true
+	}
+	offset, ok := pager.walIndex[pageNum]
+	return offset, ok
+}
+
+// 打开 WAL 文件并重建索引，返回最后一次提交时数据库的页数，没有提交过时返回0。
+// 文件不存在时，只有 create 为 true 才会创建。
+func walOpen(pager *Pager, create bool) uint32 {
+	flag := os.O_RDWR
+	if create {
+		flag |= os.O_CREATE
+	}
+	walFile, err := os.OpenFile(walFilename(pager), flag, 0644)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0
+		}
+		fmt.Printf("Unable to open wal file: %v\n", err)
+		os.Exit(1)
+	}
+
+	pager.walFile = walFile
+	pager.walIndex = make(map[uint32]int64)
+	pager.walPending = make(map[uint32]int64)
+
+	header := make([]byte, WAL_HEADER_SIZE)
+	var magic [WAL_MAGIC_SIZE]byte
+	copy(magic[:], WAL_MAGIC)
+	_, err = walFile.ReadAt(header, 0)
+	if err != nil || string(header[:WAL_MAGIC_SIZE]) != string(magic[:]) ||
+		binary.LittleEndian.Uint32(header[WAL_PAGE_SIZE_OFFSET:]) != PAGE_SIZE ||
+		binary.LittleEndian.Uint32(header[WAL_HEADER_SUM_OFFSET:]) != crc32.ChecksumIEEE(header[:WAL_HEADER_SUM_OFFSET]) {
+		// 文件头不完整，说明还没有写入任何帧
+		walReset(pager)
+		return 0
+	}
+	pager.walSeq = binary.LittleEndian.Uint32(header[WAL_CHECKPOINT_SEQ_OFFSET:])
+	pager.walSalt = binary.LittleEndian.Uint32(header[WAL_SALT_OFFSET:])
+
+	// 依次校验每一帧，遇到不完整或者校验失败的帧就停止，最后一个提交帧之后的帧被丢弃
+	numPages := uint32(0)
+	frames := make(map[uint32]int64)
+	frame := make([]byte, WAL_FRAME_SIZE)
+	pager.walCommitEnd = WAL_HEADER_SIZE
+	for offset := int64(WAL_HEADER_SIZE); ; offset += WAL_FRAME_SIZE {
+		_, err = walFile.ReadAt(frame, offset)
+		if err != nil {
+			break
+		}
+		if binary.LittleEndian.Uint32(frame[WAL_FRAME_SALT_OFFSET:]) != pager.walSalt ||
+			binary.LittleEndian.Uint32(frame[WAL_FRAME_SUM_OFFSET:]) != walFrameChecksum(frame) {
+			break
+		}
+		frames[binary.LittleEndian.Uint32(frame[WAL_FRAME_PAGE_OFFSET:])] = offset + WAL_FRAME_HEADER_SIZE
+		commitSize := binary.LittleEndian.Uint32(frame[WAL_FRAME_COMMIT_OFFSET:])
+		if commitSize != 0 {
+			for pageNum, frameOffset := range frames {
+				pager.walIndex[pageNum] = frameOffset
+			}
+			frames = make(map[uint32]int64)
+			numPages = commitSize
+			pager.walCommitEnd = offset + WAL_FRAME_SIZE
+		}
+	}
+	pager.walEnd = pager.walCommitEnd
+
+	return numPages
+}
+
+func walFrameChecksum(frame []byte) uint32 {
+	checksum := crc32.ChecksumIEEE(frame[:WAL_FRAME_SUM_OFFSET])
+	return crc32.Update(checksum, crc32.IEEETable, frame[WAL_FRAME_HEADER_SIZE:])
+}
+
+// 清空 WAL，换一个新的 salt，旧的帧即使还留在文件中也不会再被当作有效的帧
+func walReset(pager *Pager) {
+	salt := rand.Uint32()
+	for salt == pager.walSalt {
+		salt = rand.Uint32()
+	}
+	pager.walSalt = salt
+	pager.walSeq++
+
+	header := make([]byte, WAL_HEADER_SIZE)
+	copy(header[:WAL_MAGIC_SIZE], WAL_MAGIC)
+	binary.LittleEndian.PutUint32(header[WAL_PAGE_SIZE_OFFSET:], PAGE_SIZE)
+	binary.LittleEndian.PutUint32(header[WAL_CHECKPOINT_SEQ_OFFSET:], pager.walSeq)
+	binary.LittleEndian.PutUint32(header[WAL_SALT_OFFSET:], pager.walSalt)
+	binary.LittleEndian.PutUint32(header[WAL_HEADER_SUM_OFFSET:], crc32.ChecksumIEEE(header[:WAL_HEADER_SUM_OFFSET]))
+
+	err := pager.walFile.Truncate(0)
+	if err == nil {
+		_, err = pager.walFile.WriteAt(header, 0)
+	}
+	if err == nil && pager.synchronous != SYNCHRONOUS_OFF {
+		err = pager.walFile.Sync()
+	}
+	if err != nil {
+		fmt.Printf("Error resetting wal: %v\n", err)
+		os.Exit(1)
+	}
+
+	pager.walIndex = make(map[uint32]int64)
+	pager.walPending = make(map[uint32]int64)
+	pager.walEnd = WAL_HEADER_SIZE
+	pager.walCommitEnd = WAL_HEADER_SIZE
+}
+
+// 在 WAL 末尾追加一帧，commitSize 不为0表示这是事务的提交帧
+func walWriteFrame(pager *Pager, pageNum uint32, data []byte, commitSize uint32) {
+	frame := make([]byte, WAL_FRAME_SIZE)
+	binary.LittleEndian.PutUint32(frame[WAL_FRAME_PAGE_OFFSET:], pageNum)
+	binary.LittleEndian.PutUint32(frame[WAL_FRAME_COMMIT_OFFSET:], commitSize)
+	binary.LittleEndian.PutUint32(frame[WAL_FRAME_SALT_OFFSET:], pager.walSalt)
+	copy(frame[WAL_FRAME_HEADER_SIZE:], data[:PAGE_SIZE])
+	binary.LittleEndian.PutUint32(frame[WAL_FRAME_SUM_OFFSET:], walFrameChecksum(frame))
+
+	_, err := pager.walFile.WriteAt(frame, pager.walEnd)
+	if err != nil {
+		fmt.Printf("Error writing wal: %v\n", err)
+		os.Exit(1)
+	}
+	pager.walPending[pageNum] = pager.walEnd + WAL_FRAME_HEADER_SIZE
+	pager.walEnd += WAL_FRAME_SIZE
+}
+
+// WAL 模式下的提交：把脏页追加到 WAL，最后一帧标记为提交帧并同步 WAL
+func walCommit(pager *Pager) {
+	if pager.numDirty == 0 && len(pager.walPending) == 0 {
+		return
+	}
+	if pager.numDirty == 0 {
+		// 修改过的页都已经被淘汰写入 WAL，提交帧需要任意一页的内容
+		getPageForWrite(pager, HEADER_PAGE_NUM)
+	}
+
+	var dirtyPages []uint32
+	for pageNum, cached := range pager.pages {
+		if cached.dirty {
+			dirtyPages = append(dirtyPages, pageNum)
+		}
+	}
+	sort.Slice(dirtyPages, func(i, j int) bool { return dirtyPages[i] < dirtyPages[j] })
+
+	for i, pageNum := range dirtyPages {
+		cached := pager.pages[pageNum]
+		commitSize := uint32(0)
+		if i == len(dirtyPages)-1 {
+			commitSize = pager.numPages
+		}
+		walWriteFrame(pager, pageNum, cached.data, commitSize)
+		pagerMarkClean(pager, cached)
+	}
+
+	if pager.synchronous == SYNCHRONOUS_FULL {
+		err := pager.walFile.Sync()
+		if err != nil {
+			fmt.Printf("Error syncing wal: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	for pageNum, offset := range pager.walPending {
+		pager.walIndex[pageNum] = offset
+	}
+	pager.walPending = make(map[uint32]int64)
+	pager.walCommitEnd = pager.walEnd
+	pager.origNumPages = pager.numPages
+
+	if (pager.walCommitEnd-WAL_HEADER_SIZE)/WAL_FRAME_SIZE >= WAL_AUTOCHECKPOINT {
+		walCheckpoint(pager)
+	}
+}
+
+// 检查点：把 WAL 中每一页最新的已提交帧复制回数据库文件，然后清空 WAL。
+// 只能在提交之后调用，此时没有未提交的帧。
+func walCheckpoint(pager *Pager) {
+	// NORMAL 级别下提交时没有同步 WAL，覆盖数据库文件之前必须先同步
+	if pager.synchronous != SYNCHRONOUS_OFF {
+		err := pager.walFile.Sync()
+		if err != nil {
+			fmt.Printf("Error syncing wal: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	page := make([]byte, PAGE_SIZE)
+	for pageNum, offset := range pager.walIndex {
+		if pageNum >= pager.numPages {
+			continue
+		}
+		_, err := pager.walFile.ReadAt(page, offset)
+		if err != nil {
+			fmt.Printf("Error reading wal: %v\n", err)
+			os.Exit(1)
+		}
+		_, err = pager.fileDescriptor.WriteAt(page, int64(pageNum)*PAGE_SIZE)
+		if err != nil {
+			fmt.Printf("Error writing: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	pager.fileLength = int64(pager.numPages) * PAGE_SIZE
+	err := pager.fileDescriptor.Truncate(pager.fileLength)
+	if err == nil && pager.synchronous != SYNCHRONOUS_OFF {
+		err = pager.fileDescriptor.Sync()
+	}
+	if err != nil {
+		fmt.Printf("Error syncing db file: %v\n", err)
+		os.Exit(1)
+	}
+
+	walReset(pager)
+}
+
+// 切换日志模式。先用原来的模式提交，离开 WAL 模式前要先执行检查点，
+// 文件头中的模式用回滚日志模式提交，保证切换本身是原子的。
+func pagerSetJournalMode(pager *Pager, mode uint32) {
+	pagerCommit(pager)
+	if pager.journalMode == mode {
+		return
+	}
+
+	if pager.journalMode == JOURNAL_MODE_WAL {
+		walCheckpoint(pager)
+		walClose(pager)
+	}
+	pager.journalMode = JOURNAL_MODE_DELETE
+
+	header := getPageForWrite(pager, HEADER_PAGE_NUM)
+	*headerJournalMode(header) = mode
+	pagerCommit(pager)
+
+	if mode == JOURNAL_MODE_WAL {
+		walOpen(pager, true)
+		pager.journalMode = JOURNAL_MODE_WAL
+	}
+}
+
+// 关闭并删除 WAL 文件，调用前必须已经执行过检查点
+func walClose(pager *Pager) {
+	pager.walFile.Close()
+	err := os.Remove(walFilename(pager))
+	if err != nil {
+		fmt.Printf("Error deleting wal: %v\n", err)
+		os.Exit(1)
+	}
+	pager.walFile = nil
+	pager.walIndex = nil
+	pager.walPending = nil
+}
+
+func dbClose(db *Database) {
+	pager := db.pager
+
+	// 没有 commit 的事务在关闭时回滚
+	if pager.inTransaction {
+		pagerRollback(pager)
+		pager.inTransaction = false
+	}
+	pagerCommit(pager)
+	if pager.journalMode == JOURNAL_MODE_WAL {
+		walCheckpoint(pager)
+		walClose(pager)
+	}
+	for pageNum := range pager.pages {
+		pagerDropPage(pager, pageNum)
+	}
+
+	err := pager.fileDescriptor.Close()
+	if err != nil {
+		fmt.Printf("Error closing db file: %v\n", err)
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+}
+
+func printPrompt() {
+	fmt.Print("db > ")
+}
+
+func readInput(reader *bufio.Reader, db *Database, inputBuffer *InputBuffer) {
+	// chatGPT init error, need to debug
+	//reader := bufio.NewReader(os.Stdin)
+	buffer, err := reader.ReadString('\n')
+	if err != nil {
+		dbClose(db)
+		if err == io.EOF {
+			os.Exit(0)
+		}
+		fmt.Println("Error reading input: ", err.Error())
+		os.Exit(1)
+	}
+
+	// Ignore newline character
+	buffer = buffer[:len(buffer)-1]
+	inputBuffer.inputLength = len(buffer)
+	inputBuffer.buffer = buffer
+}
+
+func closeInputBuffer(inputBuffer *InputBuffer) {
+	inputBuffer.buffer = ""
+}
+
+func doMetaCommand(inputBuffer *InputBuffer, db *Database) MetaCommandResult {
+	if inputBuffer.buffer == ".exit" {
+		closeInputBuffer(inputBuffer)
+		dbClose(db)
+		return META_COMMAND_SUCCESS
+	} else if strings.HasPrefix(inputBuffer.buffer, ".btree") {
+		return doBtree(inputBuffer, db)
+	} else if inputBuffer.buffer == ".tables" {
+		for _, table := range sortedTables(db) {
+			fmt.Printf("%s\n", table.name)
+		}
+		return META_COMMAND_SUCCESS
+	} else if inputBuffer.buffer == ".schema" {
+		// 自动创建的索引由建表语句中的 UNIQUE 定义，不打印
+		var row Row
+		for cursor := tableStart(db.catalog); !cursor.endOfTable; cursorAdvance(cursor) {
+			cursorRow(cursor, &row)
+			if !strings.HasPrefix(row.values[0].strValue, AUTOINDEX_PREFIX) {
+				fmt.Printf("%s;\n", row.values[2].strValue)
+			}
+		}
+		return META_COMMAND_SUCCESS
+	} else if inputBuffer.buffer == ".vacuum" {
+		if !checkNoTransaction(inputBuffer, db) {
+			return META_COMMAND_SUCCESS
+		}
+		vacuum(db)
+		return META_COMMAND_SUCCESS
+	} else if inputBuffer.buffer == ".flush" {
+		if !checkNoTransaction(inputBuffer, db) {
+			return META_COMMAND_SUCCESS
+		}
+		pagerCommit(db.pager)
+		return META_COMMAND_SUCCESS
+	} else if inputBuffer.buffer == ".stats" {
+		printPagerStats(db.pager)
+		return META_COMMAND_SUCCESS
+	} else if inputBuffer.buffer == ".checkpoint" {
+		if !checkNoTransaction(inputBuffer, db) {
+			return META_COMMAND_SUCCESS
+		}
+		pagerCommit(db.pager)
+		if db.pager.journalMode == JOURNAL_MODE_WAL {
+			walCheckpoint(db.pager)
+		}
+		return META_COMMAND_SUCCESS
+	} else if strings.HasPrefix(inputBuffer.buffer, ".synchronous") {
+		return doSynchronous(inputBuffer, db)
+	} else if strings.HasPrefix(inputBuffer.buffer, ".journal_mode") {
+		return doJournalMode(inputBuffer, db)
+	} else if strings.HasPrefix(inputBuffer.buffer, ".cache_size") {
+		return doCacheSize(inputBuffer, db)
+	} else if strings.HasPrefix(inputBuffer.buffer, ".sort_buffer_size") {
+		return doSortBufferSize(inputBuffer, db)
+	} else if inputBuffer.buffer == ".constants" {
+		fmt.Printf(("Constants:\n"))
+		printConstants()
+		return META_COMMAND_SUCCESS
+	} else {
+		return META_COMMAND_UNRECOGNIZED_COMMAND
+	}
+}
+
+// .btree 打印第一张表的 B 树，.btree name 打印指定的表或者索引
+func doBtree(inputBuffer *InputBuffer, db *Database) MetaCommandResult {
+	tokens := strings.Fields(inputBuffer.buffer)
+	if tokens[0] != ".btree" || len(tokens) > 2 {
+		return META_COMMAND_UNRECOGNIZED_COMMAND
+	}
+
+	var table *Table
+	var index *Index
+	if len(tokens) == 2 {
+		table = db.tables[tokens[1]]
+		if tokens[1] == CATALOG_TABLE_NAME {
+			table = db.catalog
+		}
+		if index = db.indexes[tokens[1]]; index != nil {
+			table = db.tables[index.tableName]
+		}
+	} else if tables := sortedTables(db); len(tables) > 0 {
+		table = tables[0]
+	}
+	if table == nil {
+		fmt.Printf("Error: no such table.\n")
+		return META_COMMAND_SUCCESS
+	}
+
+	// 有 PRIMARY KEY 的表的 key 是编码之后的主键列，索引的 key 是列值加上表的 key
+	rowKeySize := ROW_KEY_SIZE
+	if table.primaryKey != nil {
+		rowKeySize = 0
+	}
+	tree, formatKey := table, formatRowKey
+	if index != nil || table.primaryKey != nil {
+		formatKey = func(key []byte) string {
+			return formatEncodedKey(key, rowKeySize)
+		}
+	}
+	if index != nil {
+		tree = index.tree
+	}
+
+	fmt.Printf(("Tree:\n"))
+	printTree(db.pager, tree.rootPageNum, 0, formatKey)
+	return META_COMMAND_SUCCESS
+}
+
+// 这些命令会提交修改，不能在事务中执行
+func checkNoTransaction(inputBuffer *InputBuffer, db *Database) bool {
+	if db.pager.inTransaction {
+		fmt.Printf("Error: cannot run '%s' inside a transaction.\n", inputBuffer.buffer)
+		return false
+	}
+	return true
+}
+
+// .cache_size 显示页缓存的大小，.cache_size N 修改它
+func doCacheSize(inputBuffer *InputBuffer, db *Database) MetaCommandResult {
+	tokens := strings.Fields(inputBuffer.buffer)
+	if tokens[0] != ".cache_size" || len(tokens) > 2 {
+		return META_COMMAND_UNRECOGNIZED_COMMAND
+	}
+	if len(tokens) == 1 {
+		fmt.Printf("cache_size: %d\n", db.pager.cacheSize)
+		return META_COMMAND_SUCCESS
+	}
+
+	cacheSize, err := strconv.Atoi(tokens[1])
+	if err != nil || cacheSize <= 0 {
+		fmt.Printf("Cache size must be a positive number.\n")
+		return META_COMMAND_SUCCESS
+	}
+	db.pager.cacheSize = cacheSize
+	pagerEvict(db.pager)
+	return META_COMMAND_SUCCESS
+}
+
+// .sort_buffer_size 显示排序使用的内存大小，.sort_buffer_size N 修改它
+func doSortBufferSize(inputBuffer *InputBuffer, db *Database) MetaCommandResult {
+	tokens := strings.Fields(inputBuffer.buffer)
+	if tokens[0] != ".sort_buffer_size" || len(tokens) > 2 {
+		return META_COMMAND_UNRECOGNIZED_COMMAND
+	}
+	if len(tokens) == 1 {
+		fmt.Printf("sort_buffer_size: %d\n", db.sortBufferSize)
+		return META_COMMAND_SUCCESS
+	}
+
+	size, err := strconv.Atoi(tokens[1])
+	if err != nil || size <= 0 {
+		fmt.Printf("Sort buffer size must be a positive number.\n")
+		return META_COMMAND_SUCCESS
+	}
+	db.sortBufferSize = size
+	return META_COMMAND_SUCCESS
+}
+
+// .journal_mode 显示日志模式，.journal_mode delete|wal 切换日志模式
+func doJournalMode(inputBuffer *InputBuffer, db *Database) MetaCommandResult {
+	tokens := strings.Fields(inputBuffer.buffer)
+	if tokens[0] != ".journal_mode" || len(tokens) > 2 {
+		return META_COMMAND_UNRECOGNIZED_COMMAND
+	}
+
+	if len(tokens) == 2 {
+		if !checkNoTransaction(inputBuffer, db) {
+			return META_COMMAND_SUCCESS
+		}
+		switch tokens[1] {
+		case "delete":
+			pagerSetJournalMode(db.pager, JOURNAL_MODE_DELETE)
+		case "wal":
+			pagerSetJournalMode(db.pager, JOURNAL_MODE_WAL)
+		default:
+			fmt.Printf("Journal mode must be delete or wal.\n")
+			return META_COMMAND_SUCCESS
+		}
+	}
+
+	if db.pager.journalMode == JOURNAL_MODE_WAL {
+		fmt.Printf("journal_mode: wal\n")
+	} else {
+		fmt.Printf("journal_mode: delete\n")
+	}
+	return META_COMMAND_SUCCESS
+}
+
+// .synchronous 显示同步级别，.synchronous off|normal|full 修改它
+func doSynchronous(inputBuffer *InputBuffer, db *Database) MetaCommandResult {
+	tokens := strings.Fields(inputBuffer.buffer)
+	if tokens[0] != ".synchronous" || len(tokens) > 2 {
+		return META_COMMAND_UNRECOGNIZED_COMMAND
+	}
+
+	names := []string{"off", "normal", "full"}
+	if len(tokens) == 2 {
+		level := -1
+		for i, name := range names {
+			if tokens[1] == name {
+				level = i
+			}
+		}
+		if level < 0 {
+			fmt.Printf("Synchronous must be off, normal or full.\n")
+			return META_COMMAND_SUCCESS
+		}
+		db.pager.synchronous = level
+	}
+
+	fmt.Printf("synchronous: %s\n", names[db.pager.synchronous])
+	return META_COMMAND_SUCCESS
+}
+
+/*
+ * SQL 词法分析
+ * 关键字不区分大小写，统一转换成大写；标识符转换成小写，用双引号括起来的标识符保持原样。
+ * 字符串用单引号括起来，两个连续的单引号表示一个单引号。
+ */
+type TokenType int
+
+const (
+	TOKEN_EOF TokenType = iota
+	TOKEN_KEYWORD
+	TOKEN_IDENTIFIER
+	TOKEN_INTEGER
+	TOKEN_REAL
+	TOKEN_STRING
+	TOKEN_BLOB // X'..'，text 是十六进制的内容
+	TOKEN_SYMBOL
+)
+
+type Token struct {
+	typ  TokenType
+	text string // 字符串是去掉引号之后的内容
+	pos  int    // token 在输入中的位置，从1开始
+}
+
+var keywords = map[string]bool{
+	"ADD": true, "ALTER": true, "AND": true, "AS": true, "ASC": true, "BEGIN": true,
+	"BETWEEN": true, "BY": true, "CHECK": true, "COLUMN": true, "COMMIT": true, "CONSTRAINT": true, "CREATE": true,
+	"DEFAULT": true, "DELETE": true, "DESC": true, "DROP": true, "FALSE": true,
+	"FROM": true, "GROUP": true, "HAVING": true, "IN": true, "INDEX": true, "INSERT": true, "INTO": true, "IS": true,
+	"KEY": true, "LIKE": true, "LIMIT": true, "NOT": true, "NULL": true, "OFFSET": true, "ON": true, "OR": true,
+	"ORDER": true, "PRIMARY": true, "ROLLBACK": true, "SELECT": true, "SET": true,
+	"TABLE": true, "TRANSACTION": true, "TRUE": true, "UNIQUE": true, "UPDATE": true,
+	"VALUES": true, "WHERE": true,
+}
+
+// 两个字符的符号要放在前面，优先匹配
+var symbols = []string{"<=", ">=", "!=", "<>", "||", "(", ")", ",", ";", "*", "=", "<", ">", "+", "-", "/"}
+
+func isIdentifierStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func tokenize(parser *Parser, input string) bool {
+	parser.input = input
+	i := 0
+	for i < len(input) {
+		c := input[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+			continue
+		case (c == 'x' || c == 'X') && i+1 < len(input) && input[i+1] == '\'':
+			end := strings.IndexByte(input[i+2:], '\'')
+			if end < 0 {
+				parser.errMsg = fmt.Sprintf("Syntax error at position %d: unterminated blob.", start+1)
+				return false
+			}
+			text := input[i+2 : i+2+end]
+			if _, err := hex.DecodeString(text); err != nil {
+				parser.errMsg = fmt.Sprintf("Syntax error at position %d: malformed blob literal.", start+1)
+				return false
+			}
+			parser.tokens = append(parser.tokens, Token{TOKEN_BLOB, text, start + 1})
+			i += end + 3
+			continue
+		case isIdentifierStart(c):
+			for i < len(input) && (isIdentifierStart(input[i]) || isDigit(input[i])) {
+				i++
+			}
+			word := input[start:i]
+			if keywords[strings.ToUpper(word)] {
+				parser.tokens = append(parser.tokens, Token{TOKEN_KEYWORD, strings.ToUpper(word), start + 1})
+			} else {
+				parser.tokens = append(parser.tokens, Token{TOKEN_IDENTIFIER, strings.ToLower(word), start + 1})
+			}
+			continue
+		case isDigit(c):
+			for i < len(input) && isDigit(input[i]) {
+				i++
+			}
+			// 有小数部分或者指数的是 REAL
+			typ := TOKEN_INTEGER
+			if i+1 < len(input) && input[i] == '.' && isDigit(input[i+1]) {
+				typ = TOKEN_REAL
+				for i++; i < len(input) && isDigit(input[i]); i++ {
+				}
+			}
+			if i < len(input) && (input[i] == 'e' || input[i] == 'E') {
+				j := i + 1
+				if j < len(input) && (input[j] == '+' || input[j] == '-') {
+					j++
+				}
+				if j < len(input) && isDigit(input[j]) {
+					typ = TOKEN_REAL
+					for i = j; i < len(input) && isDigit(input[i]); i++ {
+					}
+				}
+			}
+			parser.tokens = append(parser.tokens, Token{typ, input[start:i], start + 1})
+			continue
+		case c == '\'' || c == '"':
+			var text strings.Builder
+			i++
+			for {
+				if i >= len(input) {
+					parser.errMsg = fmt.Sprintf("Syntax error at position %d: unterminated %s.", start+1,
+						map[byte]string{'\'': "string", '"': "identifier"}[c])
+					return false
+				}
+				if input[i] == c {
+					if i+1 < len(input) && input[i+1] == c {
+						text.WriteByte(c)
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				text.WriteByte(input[i])
+				i++
+			}
+			if c == '\'' {
+				parser.tokens = append(parser.tokens, Token{TOKEN_STRING, text.String(), start + 1})
+			} else {
+				parser.tokens = append(parser.tokens, Token{TOKEN_IDENTIFIER, text.String(), start + 1})
+			}
+			continue
+		}
+
+		matched := false
+		for _, symbol := range symbols {
+			if strings.HasPrefix(input[i:], symbol) {
+				parser.tokens = append(parser.tokens, Token{TOKEN_SYMBOL, symbol, start + 1})
+				i += len(symbol)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			parser.errMsg = fmt.Sprintf("Syntax error at position %d: unrecognized token '%c'.", start+1, c)
+			return false
+		}
+	}
+	parser.tokens = append(parser.tokens, Token{TOKEN_EOF, "", len(input) + 1})
+	return true
+}
+
+/*
+ * SQL 语法树
+ */
+type ExprType int
+
+const (
+	EXPR_INTEGER ExprType = iota
+	EXPR_REAL
+	EXPR_STRING
+	EXPR_BLOB
+	EXPR_BOOLEAN
+	EXPR_NULL
+	EXPR_COLUMN
+	EXPR_STAR // select 中的 *
+	EXPR_UNARY
+	EXPR_BINARY
+	EXPR_IN       // left IN (list)
+	EXPR_FUNCTION // 函数调用，strValue 是函数名，list 是参数
+	// 语义检查之后的聚合函数调用，结果保存在分组的行中 columnIndex 的位置
+	EXPR_AGGREGATE
+)
+
+type Expr struct {
+	typ        ExprType
+	pos        int
+	op         string // 运算符，AND OR NOT LIKE 和 IS NULL 是大写的，<> 统一成 !=
+	left       *Expr
+	right      *Expr // 一元运算只有 left
+	list       []*Expr
+	intValue   int64 // 整数常量，TRUE 是 1，FALSE 是 0
+	floatValue float64
+	strValue   string // 字符串常量、BLOB 常量或者列名
+	// 语义检查之后列名对应的下标，-1 表示隐藏的 rowid
+	// 聚合函数是它的结果在分组的行中的下标，排在表的所有列之后
+	columnIndex int
+	// 语义检查之后函数调用结果的类型
+	resultType ValueType
+}
+
+type ColumnDef struct {
+	name         string
+	typeName     string
+	size         int // VARCHAR(32) 中的长度
+	primaryKey   bool
+	notNull      bool
+	unique       bool
+	defaultValue *Expr
+	checks       []Check
+	sql          string // 列定义的原文，alter table 把它加到建表语句中
+}
+
+type Assignment struct {
+	column string
+	value  *Expr
+}
+
+// ORDER BY 中的一项
+type OrderTerm struct {
+	expr *Expr
+	desc bool
+}
+
+/*
+ * 递归下降的语法分析，出错时记录第一个错误，之后的解析函数直接返回
+ */
+type Parser struct {
+	input  string
+	tokens []Token
+	pos    int
+	errMsg string
+}
+
+func peekToken(parser *Parser) *Token {
+	return &parser.tokens[parser.pos]
+}
+
+func nextToken(parser *Parser) *Token {
+	token := &parser.tokens[parser.pos]
+	if token.typ != TOKEN_EOF {
+		parser.pos++
+	}
+	return token
+}
+
+func parserError(parser *Parser, token *Token, message string) {
+	if parser.errMsg != "" {
+		return
+	}
+	parser.errMsg = fmt.Sprintf("Syntax error at position %d: %s.", token.pos, message)
+}
+
+// 当前 token 不是期望的内容
+func parserExpected(parser *Parser, expected string) {
+	token := peekToken(parser)
+	switch token.typ {
+	case TOKEN_EOF:
+		parserError(parser, token, "unexpected end of input, expected "+expected)
+	case TOKEN_STRING:
+		parserError(parser, token, fmt.Sprintf("near '%s', expected %s", strings.ReplaceAll(token.text, "'", "''"), expected))
+	case TOKEN_BLOB:
+		parserError(parser, token, fmt.Sprintf("near 'X'%s'', expected %s", token.text, expected))
+	default:
+		parserError(parser, token, fmt.Sprintf("near '%s', expected %s", token.text, expected))
+	}
+}
+
+func acceptKeyword(parser *Parser, keyword string) bool {
+	token := peekToken(parser)
+	if token.typ == TOKEN_KEYWORD && token.text == keyword {
+		parser.pos++
+		return true
+	}
+	return false
+}
+
+func acceptSymbol(parser *Parser, symbol string) bool {
+	token := peekToken(parser)
+	if token.typ == TOKEN_SYMBOL && token.text == symbol {
+		parser.pos++
+		return true
+	}
+	return false
+}
+
+func expectKeyword(parser *Parser, keyword string) bool {
+	if !acceptKeyword(parser, keyword) {
+		parserExpected(parser, keyword)
+		return false
+	}
+	return true
+}
+
+func expectSymbol(parser *Parser, symbol string) bool {
+	if !acceptSymbol(parser, symbol) {
+		parserExpected(parser, "'"+symbol+"'")
+		return false
+	}
+	return true
+}
+
+func expectIdentifier(parser *Parser, what string) (string, bool) {
+	token := peekToken(parser)
+	if token.typ != TOKEN_IDENTIFIER {
+		parserExpected(parser, what)
+		return "", false
+	}
+	parser.pos++
+	return token.text, true
+}
+
+// expr := and_expr { OR and_expr }
+func parseExpr(parser *Parser) *Expr {
+	left := parseAndExpr(parser)
+	for left != nil && peekToken(parser).typ == TOKEN_KEYWORD && peekToken(parser).text == "OR" {
+		pos := nextToken(parser).pos
+		right := parseAndExpr(parser)
+		if right == nil {
+			return nil
+		}
+		left = &Expr{typ: EXPR_BINARY, pos: pos, op: "OR", left: left, right: right}
+	}
+	return left
+}
+
+// and_expr := not_expr { AND not_expr }
+func parseAndExpr(parser *Parser) *Expr {
+	left := parseNotExpr(parser)
+	for left != nil && peekToken(parser).typ == TOKEN_KEYWORD && peekToken(parser).text == "AND" {
+		pos := nextToken(parser).pos
+		right := parseNotExpr(parser)
+		if right == nil {
+			return nil
+		}
+		left = &Expr{typ: EXPR_BINARY, pos: pos, op: "AND", left: left, right: right}
+	}
+	return left
+}
+
+// not_expr := NOT not_expr | comparison
+func parseNotExpr(parser *Parser) *Expr {
+	token := peekToken(parser)
+	if acceptKeyword(parser, "NOT") {
+		operand := parseNotExpr(parser)
+		if operand == nil {
+			return nil
+		}
+		return &Expr{typ: EXPR_UNARY, pos: token.pos, op: "NOT", left: operand}
+	}
+	return parseComparison(parser)
+}
+
+// comparison := additive [ ( = | != | <> | < | <= | > | >= ) additive | IS [ NOT ] NULL
+// | [ NOT ] LIKE additive | [ NOT ] IN ( expr, ... ) | [ NOT ] BETWEEN additive AND additive ]
+func parseComparison(parser *Parser) *Expr {
+	left := parseAdditive(parser)
+	if left == nil {
+		return nil
+	}
+	token := peekToken(parser)
+	if token.typ == TOKEN_SYMBOL {
+		switch token.text {
+		case "=", "!=", "<>", "<", "<=", ">", ">=":
+			nextToken(parser)
+			right := parseAdditive(parser)
+			if right == nil {
+				return nil
+			}
+			op := token.text
+			if op == "<>" {
+				op = "!="
+			}
+			return &Expr{typ: EXPR_BINARY, pos: token.pos, op: op, left: left, right: right}
+		}
+		return left
+	}
+
+	if acceptKeyword(parser, "IS") {
+		negate := acceptKeyword(parser, "NOT")
+		if !expectKeyword(parser, "NULL") {
+			return nil
+		}
+		expr := &Expr{typ: EXPR_UNARY, pos: token.pos, op: "IS NULL", left: left}
+		if negate {
+			expr = &Expr{typ: EXPR_UNARY, pos: token.pos, op: "NOT", left: expr}
+		}
+		return expr
+	}
+
+	negate := acceptKeyword(parser, "NOT")
+	var expr *Expr
+	switch {
+	case acceptKeyword(parser, "LIKE"):
+		right := parseAdditive(parser)
+		if right == nil {
+			return nil
+		}
+		expr = &Expr{typ: EXPR_BINARY, pos: token.pos, op: "LIKE", left: left, right: right}
+	case acceptKeyword(parser, "IN"):
+		if !expectSymbol(parser, "(") {
+			return nil
+		}
+		list := parseExprList(parser)
+		if list == nil || !expectSymbol(parser, ")") {
+			return nil
+		}
+		expr = &Expr{typ: EXPR_IN, pos: token.pos, left: left, list: list}
+	case acceptKeyword(parser, "BETWEEN"):
+		low := parseAdditive(parser)
+		if low == nil || !expectKeyword(parser, "AND") {
+			return nil
+		}
+		high := parseAdditive(parser)
+		if high == nil {
+			return nil
+		}
+		// x BETWEEN a AND b 等价于 x >= a AND x <= b
+		expr = &Expr{typ: EXPR_BINARY, pos: token.pos, op: "AND",
+			left:  &Expr{typ: EXPR_BINARY, pos: token.pos, op: ">=", left: left, right: low},
+			right: &Expr{typ: EXPR_BINARY, pos: token.pos, op: "<=", left: left, right: high},
+		}
+	default:
+		if negate {
+			parserExpected(parser, "LIKE, IN or BETWEEN")
+			return nil
+		}
+		return left
+	}
+	if negate {
+		expr = &Expr{typ: EXPR_UNARY, pos: token.pos, op: "NOT", left: expr}
+	}
+	return expr
+}
+
+// additive := multiplicative { ( + | - ) multiplicative }
+func parseAdditive(parser *Parser) *Expr {
+	left := parseMultiplicative(parser)
+	for left != nil {
+		token := peekToken(parser)
+		if token.typ != TOKEN_SYMBOL || (token.text != "+" && token.text != "-") {
+			break
+		}
+		nextToken(parser)
+		right := parseMultiplicative(parser)
+		if right == nil {
+			return nil
+		}
+		left = &Expr{typ: EXPR_BINARY, pos: token.pos, op: token.text, left: left, right: right}
+	}
+	return left
+}
+
+// multiplicative := concat { ( * | / ) concat }
+func parseMultiplicative(parser *Parser) *Expr {
+	left := parseConcat(parser)
+	for left != nil {
+		token := peekToken(parser)
+		if token.typ != TOKEN_SYMBOL || (token.text != "*" && token.text != "/") {
+			break
+		}
+		nextToken(parser)
+		right := parseConcat(parser)
+		if right == nil {
+			return nil
+		}
+		left = &Expr{typ: EXPR_BINARY, pos: token.pos, op: token.text, left: left, right: right}
+	}
+	return left
+}
+
+// concat := unary { || unary }
+func parseConcat(parser *Parser) *Expr {
+	left := parseUnary(parser)
+	for left != nil {
+		token := peekToken(parser)
+		if !acceptSymbol(parser, "||") {
+			break
+		}
+		right := parseUnary(parser)
+		if right == nil {
+			return nil
+		}
+		left = &Expr{typ: EXPR_BINARY, pos: token.pos, op: "||", left: left, right: right}
+	}
+	return left
+}
+
+// unary := - unary | primary
+func parseUnary(parser *Parser) *Expr {
+	token := peekToken(parser)
+	if acceptSymbol(parser, "-") {
+		operand := parseUnary(parser)
+		if operand == nil {
+			return nil
+		}
+		return &Expr{typ: EXPR_UNARY, pos: token.pos, op: "-", left: operand}
+	}
+	return parsePrimary(parser)
+}
+
+// primary := INTEGER | REAL | STRING | BLOB | TRUE | FALSE | NULL | identifier | function ( [ expr, ... ] ) | ( expr )
+func parsePrimary(parser *Parser) *Expr {
+	token := peekToken(parser)
+	switch {
+	case token.typ == TOKEN_INTEGER:
+		value, err := strconv.ParseInt(token.text, 10, 64)
+		if err != nil {
+			parserError(parser, token, fmt.Sprintf("integer %s is out of range", token.text))
+			return nil
+		}
+		nextToken(parser)
+		return &Expr{typ: EXPR_INTEGER, pos: token.pos, intValue: value}
+	case token.typ == TOKEN_REAL:
+		value, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			parserError(parser, token, fmt.Sprintf("real number %s is out of range", token.text))
+			return nil
+		}
+		nextToken(parser)
+		return &Expr{typ: EXPR_REAL, pos: token.pos, floatValue: value}
+	case token.typ == TOKEN_STRING:
+		nextToken(parser)
+		return &Expr{typ: EXPR_STRING, pos: token.pos, strValue: token.text}
+	case token.typ == TOKEN_BLOB:
+		nextToken(parser)
+		blob, _ := hex.DecodeString(token.text)
+		return &Expr{typ: EXPR_BLOB, pos: token.pos, strValue: string(blob)}
+	case acceptKeyword(parser, "TRUE"):
+		return &Expr{typ: EXPR_BOOLEAN, pos: token.pos, intValue: 1}
+	case acceptKeyword(parser, "FALSE"):
+		return &Expr{typ: EXPR_BOOLEAN, pos: token.pos}
+	case token.typ == TOKEN_IDENTIFIER:
+		nextToken(parser)
+		if !acceptSymbol(parser, "(") {
+			return &Expr{typ: EXPR_COLUMN, pos: token.pos, strValue: token.text}
+		}
+		expr := &Expr{typ: EXPR_FUNCTION, pos: token.pos, strValue: token.text}
+		if acceptSymbol(parser, ")") {
+			return expr
+		}
+		if star := peekToken(parser); acceptSymbol(parser, "*") {
+			// count(*)
+			expr.list = []*Expr{{typ: EXPR_STAR, pos: star.pos}}
+		} else {
+			expr.list = parseExprList(parser)
+		}
+		if expr.list == nil || !expectSymbol(parser, ")") {
+			return nil
+		}
+		return expr
+	case acceptKeyword(parser, "NULL"):
+		return &Expr{typ: EXPR_NULL, pos: token.pos}
+	case acceptSymbol(parser, "("):
+		expr := parseExpr(parser)
+		if expr == nil || !expectSymbol(parser, ")") {
+			return nil
+		}
+		return expr
+	}
+	parserExpected(parser, "an expression")
+	return nil
+}
+
+// 用逗号分隔的表达式列表，不包括两边的括号
+func parseExprList(parser *Parser) []*Expr {
+	var exprs []*Expr
+	for {
+		expr := parseExpr(parser)
+		if expr == nil {
+			return nil
+		}
+		exprs = append(exprs, expr)
+		if !acceptSymbol(parser, ",") {
+			return exprs
+		}
+	}
+}
+
+// INSERT INTO table [ ( column, ... ) ] VALUES ( expr, ... ) { , ( expr, ... ) }
+func parseInsert(parser *Parser, statement *Statement) bool {
+	statement.typ = STATEMENT_INSERT
+	if !expectKeyword(parser, "INTO") {
+		return false
+	}
+	var ok bool
+	if statement.tableName, ok = expectIdentifier(parser, "a table name"); !ok {
+		return false
+	}
+	if acceptSymbol(parser, "(") {
+		for {
+			column, ok := expectIdentifier(parser, "a column name")
+			if !ok {
+				return false
+			}
+			statement.columns = append(statement.columns, column)
+			if !acceptSymbol(parser, ",") {
+				break
+			}
+		}
+		if !expectSymbol(parser, ")") {
+			return false
+		}
+	}
+	if !expectKeyword(parser, "VALUES") {
+		return false
+	}
+	for {
+		if !expectSymbol(parser, "(") {
+			return false
+		}
+		values := parseExprList(parser)
+		if values == nil || !expectSymbol(parser, ")") {
+			return false
+		}
+		statement.values = append(statement.values, values)
+		if !acceptSymbol(parser, ",") {
+			return true
+		}
+	}
+}
+
+// WHERE 子句是可选的
+func parseWhere(parser *Parser, statement *Statement) bool {
+	if !acceptKeyword(parser, "WHERE") {
+		return true
+	}
+	statement.where = parseExpr(parser)
+	return statement.where != nil
+}
+
+// [ GROUP BY expr, ... ] [ HAVING expr ]
+func parseGroupBy(parser *Parser, statement *Statement) bool {
+	if acceptKeyword(parser, "GROUP") {
+		if !expectKeyword(parser, "BY") {
+			return false
+		}
+		if statement.groupBy = parseExprList(parser); statement.groupBy == nil {
+			return false
+		}
+	}
+	if !acceptKeyword(parser, "HAVING") {
+		return true
+	}
+	statement.having = parseExpr(parser)
+	return statement.having != nil
+}
+
+// [ ORDER BY expr [ ASC | DESC ], ... ] [ LIMIT expr [ OFFSET expr ] ]
+func parseOrderByLimit(parser *Parser, statement *Statement) bool {
+	if acceptKeyword(parser, "ORDER") {
+		if !expectKeyword(parser, "BY") {
+			return false
+		}
+		for {
+			term := OrderTerm{expr: parseExpr(parser)}
+			if term.expr == nil {
+				return false
+			}
+			if !acceptKeyword(parser, "ASC") {
+				term.desc = acceptKeyword(parser, "DESC")
+			}
+			statement.orderBy = append(statement.orderBy, term)
+			if !acceptSymbol(parser, ",") {
+				break
+			}
+		}
+	}
+	if !acceptKeyword(parser, "LIMIT") {
+		return true
+	}
+	if statement.limitExpr = parseExpr(parser); statement.limitExpr == nil {
+		return false
+	}
+	if !acceptKeyword(parser, "OFFSET") {
+		return true
+	}
+	statement.offsetExpr = parseExpr(parser)
+	return statement.offsetExpr != nil
+}
+
+// SELECT ( * | expr [ [ AS ] alias ] ), ... FROM table [ WHERE expr ] [ GROUP BY ... ] [ ORDER BY ... ] [ LIMIT ... ]
+func parseSelect(parser *Parser, statement *Statement) bool {
+	statement.typ = STATEMENT_SELECT
+	for {
+		token := peekToken(parser)
+		alias := ""
+		if acceptSymbol(parser, "*") {
+			statement.resultColumns = append(statement.resultColumns, &Expr{typ: EXPR_STAR, pos: token.pos})
+		} else {
+			expr := parseExpr(parser)
+			if expr == nil {
+				return false
+			}
+			statement.resultColumns = append(statement.resultColumns, expr)
+			if acceptKeyword(parser, "AS") || peekToken(parser).typ == TOKEN_IDENTIFIER {
+				var ok bool
+				if alias, ok = expectIdentifier(parser, "an alias"); !ok {
+					return false
+				}
+			}
+		}
+		statement.resultAliases = append(statement.resultAliases, alias)
+		if !acceptSymbol(parser, ",") {
+			break
+		}
+	}
+	if !expectKeyword(parser, "FROM") {
+		return false
+	}
+	var ok bool
+	if statement.tableName, ok = expectIdentifier(parser, "a table name"); !ok {
+		return false
+	}
+	return parseWhere(parser, statement) && parseGroupBy(parser, statement) && parseOrderByLimit(parser, statement)
+}
+
+// UPDATE table SET column = expr, ... [ WHERE expr ]
+func parseUpdate(parser *Parser, statement *Statement) bool {
+	statement.typ = STATEMENT_UPDATE
+	var ok bool
+	if statement.tableName, ok = expectIdentifier(parser, "a table name"); !ok {
+		return false
+	}
+	if !expectKeyword(parser, "SET") {
+		return false
+	}
+	for {
+		column, ok := expectIdentifier(parser, "a column name")
+		if !ok || !expectSymbol(parser, "=") {
+			return false
+		}
+		value := parseExpr(parser)
+		if value == nil {
+			return false
+		}
+		statement.assignments = append(statement.assignments, Assignment{column, value})
+		if !acceptSymbol(parser, ",") {
+			break
+		}
+	}
+	return parseWhere(parser, statement)
+}
+
+// DELETE FROM table [ WHERE expr ]
+func parseDelete(parser *Parser, statement *Statement) bool {
+	statement.typ = STATEMENT_DELETE
+	if !expectKeyword(parser, "FROM") {
+		return false
+	}
+	var ok bool
+	if statement.tableName, ok = expectIdentifier(parser, "a table name"); !ok {
+		return false
+	}
+	return parseWhere(parser, statement)
+}
+
+// column [ type [ ( n ) ] ] { PRIMARY KEY | NOT NULL | UNIQUE | DEFAULT value }
+func parseColumnDef(parser *Parser, columnDef *ColumnDef) bool {
+	start := peekToken(parser).pos
+	var ok bool
+	if columnDef.name, ok = expectIdentifier(parser, "a column name"); !ok {
+		return false
+	}
+	if peekToken(parser).typ == TOKEN_IDENTIFIER {
+		columnDef.typeName = strings.ToUpper(nextToken(parser).text)
+		if acceptSymbol(parser, "(") {
+			token := peekToken(parser)
+			size, err := strconv.Atoi(token.text)
+			if token.typ != TOKEN_INTEGER || err != nil || size == 0 {
+				parserExpected(parser, "a type length")
+				return false
+			}
+			nextToken(parser)
+			columnDef.size = size
+			if !expectSymbol(parser, ")") {
+				return false
+			}
+		}
+	}
+	for {
+		// CONSTRAINT name 给之后的约束命名，只有 CHECK 的错误信息用到这个名字
+		constraintName := ""
+		if acceptKeyword(parser, "CONSTRAINT") {
+			if constraintName, ok = expectIdentifier(parser, "a constraint name"); !ok {
+				return false
+			}
+		}
+		if acceptKeyword(parser, "PRIMARY") {
+			if !expectKeyword(parser, "KEY") {
+				return false
+			}
+			columnDef.primaryKey = true
+		} else if acceptKeyword(parser, "NOT") {
+			if !expectKeyword(parser, "NULL") {
+				return false
+			}
+			columnDef.notNull = true
+		} else if acceptKeyword(parser, "UNIQUE") {
+			columnDef.unique = true
+		} else if acceptKeyword(parser, "DEFAULT") {
+			if columnDef.defaultValue = parseUnary(parser); columnDef.defaultValue == nil {
+				return false
+			}
+		} else if acceptKeyword(parser, "CHECK") {
+			if !expectSymbol(parser, "(") {
+				return false
+			}
+			start := peekToken(parser).pos
+			check := Check{name: constraintName, expr: parseExpr(parser)}
+			if check.expr == nil {
+				return false
+			}
+			if check.name == "" {
+				check.name = strings.TrimSpace(parser.input[start-1 : peekToken(parser).pos-1])
+			}
+			if !expectSymbol(parser, ")") {
+				return false
+			}
+			columnDef.checks = append(columnDef.checks, check)
+		} else if constraintName != "" {
+			parserExpected(parser, "a constraint")
+			return false
+		} else {
+			break
+		}
+	}
+	columnDef.sql = strings.TrimSpace(parser.input[start-1 : peekToken(parser).pos-1])
+	return true
+}
+
+// CREATE TABLE table ( column_def, ... [, PRIMARY KEY ( column, ... ) ] )
+func parseCreateTable(parser *Parser, statement *Statement) bool {
+	statement.typ = STATEMENT_CREATE_TABLE
+	if !acceptKeyword(parser, "TABLE") {
+		parserExpected(parser, "TABLE or INDEX")
+		return false
+	}
+	var ok bool
+	if statement.tableName, ok = expectIdentifier(parser, "a table name"); !ok {
+		return false
+	}
+	if !expectSymbol(parser, "(") {
+		return false
+	}
+	for {
+		if acceptKeyword(parser, "PRIMARY") {
+			// 表级的 PRIMARY KEY ( column, ... )
+			if !expectKeyword(parser, "KEY") || !expectSymbol(parser, "(") {
+				return false
+			}
+			for {
+				column, ok := expectIdentifier(parser, "a column name")
+				if !ok {
+					return false
+				}
+				statement.primaryKey = append(statement.primaryKey, column)
+				if !acceptSymbol(parser, ",") {
+					break
+				}
+			}
+			if !expectSymbol(parser, ")") {
+				return false
+			}
+		} else {
+			var columnDef ColumnDef
+			if !parseColumnDef(parser, &columnDef) {
+				return false
+			}
+			statement.columnDefs = append(statement.columnDefs, columnDef)
+		}
+		if !acceptSymbol(parser, ",") {
+			break
+		}
+	}
+	return expectSymbol(parser, ")")
+}
+
+// CREATE [ UNIQUE ] INDEX index ON table ( column )
+func parseCreateIndex(parser *Parser, statement *Statement) bool {
+	statement.typ = STATEMENT_CREATE_INDEX
+	statement.unique = acceptKeyword(parser, "UNIQUE")
+	if !expectKeyword(parser, "INDEX") {
+		return false
+	}
+	var ok bool
+	if statement.indexName, ok = expectIdentifier(parser, "an index name"); !ok {
+		return false
+	}
+	if !expectKeyword(parser, "ON") {
+		return false
+	}
+	if statement.tableName, ok = expectIdentifier(parser, "a table name"); !ok {
+		return false
+	}
+	if !expectSymbol(parser, "(") {
+		return false
+	}
+	if statement.indexColumn, ok = expectIdentifier(parser, "a column name"); !ok {
+		return false
+	}
+	return expectSymbol(parser, ")")
+}
+
+// DROP TABLE table 或者 DROP INDEX index
+func parseDrop(parser *Parser, statement *Statement) bool {
+	var ok bool
+	if acceptKeyword(parser, "INDEX") {
+		statement.typ = STATEMENT_DROP_INDEX
+		statement.indexName, ok = expectIdentifier(parser, "an index name")
+		return ok
+	}
+	statement.typ = STATEMENT_DROP_TABLE
+	if !acceptKeyword(parser, "TABLE") {
+		parserExpected(parser, "TABLE or INDEX")
+		return false
+	}
+	statement.tableName, ok = expectIdentifier(parser, "a table name")
+	return ok
+}
+
+// ALTER TABLE table ADD [ COLUMN ] column_def
+func parseAlterTable(parser *Parser, statement *Statement) bool {
+	statement.typ = STATEMENT_ALTER_TABLE
+	if !expectKeyword(parser, "TABLE") {
+		return false
+	}
+	var ok bool
+	if statement.tableName, ok = expectIdentifier(parser, "a table name"); !ok {
+		return false
+	}
+	if !expectKeyword(parser, "ADD") {
+		return false
+	}
+	acceptKeyword(parser, "COLUMN")
+	var columnDef ColumnDef
+	if !parseColumnDef(parser, &columnDef) {
+		return false
+	}
+	statement.columnDefs = append(statement.columnDefs, columnDef)
+	return true
+}
+
+// 解析一条语句，语句末尾可以有一个分号
+func parseStatement(parser *Parser, statement *Statement) PrepareResult {
+	token := nextToken(parser)
+	ok := false
+	switch {
+	case token.typ != TOKEN_KEYWORD:
+		return PREPARE_UNRECOGNIZED_STATEMENT
+	case token.text == "INSERT":
+		ok = parseInsert(parser, statement)
+	case token.text == "SELECT":
+		ok = parseSelect(parser, statement)
+	case token.text == "UPDATE":
+		ok = parseUpdate(parser, statement)
+	case token.text == "DELETE":
+		ok = parseDelete(parser, statement)
+	case token.text == "CREATE":
+		if next := peekToken(parser); next.typ == TOKEN_KEYWORD && (next.text == "UNIQUE" || next.text == "INDEX") {
+			ok = parseCreateIndex(parser, statement)
+		} else {
+			ok = parseCreateTable(parser, statement)
+		}
+	case token.text == "DROP":
+		ok = parseDrop(parser, statement)
+	case token.text == "ALTER":
+		ok = parseAlterTable(parser, statement)
+	case token.text == "BEGIN":
+		statement.typ = STATEMENT_BEGIN
+		ok = true
+	case token.text == "COMMIT":
+		statement.typ = STATEMENT_COMMIT
+		ok = true
+	case token.text == "ROLLBACK":
+		statement.typ = STATEMENT_ROLLBACK
+		ok = true
+	default:
+		return PREPARE_UNRECOGNIZED_STATEMENT
+	}
+	if ok && (statement.typ == STATEMENT_BEGIN || statement.typ == STATEMENT_COMMIT || statement.typ == STATEMENT_ROLLBACK) {
+		acceptKeyword(parser, "TRANSACTION")
+	}
+
+	if ok {
+		acceptSymbol(parser, ";")
+		if peekToken(parser).typ != TOKEN_EOF {
+			parserExpected(parser, "end of statement")
+			ok = false
+		}
+	}
+	if !ok {
+		statement.errorMessage = parser.errMsg
+		return PREPARE_SYNTAX_ERROR
+	}
+	return PREPARE_SUCCESS
+}
+
+/*
+ * 语义检查：根据系统表中的表结构检查语法树，把它转换成表上的操作
+ */
+func prepareInvalid(statement *Statement, format string, args ...interface{}) PrepareResult {
+	statement.errorMessage = fmt.Sprintf(format, args...)
+	return PREPARE_INVALID_STATEMENT
+}
+
+// 整数常量，允许前面有负号
+func literalInteger(expr *Expr) (int64, bool) {
+	if expr.typ == EXPR_INTEGER {
+		return expr.intValue, true
+	}
+	if expr.typ == EXPR_UNARY && expr.op == "-" && expr.left.typ == EXPR_INTEGER {
+		return -expr.left.intValue, true
+	}
+	return 0, false
+}
+
+// 常量表达式的值，数字前面可以有负号
+func literalValue(expr *Expr, value *Value) bool {
+	negative := false
+	if expr.typ == EXPR_UNARY && expr.op == "-" && (expr.left.typ == EXPR_INTEGER || expr.left.typ == EXPR_REAL) {
+		expr, negative = expr.left, true
+	}
+	switch expr.typ {
+	case EXPR_NULL:
+		*value = Value{typ: VALUE_NULL}
+	case EXPR_INTEGER:
+		*value = Value{typ: VALUE_INTEGER, intValue: expr.intValue}
+		if negative {
+			value.intValue = -value.intValue
+		}
+	case EXPR_REAL:
+		*value = Value{typ: VALUE_REAL, floatValue: expr.floatValue}
+		if negative {
+			value.floatValue = -value.floatValue
+		}
+	case EXPR_STRING:
+		*value = Value{typ: VALUE_TEXT, strValue: expr.strValue}
+	case EXPR_BLOB:
+		*value = Value{typ: VALUE_BLOB, strValue: expr.strValue}
+	case EXPR_BOOLEAN:
+		*value = Value{typ: VALUE_BOOLEAN, intValue: expr.intValue}
+	default:
+		return false
+	}
+	return true
+}
+
+// 列名对应的下标，不存在时返回-1
+func tableColumnIndex(table *Table, name string) int {
+	for i, column := range table.columns {
+		if column.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// 根据 create table 中的列定义生成表结构
+func buildTable(statement *Statement, table *Table) PrepareResult {
+	table.name = statement.tableName
+	table.keyColumn = -1
+	for i := range statement.columnDefs {
+		result := buildColumn(statement, table, &statement.columnDefs[i])
+		if result != PREPARE_SUCCESS {
+			return result
+		}
+	}
+	if len(statement.primaryKey) > 0 {
+		if result := buildPrimaryKey(statement, table); result != PREPARE_SUCCESS {
+			return result
+		}
+	}
+	// CHECK 可以引用后面定义的列，所有的列都加到表中之后再检查
+	for _, columnDef := range statement.columnDefs {
+		for _, check := range columnDef.checks {
+			if result := bindCheck(statement, table, check); result != PREPARE_SUCCESS {
+				return result
+			}
+		}
+	}
+	return PREPARE_SUCCESS
+}
+
+// 表级的 PRIMARY KEY (column, ...)。只有一列并且类型是 INTEGER 时是 rowid 的别名，
+// 和列级的 INTEGER PRIMARY KEY 相同
+func buildPrimaryKey(statement *Statement, table *Table) PrepareResult {
+	if table.keyColumn >= 0 || table.primaryKey != nil {
+		return prepareInvalid(statement, "table %s has more than one primary key", table.name)
+	}
+	for _, name := range statement.primaryKey {
+		i := tableColumnIndex(table, name)
+		if i < 0 {
+			return prepareInvalid(statement, "table %s has no column named %s", table.name, name)
+		}
+		if slices.Contains(table.primaryKey, i) {
+			return prepareInvalid(statement, "column %s is specified more than once", name)
+		}
+		table.primaryKey = append(table.primaryKey, i)
+	}
+	if len(table.primaryKey) == 1 && statement.columnDefs[table.primaryKey[0]].typeName == "INTEGER" {
+		table.keyColumn = table.primaryKey[0]
+		table.primaryKey = nil
+		table.columns[table.keyColumn].primaryKey = true
+		return PREPARE_SUCCESS
+	}
+	for _, i := range table.primaryKey {
+		table.columns[i].primaryKey = true
+		table.columns[i].notNull = true
+	}
+	return PREPARE_SUCCESS
+}
+
+// CHECK 的结果必须是布尔值，不能使用聚合函数
+func bindCheck(statement *Statement, table *Table, check Check) PrepareResult {
+	typ, result := bindExpr(statement, table, check.expr)
+	if result != PREPARE_SUCCESS {
+		return result
+	}
+	if typ != VALUE_BOOLEAN && typ != VALUE_NULL {
+		return prepareInvalid(statement, "CHECK constraint must be a boolean expression")
+	}
+	table.checks = append(table.checks, check)
+	return PREPARE_SUCCESS
+}
+
+// 根据 create index 语句生成索引结构
+func buildIndex(statement *Statement, table *Table, index *Index) PrepareResult {
+	column := tableColumnIndex(table, statement.indexColumn)
+	if column < 0 {
+		return prepareInvalid(statement, "table %s has no column named %s", table.name, statement.indexColumn)
+	}
+	index.name = statement.indexName
+	index.tableName = table.name
+	index.column = column
+	index.unique = statement.unique
+	index.tree = &Table{name: index.name, pager: table.pager, keyColumn: -1}
+	return PREPARE_SUCCESS
+}
+
+// 检查列定义，把列加到表的末尾
+func buildColumn(statement *Statement, table *Table, columnDef *ColumnDef) PrepareResult {
+	if tableColumnIndex(table, columnDef.name) >= 0 {
+		return prepareInvalid(statement, "duplicate column name: %s", columnDef.name)
+	}
+	column := Column{name: columnDef.name, size: columnDef.size, primaryKey: columnDef.primaryKey, notNull: columnDef.notNull}
+	switch columnDef.typeName {
+	case "INTEGER", "INT", "BIGINT":
+		column.typ = VALUE_INTEGER
+	case "REAL", "DOUBLE", "FLOAT":
+		column.typ = VALUE_REAL
+	case "TEXT", "VARCHAR", "CHAR":
+		column.typ = VALUE_TEXT
+	case "BLOB":
+		column.typ = VALUE_BLOB
+	case "BOOLEAN", "BOOL":
+		column.typ = VALUE_BOOLEAN
+	case "":
+		return prepareInvalid(statement, "column %s has no type", columnDef.name)
+	default:
+		return prepareInvalid(statement, "unknown type %s for column %s", columnDef.typeName, columnDef.name)
+	}
+	i := len(table.columns)
+	if column.primaryKey {
+		if table.keyColumn >= 0 || table.primaryKey != nil {
+			return prepareInvalid(statement, "table %s has more than one primary key", table.name)
+		}
+		// 只有类型是 INTEGER 的主键是 rowid 的别名，其他的主键列的值编码之后作为 key，不能是 NULL
+		if columnDef.typeName == "INTEGER" {
+			table.keyColumn = i
+		} else {
+			table.primaryKey = []int{i}
+			column.notNull = true
+		}
+	}
+	// 主键本身就不会重复，不需要唯一索引
+	column.unique = columnDef.unique && !column.primaryKey
+	// 没有默认值时是 NULL
+	table.columns = append(table.columns, column)
+	if columnDef.defaultValue != nil {
+		return bindValue(statement, table, i, columnDef.defaultValue, &table.columns[i].defaultValue)
+	}
+	return PREPARE_SUCCESS
+}
+
+// 把常量转换成列的值，INTEGER 可以存入 REAL 列，每一列都可以是 NULL
+func bindValue(statement *Statement, table *Table, columnIndex int, expr *Expr, value *Value) PrepareResult {
+	column := &table.columns[columnIndex]
+	if !literalValue(expr, value) {
+		return prepareInvalid(statement, "%s must be %s", column.name, valueTypeDescriptions[column.typ])
+	}
+	if value.typ == VALUE_NULL {
+		// 主键列是 NULL 时插入时自动分配 key
+		return PREPARE_SUCCESS
+	}
+	if value.typ == VALUE_INTEGER && column.typ == VALUE_REAL {
+		*value = Value{typ: VALUE_REAL, floatValue: float64(value.intValue)}
+	}
+	if value.typ != column.typ {
+		return prepareInvalid(statement, "%s must be %s", column.name, valueTypeDescriptions[column.typ])
+	}
+	switch column.typ {
+	case VALUE_TEXT, VALUE_BLOB:
+		if column.size > 0 && len(value.strValue) > column.size {
+			return PREPARE_STRING_TOO_LONG
+		}
+	}
+	return PREPARE_SUCCESS
+}
+
+func isNumericType(typ ValueType) bool {
+	return typ == VALUE_INTEGER || typ == VALUE_REAL
+}
+
+// 两种类型的值能否比较，INTEGER 和 REAL 之间可以比较，NULL 可以和任何类型比较
+func comparableTypes(left, right ValueType) bool {
+	return left == VALUE_NULL || right == VALUE_NULL || left == right || (isNumericType(left) && isNumericType(right))
+}
+
+// 检查表达式中的列名和运算数的类型，返回表达式的类型。
+// NULL 常量的类型是 VALUE_NULL，可以出现在任何类型的位置。
+func bindExpr(statement *Statement, table *Table, expr *Expr) (ValueType, PrepareResult) {
+	switch expr.typ {
+	case EXPR_COLUMN:
+		expr.columnIndex = tableColumnIndex(table, expr.strValue)
+		if expr.columnIndex >= 0 {
+			return table.columns[expr.columnIndex].typ, PREPARE_SUCCESS
+		}
+		// 有 PRIMARY KEY 的表没有 rowid
+		if expr.strValue != "rowid" || table.primaryKey != nil {
+			return VALUE_NULL, prepareInvalid(statement, "no such column: %s", expr.strValue)
+		}
+		expr.columnIndex = table.keyColumn
+		return VALUE_INTEGER, PREPARE_SUCCESS
+	case EXPR_STAR:
+		return VALUE_NULL, prepareInvalid(statement, "* is only allowed in the result columns")
+	case EXPR_UNARY:
+		operand, result := bindExpr(statement, table, expr.left)
+		if result != PREPARE_SUCCESS {
+			return operand, result
+		}
+		switch expr.op {
+		case "-":
+			if operand != VALUE_NULL && !isNumericType(operand) {
+				return operand, prepareInvalid(statement, "operand of - must be a number")
+			}
+			return operand, PREPARE_SUCCESS
+		case "NOT":
+			if operand != VALUE_NULL && operand != VALUE_BOOLEAN {
+				return operand, prepareInvalid(statement, "operand of NOT must be a boolean")
+			}
+		}
+		return VALUE_BOOLEAN, PREPARE_SUCCESS
+	case EXPR_BINARY:
+		left, result := bindExpr(statement, table, expr.left)
+		if result != PREPARE_SUCCESS {
+			return left, result
+		}
+		right, result := bindExpr(statement, table, expr.right)
+		if result != PREPARE_SUCCESS {
+			return right, result
+		}
+		switch expr.op {
+		case "AND", "OR":
+			if (left != VALUE_NULL && left != VALUE_BOOLEAN) || (right != VALUE_NULL && right != VALUE_BOOLEAN) {
+				return left, prepareInvalid(statement, "operands of %s must be booleans", expr.op)
+			}
+		case "LIKE":
+			if (left != VALUE_NULL && left != VALUE_TEXT) || (right != VALUE_NULL && right != VALUE_TEXT) {
+				return left, prepareInvalid(statement, "operands of LIKE must be strings")
+			}
+		case "||":
+			// 除了 BLOB 以外的值都按照文本形式连接
+			if left == VALUE_BLOB || right == VALUE_BLOB {
+				return left, prepareInvalid(statement, "operands of || must not be blobs")
+			}
+			return VALUE_TEXT, PREPARE_SUCCESS
+		case "+", "-", "*", "/":
+			if (left != VALUE_NULL && !isNumericType(left)) || (right != VALUE_NULL && !isNumericType(right)) {
+				return left, prepareInvalid(statement, "operands of %s must be numbers", expr.op)
+			}
+			// 有一边是 REAL 时结果是 REAL
+			if left == VALUE_REAL || right == VALUE_REAL {
+				return VALUE_REAL, PREPARE_SUCCESS
+			}
+			if left == VALUE_NULL && right == VALUE_NULL {
+				return VALUE_NULL, PREPARE_SUCCESS
+			}
+			return VALUE_INTEGER, PREPARE_SUCCESS
+		default:
+			if !comparableTypes(left, right) {
+				return left, prepareInvalid(statement, "cannot compare %s with %s", valueTypeDescriptions[left], valueTypeDescriptions[right])
+			}
+		}
+		return VALUE_BOOLEAN, PREPARE_SUCCESS
+	case EXPR_IN:
+		left, result := bindExpr(statement, table, expr.left)
+		if result != PREPARE_SUCCESS {
+			return left, result
+		}
+		for _, item := range expr.list {
+			right, result := bindExpr(statement, table, item)
+			if result != PREPARE_SUCCESS {
+				return right, result
+			}
+			if !comparableTypes(left, right) {
+				return left, prepareInvalid(statement, "cannot compare %s with %s", valueTypeDescriptions[left], valueTypeDescriptions[right])
+			}
+		}
+		return VALUE_BOOLEAN, PREPARE_SUCCESS
+	case EXPR_FUNCTION:
+		result := bindFunction(statement, table, expr)
+		return expr.resultType, result
+	}
+	var value Value
+	literalValue(expr, &value)
+	return value.typ, PREPARE_SUCCESS
+}
+
+// 内置函数的参数个数
+var functionArgs = map[string][2]int{
+	"length": {1, 1}, "upper": {1, 1}, "lower": {1, 1}, "substr": {2, 3}, "abs": {1, 1}, "coalesce": {2, math.MaxInt},
+	"count": {1, 1}, "sum": {1, 1}, "avg": {1, 1}, "min": {1, 1}, "max": {1, 1},
+}
+
+var aggregateFunctions = map[string]bool{"count": true, "sum": true, "avg": true, "min": true, "max": true}
+
+// 聚合函数不能嵌套，也不能出现在 WHERE 和 GROUP BY 中。count(*) 的参数是 *
+func bindAggregate(statement *Statement, table *Table, expr *Expr) PrepareResult {
+	if !statement.allowAggregates {
+		return prepareInvalid(statement, "misuse of aggregate function %s()", expr.strValue)
+	}
+	expr.resultType = VALUE_INTEGER
+	arg := VALUE_NULL
+	if expr.list[0].typ != EXPR_STAR || expr.strValue != "count" {
+		statement.allowAggregates = false
+		var result PrepareResult
+		arg, result = bindExpr(statement, table, expr.list[0])
+		statement.allowAggregates = true
+		if result != PREPARE_SUCCESS {
+			return result
+		}
+	}
+	switch expr.strValue {
+	case "sum", "avg":
+		if arg != VALUE_NULL && arg != VALUE_INTEGER && arg != VALUE_REAL {
+			return prepareInvalid(statement, "argument 1 of %s() must be a number", expr.strValue)
+		}
+		if arg == VALUE_REAL || expr.strValue == "avg" {
+			expr.resultType = VALUE_REAL
+		}
+	case "min", "max":
+		expr.resultType = arg
+	}
+	expr.typ = EXPR_AGGREGATE
+	expr.columnIndex = len(table.columns) + len(statement.aggregates)
+	statement.aggregates = append(statement.aggregates, expr)
+	return PREPARE_SUCCESS
+}
+
+// 检查函数调用的参数，确定结果的类型
+func bindFunction(statement *Statement, table *Table, expr *Expr) PrepareResult {
+	numArgs, ok := functionArgs[expr.strValue]
+	if !ok {
+		return prepareInvalid(statement, "no such function: %s", expr.strValue)
+	}
+	if len(expr.list) < numArgs[0] || len(expr.list) > numArgs[1] {
+		return prepareInvalid(statement, "wrong number of arguments to function %s()", expr.strValue)
+	}
+	if aggregateFunctions[expr.strValue] {
+		return bindAggregate(statement, table, expr)
+	}
+	args := make([]ValueType, len(expr.list))
+	for i, arg := range expr.list {
+		var result PrepareResult
+		if args[i], result = bindExpr(statement, table, arg); result != PREPARE_SUCCESS {
+			return result
+		}
+	}
+	// 参数必须是 allowed 中的类型或者 NULL
+	checkArg := func(i int, description string, allowed ...ValueType) PrepareResult {
+		if args[i] == VALUE_NULL || slices.Contains(allowed, args[i]) {
+			return PREPARE_SUCCESS
+		}
+		return prepareInvalid(statement, "argument %d of %s() must be %s", i+1, expr.strValue, description)
+	}
+
+	expr.resultType = args[0]
+	switch expr.strValue {
+	case "length":
+		expr.resultType = VALUE_INTEGER
+		return checkArg(0, "a string or a blob", VALUE_TEXT, VALUE_BLOB)
+	case "upper", "lower":
+		return checkArg(0, "a string", VALUE_TEXT)
+	case "substr":
+		for i := 1; i < len(args); i++ {
+			if result := checkArg(i, "an integer", VALUE_INTEGER); result != PREPARE_SUCCESS {
+				return result
+			}
+		}
+		return checkArg(0, "a string or a blob", VALUE_TEXT, VALUE_BLOB)
+	case "abs":
+		return checkArg(0, "a number", VALUE_INTEGER, VALUE_REAL)
+	}
+	// coalesce 的参数类型必须相同，INTEGER 和 REAL 混在一起时结果是 REAL
+	for i, arg := range args {
+		if !comparableTypes(expr.resultType, arg) {
+			return prepareInvalid(statement, "argument %d of coalesce() must be %s", i+1, valueTypeDescriptions[expr.resultType])
+		}
+		if expr.resultType == VALUE_NULL || arg == VALUE_REAL {
+			expr.resultType = arg
+		}
+	}
+	return PREPARE_SUCCESS
+}
+
+// 交换比较运算两边之后的运算符，1 < id 等价于 id > 1
+var swappedComparisons = map[string]string{"=": "=", "<": ">", "<=": ">=", ">": "<", ">=": "<="}
+
+// 用 WHERE 中 AND 连接的 主键 比较 整数常量 的条件缩小扫描的 key 范围。
+// 其他条件，以及 OR 和 NOT 中的条件不影响范围，扫描时仍然逐行计算整个 WHERE。
+func planKeyRange(statement *Statement, expr *Expr) {
+	if expr.typ != EXPR_BINARY {
+		return
+	}
+	if expr.op == "AND" {
+		planKeyRange(statement, expr.left)
+		planKeyRange(statement, expr.right)
+		return
+	}
+	op, ok := swappedComparisons[expr.op]
+	if !ok {
+		return
+	}
+	column, value := expr.right, expr.left
+	if column.typ != EXPR_COLUMN {
+		column, value, op = expr.left, expr.right, expr.op
+	}
+	if column.typ != EXPR_COLUMN || column.columnIndex != statement.table.keyColumn {
+		return
+	}
+	key, ok := literalInteger(value)
+	if !ok {
+		return
+	}
+	switch op {
+	case "=":
+		statement.lowKey = max(statement.lowKey, key)
+		statement.highKey = min(statement.highKey, key)
+	case ">":
+		if key == math.MaxInt64 {
+			// 没有比最大的整数更大的 key，范围为空
+			statement.lowKey, statement.highKey = 1, 0
+			return
+		}
+		statement.lowKey = max(statement.lowKey, key+1)
+	case ">=":
+		statement.lowKey = max(statement.lowKey, key)
+	case "<":
+		if key == math.MinInt64 {
+			statement.lowKey, statement.highKey = 1, 0
+			return
+		}
+		statement.highKey = min(statement.highKey, key-1)
+	case "<=":
+		statement.highKey = min(statement.highKey, key)
+	}
+}
+
+// 用 WHERE 中 AND 连接的 列 比较 常量 的条件缩小列值的范围，low 和 high 是编码之后的列值。
+// 常量的类型和列的类型不同时不使用这个条件，INTEGER 常量和 REAL 列比较时转换成 REAL
+func planColumnRange(statement *Statement, columnIndex int, expr *Expr, low, high *[]byte) {
+	if expr.typ != EXPR_BINARY {
+		return
+	}
+	if expr.op == "AND" {
+		planColumnRange(statement, columnIndex, expr.left, low, high)
+		planColumnRange(statement, columnIndex, expr.right, low, high)
+		return
+	}
+	op, ok := swappedComparisons[expr.op]
+	if !ok {
+		return
+	}
+	column, value := expr.right, expr.left
+	if column.typ != EXPR_COLUMN {
+		column, value, op = expr.left, expr.right, expr.op
+	}
+	if column.typ != EXPR_COLUMN || column.columnIndex != columnIndex {
+		return
+	}
+	var literal Value
+	if !literalValue(value, &literal) {
+		return
+	}
+	typ := statement.table.columns[columnIndex].typ
+	if literal.typ == VALUE_INTEGER && typ == VALUE_REAL {
+		literal = Value{typ: VALUE_REAL, floatValue: float64(literal.intValue)}
+	}
+	if literal.typ != typ {
+		return
+	}
+	key := appendKeyValue(nil, &literal)
+	if op == "=" || op == ">" || op == ">=" {
+		if *low == nil || bytes.Compare(key, *low) > 0 {
+			*low = key
+		}
+	}
+	if op == "=" || op == "<" || op == "<=" {
+		if *high == nil || bytes.Compare(key, *high) < 0 {
+			*high = key
+		}
+	}
+}
+
+// 选择扫描范围最小的索引：有等值条件的索引优先，其次是有上下界的索引，没有条件的索引不使用
+func planIndex(statement *Statement) {
+	bestScore := 0
+	for _, index := range statement.table.indexes {
+		var low, high []byte
+		planColumnRange(statement, index.column, statement.where, &low, &high)
+		score := 0
+		if low != nil {
+			score++
+		}
+		if high != nil {
+			score++
+		}
+		if low != nil && high != nil && bytes.Equal(low, high) {
+			score++
+		}
+		if score > bestScore {
+			bestScore = score
+			statement.index, statement.seekLow, statement.seekHigh = index, low, high
+		}
+	}
+	if statement.index != nil && statement.seekLow == nil {
+		// 和 NULL 比较的结果不是 true，跳过索引开头值为 NULL 的项
+		statement.seekLow = []byte{KEY_TAG_NULL + 1}
+	}
+}
+
+// 有 PRIMARY KEY 的表用主键列上的条件缩小扫描范围。前面的主键列都有等值条件时，
+// 下一个主键列上的条件才能使用，seekLow 和 seekHigh 是等值条件的值加上这一列的范围
+func planPrimaryKey(statement *Statement) {
+	var prefix []byte
+	for _, column := range statement.table.primaryKey {
+		var low, high []byte
+		planColumnRange(statement, column, statement.where, &low, &high)
+		if low != nil && high != nil && bytes.Equal(low, high) {
+			prefix = append(prefix, low...)
+			continue
+		}
+		if low != nil {
+			statement.seekLow = append(slices.Clone(prefix), low...)
+		}
+		if high != nil {
+			statement.seekHigh = append(slices.Clone(prefix), high...)
+		}
+		break
+	}
+	if statement.seekLow == nil {
+		statement.seekLow = prefix
+	}
+	if statement.seekHigh == nil {
+		statement.seekHigh = prefix
+	}
+}
+
+// select、update 和 delete 的扫描范围默认是整张表。WHERE 的结果必须是布尔值，
+// 有主键的条件时按主键扫描，否则尝试使用索引
+func bindWhere(statement *Statement) PrepareResult {
+	statement.lowKey, statement.highKey = math.MinInt64, math.MaxInt64
+	if statement.where == nil {
+		return PREPARE_SUCCESS
+	}
+	typ, result := bindExpr(statement, statement.table, statement.where)
+	if result != PREPARE_SUCCESS {
+		return result
+	}
+	if typ != VALUE_BOOLEAN && typ != VALUE_NULL {
+		return prepareInvalid(statement, "WHERE clause must be a boolean expression")
+	}
+	if statement.table.primaryKey != nil {
+		planPrimaryKey(statement)
+	} else {
+		planKeyRange(statement, statement.where)
+	}
+	if statement.seekLow == nil && statement.seekHigh == nil && statement.lowKey == math.MinInt64 && statement.highKey == math.MaxInt64 {
+		planIndex(statement)
+	}
+	return PREPARE_SUCCESS
+}
+
+// ORDER BY 中的整数 N 表示第 N 个结果列，和别名同名的列名表示这个结果列
+func bindOrderBy(statement *Statement) PrepareResult {
+	table := statement.table
+	for i := range statement.orderBy {
+		term := &statement.orderBy[i]
+		if term.expr.typ == EXPR_COLUMN {
+			if k := slices.Index(statement.resultAliases, term.expr.strValue); k >= 0 {
+				term.expr = statement.resultColumns[k]
+				continue
+			}
+		}
+		if term.expr.typ == EXPR_INTEGER {
+			results := resultExprs(statement)
+			n := term.expr.intValue
+			if n < 1 || n > int64(len(results)) {
+				return prepareInvalid(statement, "ORDER BY term out of range - should be between 1 and %d", len(results))
+			}
+			term.expr = results[n-1]
+			continue
+		}
+		if _, result := bindExpr(statement, table, term.expr); result != PREPARE_SUCCESS {
+			return result
+		}
+	}
+
+	if len(statement.orderBy) == 1 {
+		// 表按 key 的顺序存放，有 PRIMARY KEY 的表按第一个主键列的顺序扫描
+		keyColumn := table.keyColumn
+		if table.primaryKey != nil {
+			keyColumn = table.primaryKey[0]
+		}
+		term := &statement.orderBy[0]
+		statement.needSort = term.expr.typ != EXPR_COLUMN || term.expr.columnIndex != keyColumn
+		statement.reverse = !statement.needSort && term.desc
+	} else {
+		statement.needSort = len(statement.orderBy) > 0
+	}
+	return PREPARE_SUCCESS
+}
+
+// 结果列的表达式，* 展开成表的每一列
+func resultExprs(statement *Statement) []*Expr {
+	var results []*Expr
+	for _, expr := range statement.resultColumns {
+		if expr.typ != EXPR_STAR {
+			results = append(results, expr)
+			continue
+		}
+		for i, column := range statement.table.columns {
+			results = append(results, &Expr{typ: EXPR_COLUMN, pos: expr.pos, strValue: column.name, columnIndex: i})
+		}
+	}
+	return results
+}
+
+// LIMIT 和 OFFSET 只能是非负的整数常量
+func bindLimit(statement *Statement, expr *Expr, name string, destination *int64) PrepareResult {
+	if expr == nil {
+		return PREPARE_SUCCESS
+	}
+	n, ok := literalInteger(expr)
+	if !ok || n < 0 {
+		return prepareInvalid(statement, "%s must be a non-negative integer", name)
+	}
+	*destination = n
+	return PREPARE_SUCCESS
+}
+
+func bindSelect(statement *Statement) PrepareResult {
+	table := statement.table
+	statement.allowAggregates = true
+	for _, expr := range statement.resultColumns {
+		if expr.typ == EXPR_STAR {
+			continue
+		}
+		if _, result := bindExpr(statement, table, expr); result != PREPARE_SUCCESS {
+			return result
+		}
+	}
+	if statement.having != nil {
+		typ, result := bindExpr(statement, table, statement.having)
+		if result != PREPARE_SUCCESS {
+			return result
+		}
+		if typ != VALUE_BOOLEAN && typ != VALUE_NULL {
+			return prepareInvalid(statement, "HAVING clause must be a boolean expression")
+		}
+	}
+	if result := bindOrderBy(statement); result != PREPARE_SUCCESS {
+		return result
+	}
+
+	statement.allowAggregates = false
+	for _, expr := range statement.groupBy {
+		if _, result := bindExpr(statement, table, expr); result != PREPARE_SUCCESS {
+			return result
+		}
+	}
+	if result := bindWhere(statement); result != PREPARE_SUCCESS {
+		return result
+	}
+	statement.grouped = len(statement.aggregates) > 0 || len(statement.groupBy) > 0 || statement.having != nil
+	if statement.grouped {
+		// 分组的顺序和扫描的顺序无关，ORDER BY 主键也需要排序
+		statement.needSort = len(statement.orderBy) > 0
+		statement.reverse = false
+		statement.minMaxKey = len(statement.groupBy) == 0 && len(statement.aggregates) > 0
+		for _, expr := range statement.aggregates {
+			arg := expr.list[0]
+			if (expr.strValue != "min" && expr.strValue != "max") || arg.typ != EXPR_COLUMN || arg.columnIndex != table.keyColumn {
+				statement.minMaxKey = false
+			}
+		}
+	}
+	if statement.index != nil {
+		// 索引扫描按照索引列的顺序输出，ORDER BY 主键也需要排序
+		statement.needSort = len(statement.orderBy) > 0
+		statement.reverse = false
+		statement.minMaxKey = false
+	}
+	statement.limit = -1
+	if result := bindLimit(statement, statement.limitExpr, "LIMIT", &statement.limit); result != PREPARE_SUCCESS {
+		return result
+	}
+	return bindLimit(statement, statement.offsetExpr, "OFFSET", &statement.offset)
+}
+
+func bindInsert(statement *Statement) PrepareResult {
+	table := statement.table
+	// 每一个插入的值对应的列
+	var columnIndexes []int
+	if len(statement.columns) == 0 {
+		for i := range table.columns {
+			columnIndexes = append(columnIndexes, i)
+		}
+	}
+	seen := make(map[int]bool)
+	for _, name := range statement.columns {
+		i := tableColumnIndex(table, name)
+		if i < 0 {
+			return prepareInvalid(statement, "table %s has no column named %s", table.name, name)
+		}
+		if seen[i] {
+			return prepareInvalid(statement, "column %s is specified more than once", name)
+		}
+		seen[i] = true
+		columnIndexes = append(columnIndexes, i)
+	}
+
+	for _, values := range statement.values {
+		if len(values) != len(columnIndexes) {
+			return prepareInvalid(statement, "%d values for %d columns", len(values), len(columnIndexes))
+		}
+		// 没有指定的列使用默认值
+		row := Row{values: make([]Value, len(table.columns))}
+		for i, column := range table.columns {
+			row.values[i] = column.defaultValue
+		}
+		for i, columnIndex := range columnIndexes {
+			result := bindValue(statement, table, columnIndex, values[i], &row.values[columnIndex])
+			if result != PREPARE_SUCCESS {
+				return result
+			}
+		}
+		if table.keyColumn >= 0 && row.values[table.keyColumn].typ != VALUE_NULL {
+			row.key = row.values[table.keyColumn].intValue
+		}
+		statement.rowsToInsert = append(statement.rowsToInsert, row)
+	}
+	return PREPARE_SUCCESS
+}
+
+func bindUpdate(statement *Statement) PrepareResult {
+	table := statement.table
+	statement.rowToUpdate.values = make([]Value, len(table.columns))
+	for _, assignment := range statement.assignments {
+		i := tableColumnIndex(table, assignment.column)
+		if i < 0 {
+			return prepareInvalid(statement, "table %s has no column named %s", table.name, assignment.column)
+		}
+		if i == table.keyColumn || slices.Contains(table.primaryKey, i) {
+			return prepareInvalid(statement, "%s cannot be updated", assignment.column)
+		}
+		result := bindValue(statement, table, i, assignment.value, &statement.rowToUpdate.values[i])
+		if result != PREPARE_SUCCESS {
+			return result
+		}
+		statement.updateColumns = append(statement.updateColumns, i)
+	}
+	return bindWhere(statement)
+}
+
+// 在表结构的副本上加一列，执行时替换原来的表
+func bindAlterTable(statement *Statement) PrepareResult {
+	columnDef := &statement.columnDefs[0]
+	if columnDef.primaryKey {
+		return prepareInvalid(statement, "cannot add a PRIMARY KEY column")
+	}
+	if columnDef.unique {
+		return prepareInvalid(statement, "cannot add a UNIQUE column")
+	}
+
+	table := *statement.table
+	table.columns = append([]Column(nil), table.columns...)
+	table.checks = append([]Check(nil), table.checks...)
+	result := buildColumn(statement, &table, columnDef)
+	if result != PREPARE_SUCCESS {
+		return result
+	}
+	// 已有的行读取时使用默认值，默认值不能违反 NOT NULL，CHECK 在执行时检查已有的行
+	column := &table.columns[len(table.columns)-1]
+	if column.notNull && column.defaultValue.typ == VALUE_NULL {
+		return prepareInvalid(statement, "cannot add a NOT NULL column with default value NULL")
+	}
+	for _, check := range columnDef.checks {
+		if result := bindCheck(statement, &table, check); result != PREPARE_SUCCESS {
+			return result
+		}
+	}
+	// 新列的定义插入到建表语句最后的括号之前
+	end := strings.LastIndex(table.sql, ")")
+	table.sql = table.sql[:end] + ", " + columnDef.sql + table.sql[end:]
+	statement.table = &table
+	return PREPARE_SUCCESS
+}
+
+func bindStatement(db *Database, statement *Statement) PrepareResult {
+	switch statement.typ {
+	case STATEMENT_BEGIN, STATEMENT_COMMIT, STATEMENT_ROLLBACK:
+		return PREPARE_SUCCESS
+	case STATEMENT_CREATE_TABLE:
+		if db.tables[statement.tableName] != nil || statement.tableName == CATALOG_TABLE_NAME {
+			return prepareInvalid(statement, "table %s already exists", statement.tableName)
+		}
+		if db.indexes[statement.tableName] != nil {
+			return prepareInvalid(statement, "there is already an index named %s", statement.tableName)
+		}
+		if strings.HasPrefix(statement.tableName, AUTOINDEX_PREFIX) {
+			return prepareInvalid(statement, "object name reserved for internal use: %s", statement.tableName)
+		}
+		statement.table = &Table{pager: db.pager, sql: statement.sql}
+		return buildTable(statement, statement.table)
+	case STATEMENT_CREATE_INDEX:
+		if db.indexes[statement.indexName] != nil {
+			return prepareInvalid(statement, "index %s already exists", statement.indexName)
+		}
+		if strings.HasPrefix(statement.indexName, AUTOINDEX_PREFIX) {
+			return prepareInvalid(statement, "object name reserved for internal use: %s", statement.indexName)
+		}
+		if db.tables[statement.indexName] != nil || statement.indexName == CATALOG_TABLE_NAME {
+			return prepareInvalid(statement, "there is already a table named %s", statement.indexName)
+		}
+	case STATEMENT_DROP_INDEX:
+		statement.index = db.indexes[statement.indexName]
+		if statement.index == nil {
+			return prepareInvalid(statement, "no such index: %s", statement.indexName)
+		}
+		if strings.HasPrefix(statement.indexName, AUTOINDEX_PREFIX) {
+			return prepareInvalid(statement, "index associated with UNIQUE constraint cannot be dropped")
+		}
+		statement.table = db.tables[statement.index.tableName]
+		return PREPARE_SUCCESS
+	}
+
+	statement.table = db.tables[statement.tableName]
+	if statement.tableName == CATALOG_TABLE_NAME {
+		// 系统表只能查询，只能通过 create table 等语句修改
+		if statement.typ != STATEMENT_SELECT {
+			return prepareInvalid(statement, "table %s may not be modified", statement.tableName)
+		}
+		statement.table = db.catalog
+	}
+	if statement.table == nil {
+		return prepareInvalid(statement, "no such table: %s", statement.tableName)
+	}
+
+	switch statement.typ {
+	case STATEMENT_INSERT:
+		return bindInsert(statement)
+	case STATEMENT_SELECT:
+		return bindSelect(statement)
+	case STATEMENT_UPDATE:
+		return bindUpdate(statement)
+	case STATEMENT_DELETE:
+		return bindWhere(statement)
+	case STATEMENT_ALTER_TABLE:
+		return bindAlterTable(statement)
+	case STATEMENT_CREATE_INDEX:
+		statement.index = &Index{sql: statement.sql}
+		return buildIndex(statement, statement.table, statement.index)
+	}
+	return PREPARE_SUCCESS
+}
+
+func prepareStatement(db *Database, inputBuffer *InputBuffer, statement *Statement) PrepareResult {
+	var parser Parser
+	if !tokenize(&parser, inputBuffer.buffer) {
+		statement.errorMessage = parser.errMsg
+		return PREPARE_SYNTAX_ERROR
+	}
+
+	result := parseStatement(&parser, statement)
+	if result != PREPARE_SUCCESS {
+		return result
+	}
+	statement.sql = strings.TrimSuffix(strings.TrimSpace(inputBuffer.buffer), ";")
+	return bindStatement(db, statement)
+}
+
+// 优先复用空闲链表中的页，没有空闲页时才追加到文件末尾
+func getUnusedPageNum(pager *Pager) uint32 {
+	header := getPageForWrite(pager, HEADER_PAGE_NUM)
+	pageNum := *headerFreelistHead(header)
+	if pageNum == 0 {
+		return pager.numPages
+	}
+
+	page := getPageForWrite(pager, pageNum)
+	*headerFreelistHead(header) = *freePageNext(page)
+	*headerFreelistCount(header) -= 1
+	clear(page)
+	return pageNum
+}
+
+// 将不再使用的页放入空闲链表的头部
+func freePage(pager *Pager, pageNum uint32) {
+	header := getPageForWrite(pager, HEADER_PAGE_NUM)
+	page := getPageForWrite(pager, pageNum)
+	clear(page)
+	*freePageNext(page) = *headerFreelistHead(header)
+	*headerFreelistHead(header) = pageNum
+	*headerFreelistCount(header) += 1
+}
+
+// 释放以 pageNum 为根的子树中的所有页，包括叶子节点中记录的溢出页
+func freeTree(pager *Pager, pageNum uint32) {
+	node := getPage(pager, pageNum)
+	if getNodeType(node) == NODE_INTERNAL {
+		numKeys := *internalNodeNumKeys(node)
+		children := make([]uint32, 0, numKeys+1)
+		for i := uint32(0); i <= numKeys; i++ {
+			children = append(children, *internalNodeChild(node, i))
+		}
+		for _, child := range children {
+			freeTree(pager, child)
+		}
+	} else {
+		for i := uint32(0); i < *leafNodeNumCells(node); i++ {
+			freeOverflow(pager, leafNodeCell(node, i))
+		}
+	}
+	freePage(pager, pageNum)
+	pagerEvict(pager)
+}
+
+// 把记录放进单元格，本页放不下的部分写入新分配的溢出页
+func buildCell(pager *Pager, key []byte, record []byte) []byte {
+	keySize := uint32(len(key))
+	payloadSize := uint32(len(record))
+	local := leafLocalSize(keySize, payloadSize)
+	size := LEAF_NODE_KEY_OFFSET + keySize + local
+	cell := make([]byte, size, size+LEAF_NODE_OVERFLOW_PAGE_SIZE)
+	*leafCellKeySize(cell) = uint16(keySize)
+	*leafCellPayloadSize(cell) = payloadSize
+	copy(cell[LEAF_NODE_KEY_OFFSET:], key)
+	copy(cell[LEAF_NODE_KEY_OFFSET+keySize:], record[:local])
+	if local == payloadSize {
+		return cell
+	}
+
+	// 从最后一页开始写，每一页写入时已经知道下一页的页码
+	rest := record[local:]
+	next := uint32(0)
+	for i := (len(rest) - 1) / OVERFLOW_PAGE_DATA_SIZE; i >= 0; i-- {
+		pageNum := getUnusedPageNum(pager)
+		page := getPageForWrite(pager, pageNum)
+		*overflowPageNext(page) = next
+		copy(page[OVERFLOW_PAGE_DATA_OFFSET:], rest[i*OVERFLOW_PAGE_DATA_SIZE:])
+		next = pageNum
+	}
+	return binary.LittleEndian.AppendUint32(cell, next)
+}
+
+// 单元格中的完整记录，包括溢出页中的部分
+func leafCellPayload(pager *Pager, cell []byte) []byte {
+	payloadSize := int(*leafCellPayloadSize(cell))
+	payload := make([]byte, 0, payloadSize)
+	offset := leafCellPayloadOffset(cell)
+	payload = append(payload, cell[offset:offset+leafLocalSize(uint32(*leafCellKeySize(cell)), uint32(payloadSize))]...)
+	if overflowPage := leafCellOverflowPage(cell); overflowPage != nil {
+		for pageNum := *overflowPage; len(payload) < payloadSize; {
+			page := getPage(pager, pageNum)
+			length := min(payloadSize-len(payload), OVERFLOW_PAGE_DATA_SIZE)
+			payload = append(payload, page[OVERFLOW_PAGE_DATA_OFFSET:OVERFLOW_PAGE_DATA_OFFSET+length]...)
+			pageNum = *overflowPageNext(page)
+		}
+	}
+	return payload
+}
+
+// 用长度相同的记录覆盖单元格中的记录，溢出页原地改写，不需要分配新页
+func leafCellOverwrite(pager *Pager, cell []byte, record []byte) {
+	local := copy(cell[leafCellPayloadOffset(cell):], record[:leafLocalSize(uint32(*leafCellKeySize(cell)), uint32(len(record)))])
+	if overflowPage := leafCellOverflowPage(cell); overflowPage != nil {
+		rest := record[local:]
+		for pageNum := *overflowPage; len(rest) > 0; {
+			page := getPageForWrite(pager, pageNum)
+			rest = rest[copy(page[OVERFLOW_PAGE_DATA_OFFSET:], rest):]
+			pageNum = *overflowPageNext(page)
+		}
+	}
+}
+
+// 释放单元格的溢出页链表
+func freeOverflow(pager *Pager, cell []byte) {
+	overflowPage := leafCellOverflowPage(cell)
+	if overflowPage == nil {
+		return
+	}
+	for pageNum := *overflowPage; pageNum != 0; {
+		next := *overflowPageNext(getPage(pager, pageNum))
+		freePage(pager, pageNum)
+		pageNum = next
+	}
+}
+
+// 返回叶子节点的前一个叶子节点，没有时返回0
+func leafNodePrevLeaf(pager *Pager, pageNum uint32) uint32 {
+	node := getPage(pager, pageNum)
+	for !isNodeRoot(node) {
+		parentPageNum := *nodeParent(node)
+		parent := getPage(pager, parentPageNum)
+		index := internalNodeChildIndex(parent, pageNum)
+		if index > 0 {
+			// 左兄弟子树中最右边的叶子节点
+			prevPageNum := *internalNodeChild(parent, index-1)
+			prev := getPage(pager, prevPageNum)
+			for getNodeType(prev) == NODE_INTERNAL {
+				prevPageNum = *internalNodeRightChild(prev)
+				prev = getPage(pager, prevPageNum)
+			}
+			return prevPageNum
+		}
+		pageNum = parentPageNum
+		node = parent
+	}
+	return 0
+}
+
+// 将树中的页移动到空闲页destination，并修正所有指向它的页码。
+// 根节点没有父节点，要修改文件头或者系统表中记录的根节点。
+func relocatePage(db *Database, pageNum, destination uint32) {
+	pager := db.pager
+	node := getPage(pager, pageNum)
+
+	if getNodeType(node) == NODE_INTERNAL {
+		numKeys := *internalNodeNumKeys(node)
+		for i := uint32(0); i <= numKeys; i++ {
+			child := getPageForWrite(pager, *internalNodeChild(node, i))
+			*nodeParent(child) = destination
+		}
+	} else {
+		// 查找前一个叶子节点依赖父节点中的页码，需要在修改父节点之前进行
+		prevPageNum := leafNodePrevLeaf(pager, pageNum)
+		if prevPageNum != 0 {
+			*leafNodeNextLeaf(getPageForWrite(pager, prevPageNum)) = destination
+		}
+	}
+
+	isRoot := isNodeRoot(node)
+	if !isRoot {
+		parent := getPageForWrite(pager, *nodeParent(node))
+		index := internalNodeChildIndex(parent, pageNum)
+		if index == *internalNodeNumKeys(parent) {
+			*internalNodeRightChild(parent) = destination
+		} else {
+			*internalNodeChild(parent, index) = destination
+		}
+	}
+
+	copy(getPageForWrite(pager, destination), node)
+	pagerDropPage(pager, pageNum)
+
+	if isRoot {
+		relocateRoot(db, pageNum, destination)
+	}
+}
+
+// 根节点被移动之后，修改文件头或者系统表中的根节点
+func relocateRoot(db *Database, pageNum, destination uint32) {
+	if db.catalog.rootPageNum == pageNum {
+		db.catalog.rootPageNum = destination
+		*headerRootPage(getPageForWrite(db.pager, HEADER_PAGE_NUM)) = destination
+		return
+	}
+
+	catalogKey := int64(0)
+	for _, table := range db.tables {
+		if table.rootPageNum == pageNum {
+			table.rootPageNum = destination
+			catalogKey = table.catalogKey
+		}
+	}
+	for _, index := range db.indexes {
+		if index.tree.rootPageNum == pageNum {
+			index.tree.rootPageNum = destination
+			catalogKey = index.catalogKey
+		}
+	}
+
+	// 记录的长度不变，原地改写，不会分配新页
+	var row Row
+	cursor := tableFind(db.catalog, catalogKey)
+	cursorRow(cursor, &row)
+	row.values[1].intValue = int64(destination)
+	leafNodeUpdate(cursor, &row)
+}
+
+// 记录叶子节点中每个单元格的溢出页链表：第一页属于叶子节点，其余的页属于链表中的前一页
+func recordOverflowPages(pager *Pager, leafPageNum uint32, overflowLeaf, overflowPrev map[uint32]uint32) {
+	node := getPage(pager, leafPageNum)
+	for i := uint32(0); i < *leafNodeNumCells(node); i++ {
+		overflowPage := leafCellOverflowPage(leafNodeCell(node, i))
+		if overflowPage == nil {
+			continue
+		}
+		overflowLeaf[*overflowPage] = leafPageNum
+		for pageNum := *overflowPage; ; {
+			next := *overflowPageNext(getPage(pager, pageNum))
+			if next == 0 {
+				break
+			}
+			overflowPrev[next] = pageNum
+			pageNum = next
+		}
+	}
+}
+
+// 将溢出页移动到空闲页destination，修改引用它的单元格或者前一个溢出页
+func relocateOverflowPage(pager *Pager, pageNum, destination uint32, overflowLeaf, overflowPrev map[uint32]uint32) {
+	page := getPage(pager, pageNum)
+	if leafPageNum, ok := overflowLeaf[pageNum]; ok {
+		leaf := getPageForWrite(pager, leafPageNum)
+		for i := uint32(0); i < *leafNodeNumCells(leaf); i++ {
+			overflowPage := leafCellOverflowPage(leafNodeCell(leaf, i))
+			if overflowPage != nil && *overflowPage == pageNum {
+				*overflowPage = destination
+			}
+		}
+		delete(overflowLeaf, pageNum)
+		overflowLeaf[destination] = leafPageNum
+	} else {
+		prevPageNum := overflowPrev[pageNum]
+		*overflowPageNext(getPageForWrite(pager, prevPageNum)) = destination
+		delete(overflowPrev, pageNum)
+		overflowPrev[destination] = prevPageNum
+	}
+	if next := *overflowPageNext(page); next != 0 {
+		overflowPrev[next] = destination
+	}
+
+	copy(getPageForWrite(pager, destination), page)
+	pagerDropPage(pager, pageNum)
+}
+
+// 把文件末尾的页移动到空闲页中，然后截断文件
+func vacuum(db *Database) {
+	pager := db.pager
+	header := getPage(pager, HEADER_PAGE_NUM)
+
+	isFree := make(map[uint32]bool)
+	var freePages []uint32
+	for pageNum := *headerFreelistHead(header); pageNum != 0; {
+		isFree[pageNum] = true
+		freePages = append(freePages, pageNum)
+		pageNum = *freePageNext(getPage(pager, pageNum))
+		pagerEvict(pager)
+	}
+	header = getPageForWrite(pager, HEADER_PAGE_NUM)
+	sort.Slice(freePages, func(i, j int) bool { return freePages[i] < freePages[j] })
+	*headerFreelistHead(header) = 0
+	*headerFreelistCount(header) = 0
+
+	// 溢出页没有父节点指针，先记录每个溢出页被哪一页引用
+	overflowLeaf := make(map[uint32]uint32)
+	overflowPrev := make(map[uint32]uint32)
+	for _, table := range append([]*Table{db.catalog}, sortedTables(db)...) {
+		for pageNum := tableStart(table).pageNum; pageNum != 0; {
+			recordOverflowPages(pager, pageNum, overflowLeaf, overflowPrev)
+			pageNum = *leafNodeNextLeaf(getPage(pager, pageNum))
+			pagerEvict(pager)
+		}
+	}
+
+	lastPageNum := pager.numPages - 1
+	for _, destination := range freePages {
+		for isFree[lastPageNum] {
+			lastPageNum--
+		}
+		if destination > lastPageNum {
+			break
+		}
+		_, isOverflow := overflowPrev[lastPageNum]
+		if _, ok := overflowLeaf[lastPageNum]; ok || isOverflow {
+			relocateOverflowPage(pager, lastPageNum, destination, overflowLeaf, overflowPrev)
+		} else {
+			relocatePage(db, lastPageNum, destination)
+			if getNodeType(getPage(pager, destination)) == NODE_LEAF {
+				recordOverflowPages(pager, destination, overflowLeaf, overflowPrev)
+			}
+		}
+		isFree[destination] = false
+		isFree[lastPageNum] = true
+		pagerEvict(pager)
+	}
+	for isFree[lastPageNum] {
+		lastPageNum--
+	}
+
+	// 截断的页也要写入日志，回滚时才能恢复
+	for pageNum := lastPageNum + 1; pageNum < pager.numPages; pageNum++ {
+		if pager.journalMode == JOURNAL_MODE_DELETE {
+			pagerJournalPage(pager, pageNum, getPage(pager, pageNum))
+		}
+		pagerDropPage(pager, pageNum)
+	}
+	pager.numPages = lastPageNum + 1
+	pagerCommit(pager)
+}
+
+// 按照占用的空间把单元格分成两半，返回左半部分的单元格数，两边都不为空
+func leafNodeSplitPoint(cells [][]byte) int {
+	total := 0
+	for _, cell := range cells {
+		total += len(cell) + LEAF_NODE_CELL_POINTER_SIZE
+	}
+	used := 0
+	for i, cell := range cells {
+		used += len(cell) + LEAF_NODE_CELL_POINTER_SIZE
+		if used*2 >= total {
+			return max(1, min(i+1, len(cells)-1))
+		}
+	}
+	return len(cells) - 1
+}
+
+// 复制出叶子节点中的所有单元格
+func leafNodeCells(node []byte) [][]byte {
+	cells := make([][]byte, *leafNodeNumCells(node))
+	for i := range cells {
+		cells[i] = append([]byte(nil), leafNodeCell(node, uint32(i))...)
+	}
+	return cells
+}
+
+// 用 cells 重新填充叶子节点，单元格紧挨着放在页的末尾，头部的其他字段不变
+func leafNodeSetCells(node []byte, cells [][]byte) {
+	*leafNodeNumCells(node) = 0
+	*leafNodeCellContentStart(node) = PAGE_SIZE
+	*leafNodeFirstFreeblock(node) = 0
+	*leafNodeFragmentedBytes(node) = 0
+	for i, cell := range cells {
+		leafNodeInsertCell(node, uint32(i), cell)
+	}
+}
+
+// 整理页面，把空闲块和碎片合并到指针数组和内容区之间
+func leafNodeDefragment(node []byte) {
+	leafNodeSetCells(node, leafNodeCells(node))
+}
+
+// 在内容区中为 size 字节的单元格分配空间并返回它的偏移，同时保证还能放下一个新的单元格指针。
+// 优先使用第一个放得下的空闲块，连续的空闲空间不够时先整理页面。调用者保证空闲空间足够。
+func leafNodeAllocateSpace(node []byte, size uint16) uint16 {
+	if leafNodeGapSpace(node) < LEAF_NODE_CELL_POINTER_SIZE {
+		leafNodeDefragment(node)
+	}
+
+	link := leafNodeFirstFreeblock(node)
+	for *link != 0 {
+		offset := *link
+		blockSize := *freeblockSize(node, offset)
+		if blockSize >= size {
+			remain := blockSize - size
+			if remain < LEAF_NODE_MIN_FREEBLOCK_SIZE {
+				// 剩下的字节放不下空闲块，记为碎片
+				*link = *freeblockNext(node, offset)
+				*leafNodeFragmentedBytes(node) += remain
+				return offset
+			}
+			// 从空闲块的末尾分配，空闲块的头部不用移动
+			*freeblockSize(node, offset) = remain
+			return offset + remain
+		}
+		link = freeblockNext(node, offset)
+	}
+
+	if leafNodeGapSpace(node) < uint32(size)+LEAF_NODE_CELL_POINTER_SIZE {
+		leafNodeDefragment(node)
+	}
+	start := *leafNodeCellContentStart(node) - size
+	*leafNodeCellContentStart(node) = start
+	return start
+}
+
+// 把从 offset 开始的 size 字节按偏移顺序放入空闲块链表，并与前后相邻的空闲块合并。
+// 紧挨着内容区起始位置的空闲块直接归还给指针数组和内容区之间的空闲空间。
+func leafNodeReleaseSpace(node []byte, offset, size uint16) {
+	link := leafNodeFirstFreeblock(node)
+	prev := uint16(0)
+	for *link != 0 && *link < offset {
+		prev = *link
+		link = freeblockNext(node, prev)
+	}
+	next := *link
+	*freeblockNext(node, offset) = next
+	*freeblockSize(node, offset) = size
+	*link = offset
+
+	if next != 0 && offset+size == next {
+		*freeblockSize(node, offset) += *freeblockSize(node, next)
+		*freeblockNext(node, offset) = *freeblockNext(node, next)
+	}
+	if prev != 0 && prev+*freeblockSize(node, prev) == offset {
+		*freeblockSize(node, prev) += *freeblockSize(node, offset)
+		*freeblockNext(node, prev) = *freeblockNext(node, offset)
+	}
+
+	first := leafNodeFirstFreeblock(node)
+	if *first == *leafNodeCellContentStart(node) {
+		*leafNodeCellContentStart(node) += *freeblockSize(node, *first)
+		*first = *freeblockNext(node, *first)
+	}
+}
+
+// 把单元格放到下标为 cellNum 的位置，调用者保证空闲空间足够
+func leafNodeInsertCell(node []byte, cellNum uint32, cell []byte) {
+	start := leafNodeAllocateSpace(node, uint16(len(cell)))
+	copy(node[start:], cell)
+
+	numCells := *leafNodeNumCells(node)
+	for i := numCells; i > cellNum; i-- {
+		*leafNodeCellPointer(node, i) = *leafNodeCellPointer(node, i-1)
+	}
+	*leafNodeCellPointer(node, cellNum) = start
+	*leafNodeNumCells(node) = numCells + 1
+}
+
+// 删除下标为 cellNum 的单元格，它占用的空间成为空闲块，其他单元格不移动
+func leafNodeRemoveCell(node []byte, cellNum uint32) {
+	numCells := *leafNodeNumCells(node)
+	offset := *leafNodeCellPointer(node, cellNum)
+	size := uint16(len(leafNodeCell(node, cellNum)))
+	leafNodeReleaseSpace(node, offset, size)
+
+	for i := cellNum; i < numCells-1; i++ {
+		*leafNodeCellPointer(node, i) = *leafNodeCellPointer(node, i+1)
+	}
+	*leafNodeNumCells(node) = numCells - 1
+}
+
+// 创建一个新节点并将一半单元格移动过去。
+// 在两个节点中的一个中插入新单元格。
+// 更新父节点或创建一个新的父节点。
+func leafNodeSplitAndInsert(cursor *Cursor, cell []byte) {
+	oldNode := getPageForWrite(cursor.table.pager, cursor.pageNum)
+	oldMax := getNodeMaxKey(cursor.table.pager, oldNode)
+	newPageNum := getUnusedPageNum(cursor.table.pager)
+	newNode := getPageForWrite(cursor.table.pager, newPageNum)
+	initializeLeafNode(newNode)
+	*nodeParent(newNode) = *nodeParent(oldNode)
+	*leafNodeNextLeaf(newNode) = *leafNodeNextLeaf(oldNode)
+	*leafNodeNextLeaf(oldNode) = newPageNum
+
+	/*
+	  所有现有单元格以及新单元格按照占用的空间
+	  均匀分布在旧（左）和新（右）节点之间。
+	*/
+	cells := leafNodeCells(oldNode)
+	cells = append(cells[:cursor.cellNum], append([][]byte{cell}, cells[cursor.cellNum:]...)...)
+	splitPoint := leafNodeSplitPoint(cells)
+	leafNodeSetCells(oldNode, cells[:splitPoint])
+	leafNodeSetCells(newNode, cells[splitPoint:])
+
+	if isNodeRoot(oldNode) {
+		createNewRoot(cursor.table, newPageNum)
+	} else {
+		newMax := getNodeMaxKey(cursor.table.pager, oldNode)
+		// 父节点修改键时可能分裂，新节点插入到旧节点当前的父节点中
+		updateInternalNodeKey(cursor.table, *nodeParent(oldNode), oldMax, newMax)
+		*nodeParent(newNode) = *nodeParent(oldNode)
+		internalNodeInsert(cursor.table, *nodeParent(oldNode), newPageNum)
+	}
+}
+
+func leafNodeInsert(cursor *Cursor, cell []byte) {
+	node := getPageForWrite(cursor.table.pager, cursor.pageNum)
+	if leafNodeFreeSpace(node) < uint32(len(cell))+LEAF_NODE_CELL_POINTER_SIZE {
+		leafNodeSplitAndInsert(cursor, cell)
+		return
+	}
+	leafNodeInsertCell(node, cursor.cellNum, cell)
+}
+
+// 替换游标指向的行，key 不变。记录长度不变或者新的单元格在本页放得下时原地替换，
+// 树的结构不受影响；否则删除之后重新插入。
+func leafNodeUpdate(cursor *Cursor, row *Row) {
+	table := cursor.table
+	record := serializeRow(table, row)
+	node := getPageForWrite(table.pager, cursor.pageNum)
+	oldCell := leafNodeCell(node, cursor.cellNum)
+	if *leafCellPayloadSize(oldCell) == uint32(len(record)) {
+		leafCellOverwrite(table.pager, oldCell, record)
+		return
+	}
+
+	key := slices.Clone(leafCellKey(oldCell))
+	cell := buildCell(table.pager, key, record)
+	if leafNodeFreeSpace(node)+uint32(len(oldCell)) >= uint32(len(cell)) {
+		freeOverflow(table.pager, oldCell)
+		leafNodeRemoveCell(node, cursor.cellNum)
+		leafNodeInsertCell(node, cursor.cellNum, cell)
+		if !isNodeRoot(node) && leafNodeUsedSpace(node) < LEAF_NODE_MIN_USED {
+			leafNodeRebalance(table, cursor.pageNum)
+		}
+		return
+	}
+	leafNodeDelete(cursor)
+	leafNodeInsert(btreeFind(table, key), cell)
+}
+
+// 游标是否指向 key 所在的行
+func cursorMatchesKey(cursor *Cursor, key []byte) bool {
+	// 需要检查游标所在的叶子节点，而不是根节点
+	node := getPage(cursor.table.pager, cursor.pageNum)
+	return cursor.cellNum < *leafNodeNumCells(node) && bytes.Equal(leafNodeKey(node, cursor.cellNum), key)
+}
+
+// 自动分配的 key 是表中最大的 key 加1，key 已经用到最大值时返回 false
+func tableNextKey(table *Table) (int64, bool) {
+	node := getPage(table.pager, table.rootPageNum)
+	for getNodeType(node) == NODE_INTERNAL {
+		node = getPage(table.pager, *internalNodeRightChild(node))
+	}
+	numCells := *leafNodeNumCells(node)
+	if numCells == 0 {
+		return 1, true
+	}
+	maxKey := decodeRowKey(leafNodeKey(node, numCells-1))
+	return maxKey + 1, maxKey < math.MaxInt64
+}
+
+// 行在表的 B 树中的 key，有 PRIMARY KEY 的表是主键列的值编码之后连在一起，其他的表是 rowid
+func tableRowKey(table *Table, row *Row) []byte {
+	if table.primaryKey == nil {
+		return encodeRowKey(row.key)
+	}
+	var key []byte
+	for _, i := range table.primaryKey {
+		key = appendKeyValue(key, &row.values[i])
+	}
+	return key
+}
+
+func tableInsert(table *Table, row *Row) {
+	key := tableRowKey(table, row)
+	cell := buildCell(table.pager, key, serializeRow(table, row))
+	leafNodeInsert(btreeFind(table, key), cell)
+}
+
+// 行在索引中的 key
+func indexKey(index *Index, table *Table, row *Row) []byte {
+	key := appendKeyValue(nil, &row.values[index.column])
+	return append(key, tableRowKey(table, row)...)
+}
+
+func indexInsert(index *Index, table *Table, row *Row) {
+	key := indexKey(index, table, row)
+	leafNodeInsert(btreeFind(index.tree, key), buildCell(index.tree.pager, key, nil))
+}
+
+func indexDelete(index *Index, table *Table, row *Row) {
+	key := indexKey(index, table, row)
+	cursor := btreeFind(index.tree, key)
+	if cursorMatchesKey(cursor, key) {
+		leafNodeDelete(cursor)
+	}
+}
+
+// 唯一索引中是否有表的 key 不是 rowKey 的行的列值等于 value，value 是编码之后的列值。
+// 唯一索引中每个值最多只有一项，只需要检查第一项
+func indexConflicts(index *Index, value, rowKey []byte) bool {
+	cursor := btreeSeek(index.tree, value)
+	if cursor.endOfTable {
+		return false
+	}
+	key := cursorKey(cursor)
+	return bytes.HasPrefix(key, value) && !bytes.Equal(key[len(value):], rowKey)
+}
+
+// 检查 rows 是否满足 NOT NULL 和 CHECK 约束，再检查索引的唯一约束。
+// 错误信息是违反的约束，NOT NULL 是 表名.列名，CHECK 是约束的名字
+func checkConstraints(statement *Statement, table *Table, rows []Row) ExecuteResult {
+	for i := range rows {
+		for j, column := range table.columns {
+			if column.notNull && rows[i].values[j].typ == VALUE_NULL {
+				statement.errorMessage = fmt.Sprintf("%s.%s", table.name, column.name)
+				return EXECUTE_NOT_NULL_CONSTRAINT
+			}
+		}
+		if !checksPass(statement, table.checks, &rows[i]) {
+			return EXECUTE_CHECK_CONSTRAINT
+		}
+	}
+	return checkIndexes(statement, table, rows)
+}
+
+// 结果是 false 的 CHECK 约束的名字记录在 errorMessage 中
+func checksPass(statement *Statement, checks []Check, row *Row) bool {
+	for _, check := range checks {
+		if value := evalExpr(check.expr, row); isFalse(&value) {
+			statement.errorMessage = check.name
+			return false
+		}
+	}
+	return true
+}
+
+// 检查 rows 写入之后表的索引是否仍然满足约束，rows 还没有写入索引。
+// 插入和更新在检查通过之前不修改任何页，失败的语句不产生影响
+func checkIndexes(statement *Statement, table *Table, rows []Row) ExecuteResult {
+	for _, index := range table.indexes {
+		values := make(map[string]bool)
+		for i := range rows {
+			value := appendKeyValue(nil, &rows[i].values[index.column])
+			rowKey := tableRowKey(table, &rows[i])
+			if len(value)+len(rowKey) > BTREE_MAX_KEY_SIZE {
+				return EXECUTE_KEY_TOO_LARGE
+			}
+			// NULL 不和任何值相等，唯一索引中可以有多个 NULL
+			if !index.unique || value[0] == KEY_TAG_NULL {
+				continue
+			}
+			if values[string(value)] || indexConflicts(index, value, rowKey) {
+				statement.errorMessage = fmt.Sprintf("%s.%s", table.name, table.columns[index.column].name)
+				return EXECUTE_UNIQUE_CONSTRAINT
+			}
+			values[string(value)] = true
+			pagerEvict(table.pager)
+		}
+	}
+	return EXECUTE_SUCCESS
+}
+
+func executeInsert(statement *Statement, table *Table) ExecuteResult {
+	rows := statement.rowsToInsert
+	// 没有 INTEGER PRIMARY KEY 或者它是 NULL 的行，key 是之前最大的 key 加一。
+	// 有 PRIMARY KEY 的表没有 rowid，key 由主键列的值确定
+	if table.primaryKey == nil {
+		key, ok := tableNextKey(table)
+		for i := range rows {
+			if table.keyColumn >= 0 && rows[i].values[table.keyColumn].typ != VALUE_NULL {
+				if rows[i].key >= key {
+					key, ok = rows[i].key+1, rows[i].key < math.MaxInt64
+				}
+				continue
+			}
+			if !ok {
+				return EXECUTE_TABLE_FULL
+			}
+			rows[i].key = key
+			if table.keyColumn >= 0 {
+				rows[i].values[table.keyColumn] = Value{typ: VALUE_INTEGER, intValue: key}
+			}
+			key, ok = key+1, key < math.MaxInt64
+		}
+	}
+
+	// 插入之前先检查所有的行，有重复的主键时一行也不插入。
+	// 主键列不能是 NULL，先检查 NOT NULL 再检查主键是否重复
+	if result := checkConstraints(statement, table, rows); result != EXECUTE_SUCCESS {
+		return result
+	}
+	keys := make(map[string]bool)
+	for i := range rows {
+		key := tableRowKey(table, &rows[i])
+		if len(key) > BTREE_MAX_KEY_SIZE {
+			return EXECUTE_KEY_TOO_LARGE
+		}
+		if keys[string(key)] || cursorMatchesKey(btreeFind(table, key), key) {
+			return EXECUTE_DUPLICATE_KEY
+		}
+		keys[string(key)] = true
+		pagerEvict(table.pager)
+	}
+
+	for i := range rows {
+		tableInsert(table, &rows[i])
+		for _, index := range table.indexes {
+			indexInsert(index, table, &rows[i])
+		}
+		pagerEvict(table.pager)
+	}
+
+	return EXECUTE_SUCCESS
+}
+
+// 沿父节点向上修正记录该节点最大键的祖先键。
+// 若节点是父节点的右子节点，父节点中没有它的键，需要继续向上查找。
+func updateAncestorKey(table *Table, pageNum uint32, oldKey, newKey []byte) {
+	node := getPage(table.pager, pageNum)
+	for !isNodeRoot(node) {
+		parentPageNum := *nodeParent(node)
+		parent := getPage(table.pager, parentPageNum)
+		if internalNodeChildIndex(parent, pageNum) < *internalNodeNumKeys(parent) {
+			updateInternalNodeKey(table, parentPageNum, oldKey, newKey)
+			return
+		}
+		pageNum = parentPageNum
+		node = parent
+	}
+}
+
+// 从父节点中移除下标为index的子节点，它的内容已经合并到左边的兄弟节点(index-1)中。
+func internalNodeRemoveChild(node []byte, index uint32) {
+	numKeys := *internalNodeNumKeys(node)
+	cells := internalNodeCells(node)
+	if index == numKeys {
+		// 左兄弟成为新的右子节点，它原来的键不再需要
+		*internalNodeRightChild(node) = *internalNodeChild(node, index-1)
+	} else {
+		// 合并后的左兄弟继承被移除节点的最大键
+		cells[index] = buildInternalCell(*internalCellChild(cells[index-1]), internalCellKey(cells[index]))
+	}
+	internalNodeSetCells(node, slices.Delete(cells, int(index-1), int(index)))
+}
+
+// 根节点只剩一个子节点时，将子节点复制到根页，树的高度减一。
+func collapseRoot(table *Table) {
+	root := getPageForWrite(table.pager, table.rootPageNum)
+	childPageNum := *internalNodeRightChild(root)
+	child := getPage(table.pager, childPageNum)
+
+	copy(root, child)
+	setNodeRoot(root, true)
+
+	if getNodeType(root) == NODE_INTERNAL {
+		numKeys := *internalNodeNumKeys(root)
+		for i := uint32(0); i <= numKeys; i++ {
+			grandchild := getPageForWrite(table.pager, *internalNodeChild(root, i))
+			*nodeParent(grandchild) = table.rootPageNum
+		}
+	}
+
+	freePage(table.pager, childPageNum)
+}
+
+// 在父节点中下标为leftIndex和leftIndex+1的两个叶子节点之间，按照占用的空间重新分配单元格
+func leafNodeRedistribute(table *Table, parentPageNum, leftIndex uint32) {
+	parent := getPage(table.pager, parentPageNum)
+	left := getPageForWrite(table.pager, *internalNodeChild(parent, leftIndex))
+	right := getPageForWrite(table.pager, *internalNodeChild(parent, leftIndex+1))
+
+	cells := append(leafNodeCells(left), leafNodeCells(right)...)
+	splitPoint := leafNodeSplitPoint(cells)
+	leafNodeSetCells(left, cells[:splitPoint])
+	leafNodeSetCells(right, cells[splitPoint:])
+
+	internalNodeReplaceKey(table, parentPageNum, leftIndex, getNodeMaxKey(table.pager, left))
+}
+
+// 将父节点中下标为leftIndex+1的叶子节点合并到下标为leftIndex的叶子节点
+func leafNodeMerge(table *Table, parentPageNum, leftIndex uint32) {
+	parent := getPageForWrite(table.pager, parentPageNum)
+	left := getPageForWrite(table.pager, *internalNodeChild(parent, leftIndex))
+	right := getPage(table.pager, *internalNodeChild(parent, leftIndex+1))
+
+	leftNumCells := *leafNodeNumCells(left)
+	rightNumCells := *leafNodeNumCells(right)
+	for i := uint32(0); i < rightNumCells; i++ {
+		leafNodeInsertCell(left, leftNumCells+i, leafNodeCell(right, i))
+	}
+	*leafNodeNextLeaf(left) = *leafNodeNextLeaf(right)
+
+	freePage(table.pager, *internalNodeChild(parent, leftIndex+1))
+	internalNodeRemoveChild(parent, leftIndex+1)
+	internalNodeRebalance(table, parentPageNum)
+}
+
+// 处理叶子节点的下溢：和兄弟节点放得下一页时合并，否则和兄弟节点重新分配单元格。
+func leafNodeRebalance(table *Table, pageNum uint32) {
+	node := getPage(table.pager, pageNum)
+	parentPageNum := *nodeParent(node)
+	parent := getPageForWrite(table.pager, parentPageNum)
+	index := internalNodeChildIndex(parent, pageNum)
+
+	// 优先使用左兄弟
+	leftIndex := index
+	if index > 0 {
+		leftIndex = index - 1
+	}
+	left := getPage(table.pager, *internalNodeChild(parent, leftIndex))
+	right := getPage(table.pager, *internalNodeChild(parent, leftIndex+1))
+	if leafNodeUsedSpace(left)+leafNodeUsedSpace(right) <= LEAF_NODE_SPACE_FOR_CELLS {
+		leafNodeMerge(table, parentPageNum, leftIndex)
+	} else {
+		leafNodeRedistribute(table, parentPageNum, leftIndex)
+	}
+}
+
+// 将左兄弟的右子节点移动为内部节点的第一个子节点。父节点中的键最后修改，它变长时父节点可能分裂
+func internalNodeBorrowFromLeft(table *Table, parent []byte, index, pageNum uint32, node, left []byte) {
+	parentKey := slices.Clone(internalNodeKey(parent, index-1))
+	leftCells := internalNodeCells(left)
+	last := leftCells[len(leftCells)-1]
+	movedPageNum := *internalNodeRightChild(left)
+
+	internalNodeSetCells(node, slices.Insert(internalNodeCells(node), 0, buildInternalCell(movedPageNum, parentKey)))
+
+	*internalNodeRightChild(left) = *internalCellChild(last)
+	internalNodeSetCells(left, leftCells[:len(leftCells)-1])
+
+	*nodeParent(getPageForWrite(table.pager, movedPageNum)) = pageNum
+	internalNodeReplaceKey(table, *nodeParent(node), index-1, internalCellKey(last))
+}
+
+// 将右兄弟的第一个子节点移动为内部节点的右子节点
+func internalNodeBorrowFromRight(table *Table, parent []byte, index, pageNum uint32, node, right []byte) {
+	parentKey := slices.Clone(internalNodeKey(parent, index))
+	rightCells := internalNodeCells(right)
+	first := rightCells[0]
+	movedPageNum := *internalCellChild(first)
+
+	internalNodeSetCells(node, append(internalNodeCells(node), buildInternalCell(*internalNodeRightChild(node), parentKey)))
+	*internalNodeRightChild(node) = movedPageNum
+
+	internalNodeSetCells(right, rightCells[1:])
+
+	*nodeParent(getPageForWrite(table.pager, movedPageNum)) = pageNum
+	internalNodeReplaceKey(table, *nodeParent(node), index, internalCellKey(first))
+}
+
+// 父节点中下标为leftIndex和leftIndex+1的两个内部节点合并之后的单元格，
+// 父节点中两者之间的键下移成为左节点原右子节点的键。
+func internalNodeMergedCells(table *Table, parent []byte, leftIndex uint32) [][]byte {
+	left := getPage(table.pager, *internalNodeChild(parent, leftIndex))
+	right := getPage(table.pager, *internalNodeChild(parent, leftIndex+1))
+	cells := append(internalNodeCells(left), buildInternalCell(*internalNodeRightChild(left), internalNodeKey(parent, leftIndex)))
+	return append(cells, internalNodeCells(right)...)
+}
+
+// 合并之后的单元格能否放在一页中
+func internalNodeCanMerge(table *Table, parent []byte, leftIndex uint32) bool {
+	cells := internalNodeMergedCells(table, parent, leftIndex)
+	size := 0
+	for _, cell := range cells {
+		size += len(cell) + INTERNAL_NODE_CELL_POINTER_SIZE
+	}
+	return len(cells) <= INTERNAL_NODE_MAX_CELLS && size <= INTERNAL_NODE_SPACE_FOR_CELLS
+}
+
+// 将父节点中下标为leftIndex+1的内部节点合并到下标为leftIndex的内部节点
+func internalNodeMerge(table *Table, parentPageNum, leftIndex uint32) {
+	parent := getPageForWrite(table.pager, parentPageNum)
+	leftPageNum := *internalNodeChild(parent, leftIndex)
+	left := getPageForWrite(table.pager, leftPageNum)
+	right := getPage(table.pager, *internalNodeChild(parent, leftIndex+1))
+
+	leftNumKeys := *internalNodeNumKeys(left)
+	internalNodeSetCells(left, internalNodeMergedCells(table, parent, leftIndex))
+	*internalNodeRightChild(left) = *internalNodeRightChild(right)
+
+	for i := leftNumKeys + 1; i <= *internalNodeNumKeys(left); i++ {
+		child := getPageForWrite(table.pager, *internalNodeChild(left, i))
+		*nodeParent(child) = leftPageNum
+	}
+
+	freePage(table.pager, *internalNodeChild(parent, leftIndex+1))
+	internalNodeRemoveChild(parent, leftIndex+1)
+	internalNodeRebalance(table, parentPageNum)
+}
+
+// 处理内部节点的下溢，根节点只剩一个子节点时降低树的高度。
+func internalNodeRebalance(table *Table, pageNum uint32) {
+	node := getPageForWrite(table.pager, pageNum)
+	if isNodeRoot(node) {
+		if *internalNodeNumKeys(node) == 0 {
+			collapseRoot(table)
+		}
+		return
+	}
+	if *internalNodeNumKeys(node) >= INTERNAL_NODE_MIN_CELLS || internalNodeUsedSpace(node) >= INTERNAL_NODE_MIN_USED {
+		return
+	}
+
+	parentPageNum := *nodeParent(node)
+	parent := getPageForWrite(table.pager, parentPageNum)
+	numKeys := *internalNodeNumKeys(parent)
+	index := internalNodeChildIndex(parent, pageNum)
+
+	if index > 0 {
+		leftPageNum := *internalNodeChild(parent, index-1)
+		if *internalNodeNumKeys(getPage(table.pager, leftPageNum)) > INTERNAL_NODE_MIN_CELLS {
+			internalNodeBorrowFromLeft(table, parent, index, pageNum, node, getPageForWrite(table.pager, leftPageNum))
+			return
+		}
+	}
+	if index < numKeys {
+		rightPageNum := *internalNodeChild(parent, index+1)
+		if *internalNodeNumKeys(getPage(table.pager, rightPageNum)) > INTERNAL_NODE_MIN_CELLS {
+			internalNodeBorrowFromRight(table, parent, index, pageNum, node, getPageForWrite(table.pager, rightPageNum))
+			return
+		}
+	}
+
+	// 键很长时合并之后可能放不下，这时从兄弟节点借一个子节点
+	leftIndex := index
+	if index > 0 {
+		leftIndex = index - 1
+	}
+	if internalNodeCanMerge(table, parent, leftIndex) {
+		internalNodeMerge(table, parentPageNum, leftIndex)
+	} else if index > 0 {
+		internalNodeBorrowFromLeft(table, parent, index, pageNum, node, getPageForWrite(table.pager, *internalNodeChild(parent, index-1)))
+	} else {
+		internalNodeBorrowFromRight(table, parent, index, pageNum, node, getPageForWrite(table.pager, *internalNodeChild(parent, index+1)))
+	}
+}
+
+// 删除游标指向的单元格，必要时修正祖先键并重新平衡树。
+func leafNodeDelete(cursor *Cursor) {
+	table := cursor.table
+	node := getPageForWrite(table.pager, cursor.pageNum)
+	oldMax := getNodeMaxKey(table.pager, node)
+
+	freeOverflow(table.pager, leafNodeCell(node, cursor.cellNum))
+	leafNodeRemoveCell(node, cursor.cellNum)
+	numCells := *leafNodeNumCells(node)
+
+	if isNodeRoot(node) {
+		return
+	}
+
+	if numCells > 0 && cursor.cellNum == numCells {
+		// 删除的是叶子节点的最大键
+		updateAncestorKey(table, cursor.pageNum, oldMax, getNodeMaxKey(table.pager, node))
+	}
+
+	if leafNodeUsedSpace(node) < LEAF_NODE_MIN_USED {
+		leafNodeRebalance(table, cursor.pageNum)
+	}
+}
+
+// 用和 select 相同的扫描找到满足 WHERE 的所有行。扫描时修改 B 树会使游标失效，
+// 所以 update 和 delete 先找到所有的行再逐行修改
+func matchingRows(statement *Statement) []Row {
+	var rows []Row
+	scanRows(statement, false, func(row *Row) bool {
+		rows = append(rows, *row)
+		return true
+	})
+	return rows
+}
+
+func executeDelete(statement *Statement, table *Table) ExecuteResult {
+	rows := matchingRows(statement)
+	if len(rows) == 0 {
+		// 和 update 一样报告没有匹配的行
+		return EXECUTE_ROW_NOT_FOUND
+	}
+
+	for i := range rows {
+		for _, index := range table.indexes {
+			indexDelete(index, table, &rows[i])
+		}
+		leafNodeDelete(btreeFind(table, tableRowKey(table, &rows[i])))
+		pagerEvict(table.pager)
+	}
+	return EXECUTE_SUCCESS
+}
+
+// 在叶子节点中重写行，新的行在本页放得下时树的结构不受影响。
+// 所有的行都满足约束之后才开始修改
+func executeUpdate(statement *Statement, table *Table) ExecuteResult {
+	oldRows := matchingRows(statement)
+	if len(oldRows) == 0 {
+		return EXECUTE_ROW_NOT_FOUND
+	}
+
+	rows := make([]Row, len(oldRows))
+	for i := range oldRows {
+		rows[i] = Row{key: oldRows[i].key, values: slices.Clone(oldRows[i].values)}
+		for _, j := range statement.updateColumns {
+			rows[i].values[j] = statement.rowToUpdate.values[j]
+		}
+	}
+	if result := checkConstraints(statement, table, rows); result != EXECUTE_SUCCESS {
+		return result
+	}
+	for i := range rows {
+		// 只有索引列的值改变时才需要修改索引
+		for _, index := range table.indexes {
+			if !bytes.Equal(indexKey(index, table, &oldRows[i]), indexKey(index, table, &rows[i])) {
+				indexDelete(index, table, &oldRows[i])
+				indexInsert(index, table, &rows[i])
+			}
+		}
+		leafNodeUpdate(btreeFind(table, tableRowKey(table, &rows[i])), &rows[i])
+		pagerEvict(table.pager)
+	}
+	return EXECUTE_SUCCESS
+}
+
+// 空的 key 比所有的 key 都小，负数的 rowid 和主键编码之后的 key 也在它后面
+func tableStart(table *Table) *Cursor {
+	return btreeSeek(table, nil)
+}
+
+func booleanValue(b bool) Value {
+	if b {
+		return Value{typ: VALUE_BOOLEAN, intValue: 1}
+	}
+	return Value{typ: VALUE_BOOLEAN}
+}
+
+func isTrue(value *Value) bool {
+	return value.typ == VALUE_BOOLEAN && value.intValue != 0
+}
+
+func isFalse(value *Value) bool {
+	return value.typ == VALUE_BOOLEAN && value.intValue == 0
+}
+
+// 比较两个非 NULL 的值，类型已经在语义检查时确认可以比较
+func compareValues(left, right *Value) int {
+	if left.typ != right.typ {
+		// INTEGER 和 REAL 比较
+		return cmp.Compare(numericValue(left), numericValue(right))
+	}
+	switch left.typ {
+	case VALUE_REAL:
+		return cmp.Compare(left.floatValue, right.floatValue)
+	case VALUE_TEXT, VALUE_BLOB:
+		return strings.Compare(left.strValue, right.strValue)
+	}
+	return cmp.Compare(left.intValue, right.intValue)
+}
+
+func numericValue(value *Value) float64 {
+	if value.typ == VALUE_REAL {
+		return value.floatValue
+	}
+	return float64(value.intValue)
+}
+
+// LIKE 模式匹配，% 匹配任意多个字符，_ 匹配一个字符，ASCII 字母不区分大小写
+func likeMatch(pattern, text string) bool {
+	p, t := []rune(pattern), []rune(text)
+	i, j := 0, 0
+	star, mark := -1, 0 // 最近一个 % 的位置，以及它已经匹配到的位置
+	for j < len(t) {
+		switch {
+		case i < len(p) && p[i] == '%':
+			star, mark = i, j
+			i++
+		case i < len(p) && (p[i] == '_' || foldASCII(p[i]) == foldASCII(t[j])):
+			i++
+			j++
+		case star >= 0:
+			// 让最近的 % 多匹配一个字符
+			i, mark = star+1, mark+1
+			j = mark
+		default:
+			return false
+		}
+	}
+	for i < len(p) && p[i] == '%' {
+		i++
+	}
+	return i == len(p)
+}
+
+func foldASCII(c rune) rune {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// 计算表达式在 row 上的值，运算数的类型已经在语义检查时确认过。
+// 运算数是 NULL 时结果一般也是 NULL，AND 和 OR 按照三值逻辑计算。
+func evalExpr(expr *Expr, row *Row) Value {
+	switch expr.typ {
+	case EXPR_COLUMN:
+		if expr.columnIndex < 0 {
+			return Value{typ: VALUE_INTEGER, intValue: row.key}
+		}
+		return row.values[expr.columnIndex]
+	case EXPR_UNARY:
+		value := evalExpr(expr.left, row)
+		if expr.op == "IS NULL" {
+			return booleanValue(value.typ == VALUE_NULL)
+		}
+		if value.typ == VALUE_NULL {
+			return value
+		}
+		switch {
+		case expr.op == "NOT":
+			value.intValue = 1 - value.intValue
+		case value.typ == VALUE_REAL:
+			value.floatValue = -value.floatValue
+		case value.intValue == math.MinInt64:
+			// 最小的 INTEGER 取反之后超出范围，改用 REAL
+			value = Value{typ: VALUE_REAL, floatValue: -float64(value.intValue)}
+		default:
+			value.intValue = -value.intValue
+		}
+		return value
+	case EXPR_BINARY:
+		return evalBinary(expr, row)
+	case EXPR_IN:
+		left := evalExpr(expr.left, row)
+		if left.typ == VALUE_NULL {
+			return left
+		}
+		// 没有相等的值，但是列表中有 NULL 时结果是 NULL
+		hasNull := false
+		for _, item := range expr.list {
+			right := evalExpr(item, row)
+			if right.typ == VALUE_NULL {
+				hasNull = true
+			} else if compareValues(&left, &right) == 0 {
+				return booleanValue(true)
+			}
+		}
+		if hasNull {
+			return Value{typ: VALUE_NULL}
+		}
+		return booleanValue(false)
+	case EXPR_FUNCTION:
+		return evalFunction(expr, row)
+	case EXPR_AGGREGATE:
+		return row.values[expr.columnIndex]
+	}
+	var value Value
+	literalValue(expr, &value)
+	return value
+}
+
+// 内置函数，除了 coalesce 以外参数是 NULL 时结果是 NULL
+func evalFunction(expr *Expr, row *Row) Value {
+	args := make([]Value, len(expr.list))
+	for i, arg := range expr.list {
+		args[i] = evalExpr(arg, row)
+	}
+	if expr.strValue == "coalesce" {
+		for _, arg := range args {
+			if arg.typ == VALUE_INTEGER && expr.resultType == VALUE_REAL {
+				return Value{typ: VALUE_REAL, floatValue: float64(arg.intValue)}
+			}
+			if arg.typ != VALUE_NULL {
+				return arg
+			}
+		}
+		return Value{typ: VALUE_NULL}
+	}
+	for _, arg := range args {
+		if arg.typ == VALUE_NULL {
+			return arg
+		}
 	}
 
-	if fileLength%PAGE_SIZE != 0 {
-		fmt.Printf("Db file is not a whole number of pages. Corrupt file.\n")
-		os.Exit(1)
+	value := args[0]
+	switch expr.strValue {
+	case "length":
+		// TEXT 是字符数，BLOB 是字节数
+		length := len(value.strValue)
+		if value.typ == VALUE_TEXT {
+			length = utf8.RuneCountInString(value.strValue)
+		}
+		return Value{typ: VALUE_INTEGER, intValue: int64(length)}
+	case "upper":
+		value.strValue = strings.ToUpper(value.strValue)
+	case "lower":
+		value.strValue = strings.ToLower(value.strValue)
+	case "abs":
+		if value.typ == VALUE_REAL {
+			value.floatValue = math.Abs(value.floatValue)
+		} else if value.intValue == math.MinInt64 {
+			// 最小的 INTEGER 的绝对值超出范围，改用 REAL
+			value = Value{typ: VALUE_REAL, floatValue: -float64(value.intValue)}
+		} else if value.intValue < 0 {
+			value.intValue = -value.intValue
+		}
+	case "substr":
+		length := int64(math.MaxInt32)
+		if len(args) == 3 {
+			length = args[2].intValue
+		}
+		value.strValue = substr(value.strValue, value.typ == VALUE_TEXT, args[1].intValue, length)
 	}
+	return value
+}
 
-	for i := 0; i < TABLE_MAX_PAGES; i++ {
-		pager.pages[i] = nil
+// substr(x, start, length)：start 从1开始，负数从末尾开始数；length 是负数时取 start 之前的字符。
+// TEXT 按字符计算，BLOB 按字节计算
+func substr(s string, isText bool, start, length int64) string {
+	var chars []string
+	if isText {
+		for _, c := range s {
+			chars = append(chars, string(c))
+		}
+	} else {
+		for i := 0; i < len(s); i++ {
+			chars = append(chars, s[i:i+1])
+		}
 	}
+	n := int64(len(chars))
 
-	return pager
+	negative := length < 0
+	if negative {
+		length = -length
+	}
+	// 转换成从0开始的下标
+	switch {
+	case start < 0:
+		start += n
+		if start < 0 {
+			length = max(length+start, 0)
+			start = 0
+		}
+	case start > 0:
+		start--
+	case length > 0:
+		// start 是0时位于第一个字符之前
+		length--
+	}
+	if negative {
+		start -= length
+		if start < 0 {
+			length += start
+			start = 0
+		}
+	}
+	start = min(start, n)
+	end := start + min(length, n-start)
+	return strings.Join(chars[start:end], "")
 }
 
-func dbOpen(filename string) *Table {
-	pager := pagerOpen(filename)
+func evalBinary(expr *Expr, row *Row) Value {
+	left := evalExpr(expr.left, row)
+	switch expr.op {
+	case "AND", "OR":
+		// 一边是 false（OR 是 true）时结果就是它，否则有 NULL 时结果是 NULL
+		decisive := isFalse
+		if expr.op == "OR" {
+			decisive = isTrue
+		}
+		if decisive(&left) {
+			return left
+		}
+		right := evalExpr(expr.right, row)
+		if decisive(&right) || right.typ == VALUE_NULL {
+			return right
+		}
+		return left
+	}
+
+	right := evalExpr(expr.right, row)
+	if left.typ == VALUE_NULL || right.typ == VALUE_NULL {
+		return Value{typ: VALUE_NULL}
+	}
+	switch expr.op {
+	case "+", "-", "*", "/":
+		return evalArithmetic(expr.op, &left, &right)
+	case "||":
+		return Value{typ: VALUE_TEXT, strValue: formatValue(&left) + formatValue(&right)}
+	case "LIKE":
+		return booleanValue(likeMatch(right.strValue, left.strValue))
+	}
+	c := compareValues(&left, &right)
+	switch expr.op {
+	case "=":
+		return booleanValue(c == 0)
+	case "!=":
+		return booleanValue(c != 0)
+	case "<":
+		return booleanValue(c < 0)
+	case "<=":
+		return booleanValue(c <= 0)
+	case ">":
+		return booleanValue(c > 0)
+	}
+	return booleanValue(c >= 0)
+}
 
-	table := &Table{
-		rootPageNum: 0,
-		pager:       pager,
+// 两个 INTEGER 的运算结果是 INTEGER，溢出时和 SQLite 一样改用 REAL 计算。除以0的结果是 NULL
+func evalArithmetic(op string, left, right *Value) Value {
+	if left.typ == VALUE_INTEGER && right.typ == VALUE_INTEGER {
+		a, b := left.intValue, right.intValue
+		var result int64
+		var overflow bool
+		switch op {
+		case "+":
+			// 同号的两个数相加，或者异号的两个数相减，结果的符号和 a 不同时溢出
+			result = a + b
+			overflow = (a < 0) == (b < 0) && (result < 0) != (a < 0)
+		case "-":
+			result = a - b
+			overflow = (a < 0) != (b < 0) && (result < 0) != (a < 0)
+		case "*":
+			result = a * b
+			overflow = a != 0 && (result/a != b || (a == -1 && b == math.MinInt64))
+		default:
+			if b == 0 {
+				return Value{typ: VALUE_NULL}
+			}
+			result = a / b
+			overflow = a == math.MinInt64 && b == -1
+		}
+		if !overflow {
+			return Value{typ: VALUE_INTEGER, intValue: result}
+		}
+	}
+	a, b := numericValue(left), numericValue(right)
+	switch op {
+	case "+":
+		return Value{typ: VALUE_REAL, floatValue: a + b}
+	case "-":
+		return Value{typ: VALUE_REAL, floatValue: a - b}
+	case "*":
+		return Value{typ: VALUE_REAL, floatValue: a * b}
+	}
+	if b == 0 {
+		return Value{typ: VALUE_NULL}
 	}
+	return Value{typ: VALUE_REAL, floatValue: a / b}
+}
 
-	if pager.numPages == 0 {
-		// New database file. Initialize page 0 as leaf node.
-		rootNode := getPage(pager, 0)
-		initializeLeafNode(rootNode)
-		setNodeRoot(rootNode, true)
+// 没有 WHERE，或者 WHERE 的结果是 true 时这一行满足条件，false 和 NULL 都不满足
+func rowMatches(where *Expr, row *Row) bool {
+	if where == nil {
+		return true
 	}
+	value := evalExpr(where, row)
+	return isTrue(&value)
+}
 
-	return table
+// 按照 select 的结果列计算输出的一行，* 展开成表的所有列
+func projectRow(statement *Statement, row *Row) Row {
+	var output Row
+	for _, expr := range statement.resultColumns {
+		if expr.typ == EXPR_STAR {
+			// 分组的行在表的列后面还有聚合函数的结果
+			output.values = append(output.values, row.values[:len(statement.table.columns)]...)
+		} else {
+			output.values = append(output.values, evalExpr(expr, row))
+		}
+	}
+	return output
 }
 
-func pagerFlush(pager *Pager, pageNum uint32) {
-	if pager.pages[pageNum] == nil {
-		fmt.Printf("Tried to flush null page\n")
-		os.Exit(1)
+// NULL 排在最前面
+func compareSortValues(left, right *Value) int {
+	if left.typ == VALUE_NULL || right.typ == VALUE_NULL {
+		return cmp.Compare(boolToInt(left.typ != VALUE_NULL), boolToInt(right.typ != VALUE_NULL))
 	}
+	return compareValues(left, right)
+}
 
-	offset, err := pager.fileDescriptor.Seek(int64(pageNum*PAGE_SIZE), os.SEEK_SET)
-	if err != nil {
-		fmt.Printf("Error seeking: %v\n", err)
-		os.Exit(1)
+func boolToInt(b bool) int {
+	if b {
+		return 1
 	}
+	return 0
+}
 
-	if offset != int64(pageNum*PAGE_SIZE) {
-		fmt.Printf("Seek offset does not match page start\n")
-		os.Exit(1)
+func compareRecords(sorter *Sorter, left, right *Row) int {
+	for i, term := range sorter.terms {
+		c := compareSortValues(&left.values[i], &right.values[i])
+		if term.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
 	}
+	return 0
+}
 
-	_, err = pager.fileDescriptor.Write(pager.pages[pageNum][:PAGE_SIZE])
-	if err != nil {
-		fmt.Printf("Error writing: %v\n", err)
-		os.Exit(1)
+func sorterAdd(sorter *Sorter, record Row) {
+	if sorter.format == nil {
+		sorter.format = &Table{columns: make([]Column, len(record.values)), keyColumn: -1}
+	}
+	sorter.records = append(sorter.records, record)
+	sorter.memory += recordSize(sorter.format, &record)
+	if sorter.memory > sorter.bufferSize {
+		sorterSpill(sorter)
 	}
 }
 
-func dbClose(table *Table) {
-	pager := table.pager
+// 稳定排序，排序键相同的行保持扫描的顺序
+func sorterSort(sorter *Sorter) {
+	slices.SortStableFunc(sorter.records, func(a, b Row) int {
+		return compareRecords(sorter, &a, &b)
+	})
+}
 
-	for i := uint32(0); i < pager.numPages; i++ {
-		if pager.pages[i] == nil {
-			continue
-		}
-		pagerFlush(pager, i)
-		pager.pages[i] = nil
+// 内存中的记录排好序写入一个新的临时文件
+func sorterSpill(sorter *Sorter) {
+	sorterSort(sorter)
+	file, err := os.CreateTemp("", "baby-db-sort-*")
+	if err != nil {
+		fmt.Printf("Error creating temp file: %v\n", err)
+		os.Exit(1)
+	}
+	// 文件关闭之后自动删除
+	os.Remove(file.Name())
+
+	writer := bufio.NewWriter(file)
+	for i := range sorter.records {
+		data := serializeRow(sorter.format, &sorter.records[i])
+		writer.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(data))))
+		writer.Write(data)
+	}
+	if err := writer.Flush(); err != nil {
+		fmt.Printf("Error writing temp file: %v\n", err)
+		os.Exit(1)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		fmt.Printf("Error seeking: %v\n", err)
+		os.Exit(1)
 	}
+	sorter.runs = append(sorter.runs, file)
+	sorter.records = nil
+	sorter.memory = 0
+}
 
-	err := pager.fileDescriptor.Close()
+// 读出有序段中的下一条记录，读完时返回 false
+func sorterReadRecord(sorter *Sorter, reader *bufio.Reader, record *Row) bool {
+	var length [4]byte
+	_, err := io.ReadFull(reader, length[:])
+	if err == io.EOF {
+		return false
+	}
+	data := make([]byte, binary.LittleEndian.Uint32(length[:]))
+	if err == nil {
+		_, err = io.ReadFull(reader, data)
+	}
 	if err != nil {
-		fmt.Printf("Error closing db file: %v\n", err)
+		fmt.Printf("Error reading temp file: %v\n", err)
 		os.Exit(1)
 	}
+	deserializeRow(sorter.format, data, record)
+	return true
+}
 
-	for i := 0; i < TABLE_MAX_PAGES; i++ {
-		page := pager.pages[i]
-		if page != nil {
-			pager.pages[i] = nil
+// 按顺序把每一行的输出列交给 emit，emit 返回 false 时停止
+func sorterEach(sorter *Sorter, emit func(output *Row) bool) {
+	n := len(sorter.terms)
+	if len(sorter.runs) == 0 {
+		sorterSort(sorter)
+		for i := range sorter.records {
+			if !emit(&Row{values: sorter.records[i].values[n:]}) {
+				return
+			}
 		}
+		return
 	}
 
-	os.Exit(0)
+	if len(sorter.records) > 0 {
+		sorterSpill(sorter)
+	}
+	defer sorterClose(sorter)
+	// 每个段当前最小的记录，相同的记录取前面的段，保证排序是稳定的
+	readers := make([]*bufio.Reader, len(sorter.runs))
+	heads := make([]Row, len(sorter.runs))
+	valid := make([]bool, len(sorter.runs))
+	for i, file := range sorter.runs {
+		readers[i] = bufio.NewReader(file)
+		valid[i] = sorterReadRecord(sorter, readers[i], &heads[i])
+	}
+	for {
+		best := -1
+		for i := range heads {
+			if valid[i] && (best < 0 || compareRecords(sorter, &heads[i], &heads[best]) < 0) {
+				best = i
+			}
+		}
+		if best < 0 || !emit(&Row{values: heads[best].values[n:]}) {
+			return
+		}
+		valid[best] = sorterReadRecord(sorter, readers[best], &heads[best])
+	}
 }
 
-func printPrompt() {
-	fmt.Print("db > ")
+func sorterClose(sorter *Sorter) {
+	for _, file := range sorter.runs {
+		file.Close()
+	}
+	sorter.runs = nil
 }
 
-func readInput(reader *bufio.Reader, table *Table, inputBuffer *InputBuffer) {
-	// chatGPT init error, need to debug
-	//reader := bufio.NewReader(os.Stdin)
-	buffer, err := reader.ReadString('\n')
-	if err != nil {
-		dbClose(table)
-		if err == io.EOF {
-			os.Exit(0)
-		}
-		fmt.Println("Error reading input: ", err.Error())
-		os.Exit(1)
+// 从 lowKey 开始沿着叶子节点的链表扫描，key 超过 highKey 时停止，把满足 WHERE 的行交给 visit。
+// reverse 时反过来从 highKey 开始向前扫描到 lowKey。visit 返回 false 时停止扫描。
+func scanRows(statement *Statement, reverse bool, visit func(row *Row) bool) {
+	table := statement.table
+	if statement.index != nil || table.primaryKey != nil {
+		scanKeyRange(statement, reverse, visit)
+		return
+	}
+	if statement.lowKey > statement.highKey {
+		return
 	}
 
-	// Ignore newline character
-	buffer = buffer[:len(buffer)-1]
-	inputBuffer.inputLength = len(buffer)
-	inputBuffer.buffer = buffer
+	var row Row
+	var cursor *Cursor
+	if reverse {
+		cursor = tableSeekLast(table, statement.highKey)
+	} else {
+		cursor = tableSeek(table, statement.lowKey)
+	}
+	for cursor.endOfTable == false {
+		key := decodeRowKey(cursorKey(cursor))
+		if key < statement.lowKey || key > statement.highKey {
+			break
+		}
+		cursorRow(cursor, &row)
+		if rowMatches(statement.where, &row) && !visit(&row) {
+			break
+		}
+		if reverse {
+			cursorRetreat(cursor)
+		} else {
+			cursorAdvance(cursor)
+		}
+		pagerEvict(table.pager)
+	}
 }
 
-func closeInputBuffer(inputBuffer *InputBuffer) {
-	inputBuffer.buffer = ""
-}
+// 按 key 的顺序扫描索引或者有 PRIMARY KEY 的表中 [seekLow, seekHigh] 之间的项，
+// 索引项的 key 末尾是表的 key，用它在表中找到对应的行
+func scanKeyRange(statement *Statement, reverse bool, visit func(row *Row) bool) {
+	table := statement.table
+	tree := table
+	if statement.index != nil {
+		tree = statement.index.tree
+	}
 
-func doMetaCommand(inputBuffer *InputBuffer, table *Table) MetaCommandResult {
-	if inputBuffer.buffer == ".exit" {
-		closeInputBuffer(inputBuffer)
-		dbClose(table)
-		return META_COMMAND_SUCCESS
-	} else if inputBuffer.buffer == ".btree" {
-		fmt.Printf(("Tree:\n"))
-		printTree(table.pager, 0, 0)
-		return META_COMMAND_SUCCESS
-	} else if inputBuffer.buffer == ".constants" {
-		fmt.Printf(("Constants:\n"))
-		printConstants()
-		return META_COMMAND_SUCCESS
+	var row Row
+	var cursor *Cursor
+	if reverse {
+		cursor = btreeSeekLast(tree, statement.seekHigh)
 	} else {
-		return META_COMMAND_UNRECOGNIZED_COMMAND
+		cursor = btreeSeek(tree, statement.seekLow)
+	}
+	for !cursor.endOfTable {
+		key := cursorKey(cursor)
+		if reverse && bytes.Compare(key, statement.seekLow) < 0 {
+			break
+		}
+		high := statement.seekHigh
+		if !reverse && high != nil && bytes.Compare(key, high) > 0 && !bytes.HasPrefix(key, high) {
+			break
+		}
+		if tree == table {
+			cursorRow(cursor, &row)
+		} else {
+			var value Value
+			rowKey := slices.Clone(decodeKeyValue(key, &value))
+			cursorRow(btreeFind(table, rowKey), &row)
+		}
+		if rowMatches(statement.where, &row) && !visit(&row) {
+			break
+		}
+		if reverse {
+			cursorRetreat(cursor)
+		} else {
+			cursorAdvance(cursor)
+		}
+		pagerEvict(table.pager)
 	}
 }
 
-func prepareInsert(inputBuffer *InputBuffer, statement *Statement) PrepareResult {
-	statement.typ = STATEMENT_INSERT
+// 聚合函数的中间结果，sum 的 value 是累加值，min 和 max 的 value 是当前的最小值或最大值。
+// avg 在 total 中用 REAL 累加，不会溢出
+type Aggregate struct {
+	count int64 // 参数不是 NULL 的行数，count(*) 是所有行数
+	value Value
+	total float64
+}
 
-	tokens := strings.Fields(inputBuffer.buffer)
-	if len(tokens) != 4 {
-		return PREPARE_SYNTAX_ERROR
-	}
+// 一个分组保留第一行，用来计算 select 中不在聚合函数里面的列
+type Group struct {
+	row        Row
+	aggregates []Aggregate
+}
 
-	id, err := strconv.Atoi(tokens[1])
-	if err != nil {
-		return PREPARE_NEGATIVE_ID
+func aggregateStep(expr *Expr, aggregate *Aggregate, row *Row) {
+	if expr.list[0].typ == EXPR_STAR {
+		aggregate.count++
+		return
+	}
+	value := evalExpr(expr.list[0], row)
+	if value.typ == VALUE_NULL {
+		return
+	}
+	aggregate.count++
+	switch {
+	case expr.strValue == "avg":
+		aggregate.total += numericValue(&value)
+	case aggregate.value.typ == VALUE_NULL:
+		aggregate.value = value
+	case expr.strValue == "sum":
+		// INTEGER 的和溢出之后 evalArithmetic 返回 REAL，之后继续用 REAL 累加
+		aggregate.value = evalArithmetic("+", &aggregate.value, &value)
+	case expr.strValue == "min" && compareValues(&value, &aggregate.value) < 0:
+		aggregate.value = value
+	case expr.strValue == "max" && compareValues(&value, &aggregate.value) > 0:
+		aggregate.value = value
 	}
+}
 
-	if id < 0 {
-		return PREPARE_NEGATIVE_ID
+func aggregateResult(expr *Expr, aggregate *Aggregate) Value {
+	switch expr.strValue {
+	case "count":
+		return Value{typ: VALUE_INTEGER, intValue: aggregate.count}
+	case "avg":
+		if aggregate.count == 0 {
+			return Value{typ: VALUE_NULL}
+		}
+		return Value{typ: VALUE_REAL, floatValue: aggregate.total / float64(aggregate.count)}
+	case "sum":
+		if aggregate.value.typ == VALUE_INTEGER && expr.resultType == VALUE_REAL {
+			return Value{typ: VALUE_REAL, floatValue: float64(aggregate.value.intValue)}
+		}
 	}
+	return aggregate.value
+}
 
-	if len(tokens[2]) > COLUMN_USERNAME_SIZE || len(tokens[3]) > COLUMN_EMAIL_SIZE {
-		return PREPARE_STRING_TOO_LONG
+// 哈希分组：GROUP BY 的值序列化之后作为哈希表的 key，按照每组第一次出现的顺序输出。
+// 没有 GROUP BY 时所有行是一组，没有行时也输出一组。
+func groupRows(statement *Statement, output func(row *Row) bool) {
+	table := statement.table
+	format := &Table{columns: make([]Column, len(statement.groupBy)), keyColumn: -1}
+	groups := make(map[string]*Group)
+	var order []*Group
+	scanRows(statement, false, func(row *Row) bool {
+		groupKey := Row{values: make([]Value, len(statement.groupBy))}
+		for i, expr := range statement.groupBy {
+			groupKey.values[i] = evalExpr(expr, row)
+		}
+		key := string(serializeRow(format, &groupKey))
+		group := groups[key]
+		if group == nil {
+			group = &Group{row: *row, aggregates: make([]Aggregate, len(statement.aggregates))}
+			groups[key] = group
+			order = append(order, group)
+		}
+		for i, expr := range statement.aggregates {
+			aggregateStep(expr, &group.aggregates[i], row)
+		}
+		return true
+	})
+	if len(order) == 0 && len(statement.groupBy) == 0 {
+		order = append(order, &Group{
+			row:        Row{values: make([]Value, len(table.columns))},
+			aggregates: make([]Aggregate, len(statement.aggregates)),
+		})
 	}
 
-	statement.rowToInsert.id = uint32(id)
-	copy(statement.rowToInsert.username[:], tokens[2])
-	copy(statement.rowToInsert.email[:], tokens[3])
+	for _, group := range order {
+		row := Row{key: group.row.key, values: slices.Clone(group.row.values)}
+		for i, expr := range statement.aggregates {
+			row.values = append(row.values, aggregateResult(expr, &group.aggregates[i]))
+		}
+		if !output(&row) {
+			return
+		}
+	}
+}
 
-	return PREPARE_SUCCESS
+// 主键的 min 是正向扫描第一个满足 WHERE 的行，max 是反向扫描第一个满足 WHERE 的行
+func minMaxKeyRow(statement *Statement, output func(row *Row) bool) {
+	row := Row{values: make([]Value, len(statement.table.columns))}
+	results := make([]Value, len(statement.aggregates))
+	for i, expr := range statement.aggregates {
+		scanRows(statement, expr.strValue == "max", func(found *Row) bool {
+			if i == 0 {
+				row = *found
+			}
+			results[i] = evalExpr(expr.list[0], found)
+			return false
+		})
+	}
+	row.values = append(row.values, results...)
+	output(&row)
 }
 
-func prepareStatement(inputBuffer *InputBuffer, statement *Statement) PrepareResult {
-	tokens := strings.Fields(inputBuffer.buffer)
+// 需要排序时先把结果交给排序器，否则直接输出，输出 LIMIT 行之后停止扫描。
+// 有 GROUP BY 或聚合函数时先分组，HAVING 和 ORDER BY 在分组的行上计算。
+func executeSelect(statement *Statement, db *Database) ExecuteResult {
+	i := 0
+	if statement.limit == 0 {
+		fmt.Printf("total_rows: %d\n", i)
+		return EXECUTE_SUCCESS
+	}
 
-	if len(tokens) == 0 {
-		return PREPARE_UNRECOGNIZED_STATEMENT
+	offset := statement.offset
+	emit := func(output *Row) bool {
+		if offset > 0 {
+			offset--
+			return true
+		}
+		printRow(output)
+		i++
+		return statement.limit < 0 || int64(i) < statement.limit
+	}
+	var sorter *Sorter
+	if statement.needSort {
+		sorter = &Sorter{terms: statement.orderBy, bufferSize: db.sortBufferSize}
+	}
+	output := func(row *Row) bool {
+		if !rowMatches(statement.having, row) {
+			return true
+		}
+		result := projectRow(statement, row)
+		if sorter == nil {
+			return emit(&result)
+		}
+		record := Row{values: make([]Value, 0, len(statement.orderBy)+len(result.values))}
+		for _, term := range statement.orderBy {
+			record.values = append(record.values, evalExpr(term.expr, row))
+		}
+		record.values = append(record.values, result.values...)
+		sorterAdd(sorter, record)
+		return true
 	}
 
-	switch tokens[0] {
-	case "insert":
-		return prepareInsert(inputBuffer, statement)
-	case "select":
-		statement.typ = STATEMENT_SELECT
-		return PREPARE_SUCCESS
+	switch {
+	case statement.minMaxKey:
+		minMaxKeyRow(statement, output)
+	case statement.grouped:
+		groupRows(statement, output)
 	default:
-		return PREPARE_UNRECOGNIZED_STATEMENT
+		scanRows(statement, statement.reverse, output)
 	}
+	if sorter != nil {
+		sorterEach(sorter, emit)
+	}
+	fmt.Printf("total_rows: %d\n", i)
+	return EXECUTE_SUCCESS
 }
 
-func getUnusedPageNum(pager *Pager) uint32 {
-	return pager.numPages
+// 分配一棵空的 B 树，在系统表中记录它的名字、根节点和创建它的语句，返回根节点和系统表中的 key。
+// 系统表的 key 已经用完时返回 false
+func catalogCreateTree(db *Database, name, sql string) (uint32, int64, bool) {
+	key, ok := tableNextKey(db.catalog)
+	if !ok {
+		return 0, 0, false
+	}
+
+	rootPageNum := getUnusedPageNum(db.pager)
+	root := getPageForWrite(db.pager, rootPageNum)
+	initializeLeafNode(root)
+	setNodeRoot(root, true)
+
+	row := Row{key: key, values: []Value{
+		{typ: VALUE_TEXT, strValue: name},
+		{typ: VALUE_INTEGER, intValue: int64(rootPageNum)},
+		{typ: VALUE_TEXT, strValue: sql},
+	}}
+	tableInsert(db.catalog, &row)
+
+	header := getPageForWrite(db.pager, HEADER_PAGE_NUM)
+	*headerSchemaCookie(header) += 1
+	return rootPageNum, key, true
 }
 
-// 创建一个新节点并将一半单元格移动过去。
-// 在两个节点中的一个中插入新值。
-// 更新父节点或创建一个新的父节点。
-func leafNodeSplitAndInsert(cursor *Cursor, key uint32, value *Row) {
-	oldNode := getPage(cursor.table.pager, cursor.pageNum)
-	oldMax := getNodeMaxKey(cursor.table.pager, oldNode)
-	newPageNum := getUnusedPageNum(cursor.table.pager)
-	newNode := getPage(cursor.table.pager, newPageNum)
-	initializeLeafNode(newNode)
-	*nodeParent(newNode) = *nodeParent(oldNode)
-	*leafNodeNextLeaf(newNode) = *leafNodeNextLeaf(oldNode)
-	*leafNodeNextLeaf(oldNode) = newPageNum
+// 释放 B 树的所有页，从系统表中删除它
+func catalogDropTree(db *Database, rootPageNum uint32, catalogKey int64) {
+	freeTree(db.pager, rootPageNum)
+	leafNodeDelete(tableFind(db.catalog, catalogKey))
 
-	/*
-	  所有现有键以及新键应该均匀分布
-	  在旧（左）和新（右）节点之间。
-	  从右侧开始，将每个键移动到正确的位置。
-	*/
-	for i := LEAF_NODE_MAX_CELLS; i >= 0; i-- {
-		var destinationNode []byte
-		if i >= LEAF_NODE_LEFT_SPLIT_COUNT {
-			destinationNode = newNode
-		} else {
-			destinationNode = oldNode
-		}
-		indexWithinNode := i % LEAF_NODE_LEFT_SPLIT_COUNT
-		destination := leafNodeCell(destinationNode, uint32(indexWithinNode))
+	header := getPageForWrite(db.pager, HEADER_PAGE_NUM)
+	*headerSchemaCookie(header) += 1
+}
 
-		if i == int(cursor.cellNum) {
-			serializeRow(value, leafNodeValue(destinationNode, uint32(indexWithinNode)))
-			*leafNodeKey(destinationNode, uint32(indexWithinNode)) = key
-		} else if i > int(cursor.cellNum) {
-			copy(destination, leafNodeCell(oldNode, uint32(i-1))[:LEAF_NODE_CELL_SIZE])
-		} else {
-			copy(destination, leafNodeCell(oldNode, uint32(i))[:LEAF_NODE_CELL_SIZE])
-		}
+// 分配根节点，在系统表中记录新表，UNIQUE 列同时创建唯一索引
+func executeCreateTable(statement *Statement, db *Database) ExecuteResult {
+	table := statement.table
+	rootPageNum, key, ok := catalogCreateTree(db, table.name, statement.sql)
+	if !ok {
+		return EXECUTE_TABLE_FULL
 	}
+	table.rootPageNum = rootPageNum
+	table.catalogKey = key
+	db.tables[table.name] = table
 
-	/* 在两个叶子节点上更新单元格计数 */
-	*leafNodeNumCells(oldNode) = LEAF_NODE_LEFT_SPLIT_COUNT
-	*leafNodeNumCells(newNode) = LEAF_NODE_RIGHT_SPLIT_COUNT
-	if isNodeRoot(oldNode) {
-		createNewRoot(cursor.table, newPageNum)
-	} else {
-		parentPageNum := *nodeParent(oldNode)
-		newMax := getNodeMaxKey(cursor.table.pager, oldNode)
-		parent := getPage(cursor.table.pager, parentPageNum)
-
-		updateInternalNodeKey(parent, oldMax, newMax)
-		internalNodeInsert(cursor.table, parentPageNum, newPageNum)
+	for i, column := range table.columns {
+		if !column.unique {
+			continue
+		}
+		index := &Index{
+			name:      fmt.Sprintf("%s%s_%d", AUTOINDEX_PREFIX, table.name, len(table.indexes)+1),
+			tableName: table.name,
+			column:    i,
+			unique:    true,
+		}
+		index.sql = fmt.Sprintf("create unique index %s on %s (%s)", index.name, table.name, column.name)
+		index.tree = &Table{name: index.name, pager: db.pager, keyColumn: -1}
+		if index.tree.rootPageNum, index.catalogKey, ok = catalogCreateTree(db, index.name, index.sql); !ok {
+			return EXECUTE_TABLE_FULL
+		}
+		table.indexes = append(table.indexes, index)
+		db.indexes[index.name] = index
 	}
+	return EXECUTE_SUCCESS
 }
 
-func leafNodeInsert(cursor *Cursor, key uint32, value *Row) {
-	node := getPage(cursor.table.pager, cursor.pageNum)
-
-	numCells := *leafNodeNumCells(node)
-	if numCells >= LEAF_NODE_MAX_CELLS {
-		leafNodeSplitAndInsert(cursor, key, value)
-		return
+// 释放表和它的索引的所有页，从系统表中删除它们
+func executeDropTable(statement *Statement, db *Database) ExecuteResult {
+	table := statement.table
+	for _, index := range table.indexes {
+		catalogDropTree(db, index.tree.rootPageNum, index.catalogKey)
+		delete(db.indexes, index.name)
 	}
+	catalogDropTree(db, table.rootPageNum, table.catalogKey)
+	delete(db.tables, table.name)
+	return EXECUTE_SUCCESS
+}
 
-	if cursor.cellNum < numCells {
-		// Make room for new cell
-		for i := numCells; i > cursor.cellNum; i-- {
-			copy(leafNodeCell(node, i), leafNodeCell(node, i-1))
+// 扫描表把所有的索引项交给排序器，值太长时不创建索引，排序器在内存不够时把索引项写入临时文件。
+// 之后按顺序插入所有的索引项，唯一索引中相同的值排在一起，发现重复时删除已经插入了一部分的索引
+func executeCreateIndex(statement *Statement, db *Database) ExecuteResult {
+	table := statement.table
+	index := statement.index
+	// 排序键和输出的列都是索引项
+	sorter := &Sorter{terms: []OrderTerm{{}}, bufferSize: db.sortBufferSize}
+	defer sorterClose(sorter)
+	var row Row
+	for cursor := tableStart(table); !cursor.endOfTable; cursorAdvance(cursor) {
+		cursorRow(cursor, &row)
+		key := appendKeyValue(nil, &row.values[index.column])
+		key = append(key, tableRowKey(table, &row)...)
+		if len(key) > BTREE_MAX_KEY_SIZE {
+			return EXECUTE_KEY_TOO_LARGE
 		}
+		entry := Value{typ: VALUE_BLOB, strValue: string(key)}
+		sorterAdd(sorter, Row{values: []Value{entry, entry}})
+		pagerEvict(db.pager)
 	}
 
-	*leafNodeNumCells(node) += 1
-	*leafNodeKey(node, cursor.cellNum) = key
-	serializeRow(value, leafNodeValue(node, cursor.cellNum))
+	rootPageNum, catalogKey, ok := catalogCreateTree(db, index.name, statement.sql)
+	if !ok {
+		return EXECUTE_TABLE_FULL
+	}
+	index.tree.rootPageNum = rootPageNum
+	index.catalogKey = catalogKey
+	var prevValue []byte
+	duplicate := false
+	sorterEach(sorter, func(entry *Row) bool {
+		key := []byte(entry.values[0].strValue)
+		var decoded Value
+		value := key[:len(key)-len(decodeKeyValue(key, &decoded))]
+		// NULL 不和任何值相等，唯一索引中可以有多个 NULL
+		if index.unique && value[0] != KEY_TAG_NULL && bytes.Equal(value, prevValue) {
+			duplicate = true
+			return false
+		}
+		prevValue = value
+		leafNodeInsert(btreeFind(index.tree, key), buildCell(db.pager, key, nil))
+		pagerEvict(db.pager)
+		return true
+	})
+	if duplicate {
+		catalogDropTree(db, rootPageNum, catalogKey)
+		statement.errorMessage = fmt.Sprintf("%s.%s", table.name, table.columns[index.column].name)
+		return EXECUTE_UNIQUE_CONSTRAINT
+	}
+	table.indexes = append(table.indexes, index)
+	db.indexes[index.name] = index
+	return EXECUTE_SUCCESS
 }
 
-func executeInsert(statement *Statement, table *Table) ExecuteResult {
-	node := getPage(table.pager, table.rootPageNum)
-	numCells := *leafNodeNumCells(node)
+func executeDropIndex(statement *Statement, db *Database) ExecuteResult {
+	index := statement.index
+	catalogDropTree(db, index.tree.rootPageNum, index.catalogKey)
+	statement.table.indexes = slices.DeleteFunc(statement.table.indexes, func(i *Index) bool { return i == index })
+	delete(db.indexes, index.name)
+	return EXECUTE_SUCCESS
+}
 
-	rowToInsert := &statement.rowToInsert
-	keyToInsert := rowToInsert.id
-	cursor := tableFind(table, keyToInsert)
-	if cursor.cellNum < numCells {
-		keyAtIndex := *leafNodeKey(node, cursor.cellNum)
-		if keyAtIndex == keyToInsert {
-			return EXECUTE_DUPLICATE_KEY
+// 只修改系统表中的建表语句，已有的行在读取时用默认值补齐新加的列
+func executeAlterTable(statement *Statement, db *Database) ExecuteResult {
+	table := statement.table
+	var row Row
+	// 已有的行中新列的值是默认值，需要满足新列的 CHECK 约束
+	if checks := table.checks[len(table.checks)-len(statement.columnDefs[0].checks):]; len(checks) > 0 {
+		for cursor := tableStart(table); !cursor.endOfTable; cursorAdvance(cursor) {
+			cursorRow(cursor, &row)
+			if !checksPass(statement, checks, &row) {
+				return EXECUTE_CHECK_CONSTRAINT
+			}
+			pagerEvict(db.pager)
 		}
 	}
 
-	leafNodeInsert(cursor, rowToInsert.id, rowToInsert)
+	cursor := tableFind(db.catalog, table.catalogKey)
+	cursorRow(cursor, &row)
+	row.values[2].strValue = table.sql
+	leafNodeUpdate(cursor, &row)
+	db.tables[table.name] = table
 
+	header := getPageForWrite(db.pager, HEADER_PAGE_NUM)
+	*headerSchemaCookie(header) += 1
 	return EXECUTE_SUCCESS
 }
 
-func tableStart(table *Table) *Cursor {
-	cursor := tableFind(table, 0)
-	node := getPage(table.pager, cursor.pageNum)
-	numCells := *leafNodeNumCells(node)
-	cursor.endOfTable = numCells == 0
+// 开始事务前先提交之前没有提交的修改，回滚只撤销 begin 之后的修改
+func executeBegin(db *Database) ExecuteResult {
+	if db.pager.inTransaction {
+		return EXECUTE_TRANSACTION_ACTIVE
+	}
+	pagerCommit(db.pager)
+	db.pager.inTransaction = true
+	return EXECUTE_SUCCESS
+}
 
-	return cursor
+func executeCommit(db *Database) ExecuteResult {
+	if !db.pager.inTransaction {
+		return EXECUTE_NO_TRANSACTION
+	}
+	pagerCommit(db.pager)
+	db.pager.inTransaction = false
+	return EXECUTE_SUCCESS
 }
 
-func executeSelect(statement *Statement, table *Table) ExecuteResult {
-	cursor := tableStart(table)
-	var row Row
-	i := 0
-	for cursor.endOfTable == false {
-		deserializeRow(cursorValue(cursor), &row)
-		printRow(&row)
-		cursorAdvance(cursor)
-		i++
+// 事务中可能修改了表结构，回滚之后重新加载
+func executeRollback(db *Database) ExecuteResult {
+	if !db.pager.inTransaction {
+		return EXECUTE_NO_TRANSACTION
 	}
-	fmt.Printf("total_rows: %d\n", i)
+	pagerRollback(db.pager)
+	db.pager.inTransaction = false
+	loadSchema(db)
 	return EXECUTE_SUCCESS
 }
 
-func executeStatement(statement *Statement, table *Table) ExecuteResult {
+func executeStatement(statement *Statement, db *Database) ExecuteResult {
+	table := statement.table
 	switch statement.typ {
 	case STATEMENT_INSERT:
 		return executeInsert(statement, table)
 	case STATEMENT_SELECT:
-		return executeSelect(statement, table)
+		return executeSelect(statement, db)
+	case STATEMENT_DELETE:
+		return executeDelete(statement, table)
+	case STATEMENT_UPDATE:
+		return executeUpdate(statement, table)
+	case STATEMENT_CREATE_TABLE:
+		return executeCreateTable(statement, db)
+	case STATEMENT_DROP_TABLE:
+		return executeDropTable(statement, db)
+	case STATEMENT_ALTER_TABLE:
+		return executeAlterTable(statement, db)
+	case STATEMENT_CREATE_INDEX:
+		return executeCreateIndex(statement, db)
+	case STATEMENT_DROP_INDEX:
+		return executeDropIndex(statement, db)
+	case STATEMENT_BEGIN:
+		return executeBegin(db)
+	case STATEMENT_COMMIT:
+		return executeCommit(db)
+	case STATEMENT_ROLLBACK:
+		return executeRollback(db)
 	default:
 		return EXECUTE_SUCCESS
 	}
@@ -995,20 +6524,21 @@ func main() {
 	}
 
 	filename := os.Args[1]
-	table := dbOpen(filename)
+	db := dbOpen(filename)
 
 	inputBuffer := newInputBuffer()
 	reader := bufio.NewReader(os.Stdin)
 	for {
 		printPrompt()
-		readInput(reader, table, inputBuffer)
+		readInput(reader, db, inputBuffer)
 		if inputBuffer.inputLength == 0 {
 			continue
 		}
 
 		if inputBuffer.buffer[0] == '.' {
-			switch doMetaCommand(inputBuffer, table) {
+			switch doMetaCommand(inputBuffer, db) {
 			case META_COMMAND_SUCCESS:
+				pagerEvict(db.pager)
 				continue
 			case META_COMMAND_UNRECOGNIZED_COMMAND:
 				fmt.Printf("Unrecognized command '%s'\n", inputBuffer.buffer)
@@ -1017,30 +6547,50 @@ func main() {
 		}
 
 		var statement Statement
-		switch prepareStatement(inputBuffer, &statement) {
+		switch prepareStatement(db, inputBuffer, &statement) {
 		case PREPARE_SUCCESS:
 			break
-		case PREPARE_NEGATIVE_ID:
-			fmt.Println("ID must be positive.")
-			continue
 		case PREPARE_STRING_TOO_LONG:
 			fmt.Println("String is too long.")
 			continue
 		case PREPARE_SYNTAX_ERROR:
-			fmt.Println("Syntax error. Could not parse statement.")
+			fmt.Println(statement.errorMessage)
+			continue
+		case PREPARE_INVALID_STATEMENT:
+			fmt.Printf("Error: %s.\n", statement.errorMessage)
 			continue
 		case PREPARE_UNRECOGNIZED_STATEMENT:
 			fmt.Printf("Unrecognized keyword at start of '%s'.\n", inputBuffer.buffer)
 			continue
 		}
 
-		switch executeStatement(&statement, table) {
+		result := executeStatement(&statement, db)
+		// 不在事务中时每条语句自动提交
+		if result == EXECUTE_SUCCESS && !db.pager.inTransaction {
+			pagerCommit(db.pager)
+		}
+		pagerEvict(db.pager)
+		switch result {
 		case EXECUTE_SUCCESS:
 			fmt.Println("Executed.")
 		case EXECUTE_TABLE_FULL:
 			fmt.Println("Error: Table full.")
 		case EXECUTE_DUPLICATE_KEY:
 			fmt.Println("Error: Duplicate key.")
+		case EXECUTE_ROW_NOT_FOUND:
+			fmt.Println("Error: Row not found.")
+		case EXECUTE_NO_TRANSACTION:
+			fmt.Println("Error: No transaction is active.")
+		case EXECUTE_TRANSACTION_ACTIVE:
+			fmt.Println("Error: Transaction already active.")
+		case EXECUTE_UNIQUE_CONSTRAINT:
+			fmt.Printf("Error: UNIQUE constraint failed: %s.\n", statement.errorMessage)
+		case EXECUTE_NOT_NULL_CONSTRAINT:
+			fmt.Printf("Error: NOT NULL constraint failed: %s.\n", statement.errorMessage)
+		case EXECUTE_CHECK_CONSTRAINT:
+			fmt.Printf("Error: CHECK constraint failed: %s.\n", statement.errorMessage)
+		case EXECUTE_KEY_TOO_LARGE:
+			fmt.Println("Error: Key too large.")
 		}
 	}
 }
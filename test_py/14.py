@@ -1,73 +1,28 @@
 import sys,os
-from util import run_script
-
-# 测试7个叶子节点的B+树的结构
-def test_prints_structure_of_7_leaf_node_btree(db_file=""):
-    script = [
-        "insert 58 user58 person58@example.com",
-        "insert 56 user56 person56@example.com",
-        "insert 8 user8 person8@example.com",
-        "insert 54 user54 person54@example.com",
-        "insert 77 user77 person77@example.com",
-        "insert 7 user7 person7@example.com",
-        "insert 25 user25 person25@example.com",
-        "insert 71 user71 person71@example.com",
-        "insert 13 user13 person13@example.com",
-        "insert 22 user22 person22@example.com",
-        "insert 53 user53 person53@example.com",
-        "insert 51 user51 person51@example.com",
-        "insert 59 user59 person59@example.com",
-        "insert 32 user32 person32@example.com",
-        "insert 36 user36 person36@example.com",
-        "insert 79 user79 person79@example.com",
-        "insert 10 user10 person10@example.com",
-        "insert 33 user33 person33@example.com",
-        "insert 20 user20 person20@example.com",
-        "insert 4 user4 person4@example.com",
-        "insert 35 user35 person35@example.com",
-        "insert 76 user76 person76@example.com",
-        "insert 49 user49 person49@example.com",
-        "insert 24 user24 person24@example.com",
-        "insert 70 user70 person70@example.com",
-        "insert 48 user48 person48@example.com",
-        "insert 39 user39 person39@example.com",
-        "insert 15 user15 person15@example.com",
-        "insert 47 user47 person47@example.com",
-        "insert 30 user30 person30@example.com",
-        "insert 86 user86 person86@example.com",
-        "insert 31 user31 person31@example.com",
-        "insert 68 user68 person68@example.com",
-        "insert 37 user37 person37@example.com",
-        "insert 66 user66 person66@example.com",
-        "insert 63 user63 person63@example.com",
-        "insert 40 user40 person40@example.com",
-        "insert 78 user78 person78@example.com",
-        "insert 19 user19 person19@example.com",
-        "insert 46 user46 person46@example.com",
-        "insert 14 user14 person14@example.com",
-        "insert 81 user81 person81@example.com",
-        "insert 72 user72 person72@example.com",
-        "insert 6 user6 person6@example.com",
-        "insert 50 user50 person50@example.com",
-        "insert 85 user85 person85@example.com",
-        "insert 67 user67 person67@example.com",
-        "insert 2 user2 person2@example.com",
-        "insert 55 user55 person55@example.com",
-        "insert 69 user69 person69@example.com",
-        "insert 5 user5 person5@example.com",
-        "insert 65 user65 person65@example.com",
-        "insert 52 user52 person52@example.com",
-        "insert 1 user1 person1@example.com",
-        "insert 29 user29 person29@example.com",
-        "insert 9 user9 person9@example.com",
-        "insert 43 user43 person43@example.com",
-        "insert 75 user75 person75@example.com",
-        "insert 21 user21 person21@example.com",
-        "insert 82 user82 person82@example.com",
-        "insert 12 user12 person12@example.com",
-        "insert 18 user18 person18@example.com",
-        "insert 60 user60 person60@example.com",
-        "insert 44 user44 person44@example.com",
+from util import run_script, run_script_and_kill
+
+USERS_TABLE = "create table users (id integer primary key, username varchar(32), email varchar(255))"
+
+# 插入一行 email 较长的记录，使每个叶子节点只能放下十几行
+def wide_insert(i):
+    return f"insert into users values ({i}, 'user{i}', 'person{i}@example.com{'.' * 235}')"
+
+# 执行一条查询，返回结果中的行和 .stats 报告的读取页数
+def pages_read(query, db_file):
+    result = run_script([query, ".stats", ".exit"],db_file=db_file)
+    rows = [line.removeprefix("db > ") for line in result if line.removeprefix("db > ").startswith("(")]
+    return rows, int([line for line in result if "pages_read" in line][0].split(": ")[-1])
+
+# 测试6个叶子节点的B+树的结构
+def test_prints_structure_of_6_leaf_node_btree(db_file=""):
+    keys = [
+        58, 56, 8, 54, 77, 7, 25, 71, 13, 22, 53, 51, 59, 32, 36, 79,
+        10, 33, 20, 4, 35, 76, 49, 24, 70, 48, 39, 15, 47, 30, 86, 31,
+        68, 37, 66, 63, 40, 78, 19, 46, 14, 81, 72, 6, 50, 85, 67, 2,
+        55, 69, 5, 65, 52, 1, 29, 9, 43, 75, 21, 82, 12, 18, 60, 44,
+    ]
+    script = [USERS_TABLE] + [wide_insert(i) for i in keys]
+    script += [
         ".btree",
         ".exit",
     ]
@@ -77,7 +32,7 @@ def test_prints_structure_of_7_leaf_node_btree(db_file=""):
         "db > Tree:",
         "- internal (size 1)",
         "  - internal (size 2)",
-        "    - leaf (size 7)",
+        "    - leaf (size 9)",
         "      - 1",
         "      - 2",
         "      - 4",
@@ -85,10 +40,10 @@ def test_prints_structure_of_7_leaf_node_btree(db_file=""):
         "      - 6",
         "      - 7",
         "      - 8",
-        "    - key 8",
-        "    - leaf (size 11)",
         "      - 9",
         "      - 10",
+        "    - key 10",
+        "    - leaf (size 10)",
         "      - 12",
         "      - 13",
         "      - 14",
@@ -98,9 +53,9 @@ def test_prints_structure_of_7_leaf_node_btree(db_file=""):
         "      - 20",
         "      - 21",
         "      - 22",
-        "    - key 22",
-        "    - leaf (size 8)",
         "      - 24",
+        "    - key 24",
+        "    - leaf (size 9)",
         "      - 25",
         "      - 29",
         "      - 30",
@@ -108,11 +63,11 @@ def test_prints_structure_of_7_leaf_node_btree(db_file=""):
         "      - 32",
         "      - 33",
         "      - 35",
-        "  - key 35",
-        "  - internal (size 3)",
-        "    - leaf (size 12)",
         "      - 36",
         "      - 37",
+        "  - key 37",
+        "  - internal (size 2)",
+        "    - leaf (size 10)",
         "      - 39",
         "      - 40",
         "      - 43",
@@ -124,7 +79,7 @@ def test_prints_structure_of_7_leaf_node_btree(db_file=""):
         "      - 50",
         "      - 51",
         "    - key 51",
-        "    - leaf (size 11)",
+        "    - leaf (size 13)",
         "      - 52",
         "      - 53",
         "      - 54",
@@ -136,17 +91,15 @@ def test_prints_structure_of_7_leaf_node_btree(db_file=""):
         "      - 63",
         "      - 65",
         "      - 66",
-        "    - key 66",
-        "    - leaf (size 7)",
         "      - 67",
         "      - 68",
+        "    - key 68",
+        "    - leaf (size 13)",
         "      - 69",
         "      - 70",
         "      - 71",
         "      - 72",
         "      - 75",
-        "    - key 75",
-        "    - leaf (size 8)",
         "      - 76",
         "      - 77",
         "      - 78",
@@ -159,11 +112,1380 @@ def test_prints_structure_of_7_leaf_node_btree(db_file=""):
     ]
 
     #print(f"result: {result}")
-    print(f"result[64:]: {result[64:]}")
-    assert result[64:] == expected_output
+    print(f"result[65:]: {result[65:]}")
+    assert result[65:] == expected_output
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+# 测试删除后叶子节点的重新分配、合并以及根节点的收缩
+def test_deletes_rows_and_rebalances_btree(db_file=""):
+    script = [USERS_TABLE]
+    script += [wide_insert(i) for i in range(1, 22)]
+    script += [f"delete from users where id = {i}" for i in [1, 2, 3, 4, 5]]
+    script.append(".btree")
+    script += [f"delete from users where id = {i}" for i in range(14, 22)]
+    script += [".btree", "select * from users", ".exit"]
+    result = run_script(script,db_file=db_file,is_remove=True)
+
+    expected_output = [
+        "db > Tree:",
+        "- internal (size 1)",
+        "  - leaf (size 9)",
+    ]
+    expected_output += [f"    - {i}" for i in range(6, 15)]
+    expected_output += [
+        "  - key 14",
+        "  - leaf (size 7)",
+    ]
+    expected_output += [f"    - {i}" for i in range(15, 22)]
+    expected_output += ["db > Executed."] * 8
+    expected_output += [
+        "db > Tree:",
+        "- leaf (size 8)",
+    ]
+    expected_output += [f"  - {i}" for i in range(6, 14)]
+    expected_output += [f"({i}, user{i}, person{i}@example.com{'.' * 235})" for i in range(6, 14)]
+    expected_output[-8] = "db > " + expected_output[-8]
+    expected_output += [
+        "total_rows: 8",
+        "Executed.",
+        "db > ",
+    ]
+
+    #print(f"result: {result}")
+    print(f"result[27:]: {result[27:]}")
+    assert result[27:] == expected_output
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+
+# 测试按主键原地更新行
+def test_updates_row_in_place(db_file=""):
+    script = [
+        USERS_TABLE,
+        "insert into users values (1, 'user1', 'person1@example.com')",
+        "insert into users values (2, 'user2', 'person2@example.com')",
+        "update users set email = 'new2@example.com' where id = 2",
+        "update users set username = 'admin', email = 'admin@example.com' where id = 1",
+        "update users set email = 'person3@example.com' where id = 3",
+        "delete from users where id = 3",
+        "update users set username = '" + "a" * 33 + "' where id = 1",
+        "select * from users",
+        ".exit",
+    ]
+    result = run_script(script,db_file=db_file,is_remove=True)
+
+    expected_output = [
+        "db > Executed.",
+        "db > Executed.",
+        "db > Executed.",
+        "db > Executed.",
+        "db > Executed.",
+        "db > Error: Row not found.",
+        "db > Error: Row not found.",
+        "db > String is too long.",
+        "db > (1, admin, admin@example.com)",
+        "(2, user2, new2@example.com)",
+        "total_rows: 2",
+        "Executed.",
+        "db > ",
+    ]
+
+    print(f"result: {result}")
+    assert result == expected_output
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+
+# 测试删除释放的页会被复用，.vacuum 会截断文件
+def test_reuses_free_pages_and_vacuum_truncates_file(db_file=""):
+    script = [USERS_TABLE]
+    script += [f"insert into users values ({i}, 'user{i}', 'person{i}@example.com')" for i in range(1, 101)]
+    script += [f"delete from users where id = {i}" for i in range(1, 91)]
+    script.append(".exit")
+    run_script(script,db_file=db_file,is_remove=True)
+    size_after_delete = os.path.getsize(db_file)
+
+    script = [f"insert into users values ({i}, 'user{i}', 'person{i}@example.com')" for i in range(101, 161)]
+    script.append(".exit")
+    run_script(script,db_file=db_file)
+    size_after_reinsert = os.path.getsize(db_file)
+    print(f"size after delete: {size_after_delete}, after reinsert: {size_after_reinsert}")
+    assert size_after_reinsert == size_after_delete
+
+    script = [".vacuum", "select * from users", ".exit"]
+    result = run_script(script,db_file=db_file)
+    size_after_vacuum = os.path.getsize(db_file)
+    print(f"size after vacuum: {size_after_vacuum}")
+    assert size_after_vacuum < size_after_reinsert
+    assert result[-3:] == ["total_rows: 70", "Executed.", "db > "]
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+
+# 测试拒绝打开不是数据库的文件
+def test_rejects_file_that_is_not_a_database(db_file=""):
+    if os.path.exists(db_file):
+        os.remove(db_file)
+    with open(db_file, "wb") as f:
+        f.write(b"not a database\n" * 4096)
+
+    result = run_script([".exit"],db_file=db_file)
+    print(f"result: {result}")
+    assert result == ["Error: file is not a database."]
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+
+# 测试表的大小不再受 TABLE_MAX_PAGES 限制，页缓存保持在 cache_size 以内
+def test_grows_past_old_page_limit_with_small_cache(db_file=""):
+    script = [".cache_size 10", ".cache_size", USERS_TABLE]
+    script += [f"insert into users values ({i}, 'user{i}', 'person{i}@example.com')" for i in range(3000, 0, -1)]
+    script.append(".exit")
+    result = run_script(script,db_file=db_file,is_remove=True)
+    assert result[0] == "db > db > cache_size: 10"
+    assert result[-2:] == ["db > Executed.", "db > "]
+
+    script = [".cache_size 10", "select * from users", ".exit"]
+    result = run_script(script,db_file=db_file)
+    print(f"result[-3:]: {result[-3:]}")
+    assert result[0] == "db > db > (1, user1, person1@example.com)"
+    assert result[-3:] == ["total_rows: 3000", "Executed.", "db > "]
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+
+# 测试缓存很小时一条插入多行的语句执行期间也会淘汰页，同一页被淘汰之后又被修改，写入的次数比页数多
+def test_evicts_pages_during_multi_row_insert(db_file=""):
+    values = ", ".join(f"({i}, 'user{i}', 'person{i}@example.com')" for i in range(300, 0, -1))
+    script = [".cache_size 3", USERS_TABLE, f"insert into users values {values}", ".stats", "select * from users where id = 150", ".exit"]
+    result = run_script(script,db_file=db_file,is_remove=True)
+    print(f"result: {result}")
+    stats = {line.split(": ")[0].split("> ")[-1]: int(line.split(": ")[1]) for line in result[2:7]}
+    assert result[:2] == ["db > db > Executed.", "db > Executed."]
+    assert stats["cached_pages"] == 3
+    assert stats["pages_written"] > stats["pages"]
+    assert result[7:] == [
+        "db > (150, user150, person150@example.com)",
+        "total_rows: 1",
+        "Executed.",
+        "db > ",
+    ]
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+
+# 测试只读的语句不会产生写入，提交时只写回脏页
+def test_flushes_only_dirty_pages(db_file=""):
+    script = [USERS_TABLE]
+    script += [f"insert into users values ({i}, 'user{i}', 'person{i}@example.com')" for i in range(1, 101)]
+    script.append(".exit")
+    run_script(script,db_file=db_file,is_remove=True)
+
+    script = ["select * from users", ".stats", "begin", "insert into users values (101, 'user101', 'person101@example.com')", ".stats", "commit", ".stats", ".exit"]
+    result = run_script(script,db_file=db_file)
+    stats = [line.split(": ")[-1] for line in result if "dirty_pages" in line or "pages_written" in line]
+    print(f"stats: {stats}")
+    assert stats == ["0", "0", "1", "0", "0", "1"]
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+
+# 测试进程崩溃后，下次打开数据库时用回滚日志恢复到上次提交的状态
+def test_rolls_back_hot_journal_after_crash(db_file=""):
+    script = [USERS_TABLE]
+    script += [f"insert into users values ({i}, 'user{i}', 'person{i}@example.com')" for i in range(1, 51)]
+    script.append(".exit")
+    run_script(script,db_file=db_file,is_remove=True)
+
+    # 缓存很小，没有提交的修改会在淘汰时写入数据库文件
+    script = [".cache_size 2", "begin"]
+    script += [f"insert into users values ({i}, 'user{i}', 'person{i}@example.com')" for i in range(51, 201)]
+    script.append(".stats")
+    result = run_script_and_kill(script,"pages_written",db_file=db_file)
+    pages_written = int(result[-1].split(": ")[-1])
+    print(f"pages written before crash: {pages_written}")
+    assert pages_written > 0
+    assert os.path.exists(db_file + "-journal")
+
+    result = run_script(["select * from users", ".exit"],db_file=db_file)
+    print(f"result[-3:]: {result[-3:]}")
+    assert result[0] == "db > (1, user1, person1@example.com)"
+    assert result[-3:] == ["total_rows: 50", "Executed.", "db > "]
+    assert not os.path.exists(db_file + "-journal")
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+
+# 测试 WAL 模式下进程崩溃后，下次打开数据库时只使用 WAL 中已提交的帧，数据库文件不受影响
+def test_recovers_committed_frames_from_wal_after_crash(db_file=""):
+    if os.path.exists(db_file):
+        os.remove(db_file)
+    script = [".journal_mode wal", USERS_TABLE]
+    script += [f"insert into users values ({i}, 'user{i}', 'person{i}@example.com')" for i in range(1, 51)]
+    # 没有提交的修改在淘汰时写入 WAL，不会写入数据库文件
+    script += [".cache_size 2", "begin"]
+    script += [f"insert into users values ({i}, 'user{i}', 'person{i}@example.com')" for i in range(51, 201)]
+    script.append(".stats")
+    run_script_and_kill(script,"pages_written",db_file=db_file)
+    assert os.path.exists(db_file + "-wal")
+    assert not os.path.exists(db_file + "-journal")
+
+    result = run_script([".journal_mode", "select * from users", ".exit"],db_file=db_file)
+    print(f"result[-3:]: {result[-3:]}")
+    assert result[0] == "db > journal_mode: wal"
+    assert result[1] == "db > (1, user1, person1@example.com)"
+    assert result[-3:] == ["total_rows: 50", "Executed.", "db > "]
+    # 正常退出时执行检查点并删除 WAL
+    assert not os.path.exists(db_file + "-wal")
+
+    result = run_script([".journal_mode delete", "select * from users", ".exit"],db_file=db_file)
+    assert result[0] == "db > journal_mode: delete"
+    assert result[-3:] == ["total_rows: 50", "Executed.", "db > "]
+    assert not os.path.exists(db_file + "-wal")
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+
+# 测试事务中的修改在回滚时全部撤销，提交之后才保存，没有提交的事务在重新打开之后不存在
+def test_rolls_back_and_commits_transactions(db_file=""):
+    script = [USERS_TABLE]
+    script += [f"insert into users values ({i}, 'user{i}', 'person{i}@example.com')" for i in range(1, 21)]
+    script.append(".exit")
+    run_script(script,db_file=db_file,is_remove=True)
+
+    # 缓存很小，事务中的修改会在淘汰时写入文件，回滚时要恢复原来的内容
+    script = [".cache_size 2", "begin"]
+    script += [f"insert into users values ({i}, 'user{i}', 'person{i}@example.com')" for i in range(21, 101)]
+    script += [f"delete from users where id = {i}" for i in range(1, 11)]
+    script += ["update users set username = 'changed' where id = 15", "begin", ".vacuum", "rollback", "rollback", "select * from users", ".exit"]
+    result = run_script(script,db_file=db_file)
+    print(f"result[-12:]: {result[-12:]}")
+    assert "db > Error: Transaction already active." in result
+    assert "db > Error: cannot run '.vacuum' inside a transaction." in result
+    # 第一次 rollback 成功，第二次已经没有事务，之后 select 的第一行是回滚之前删除的行
+    i = result.index("db > Error: No transaction is active.")
+    assert result[i - 1] == "db > Executed."
+    assert result[i + 1] == "db > (1, user1, person1@example.com)"
+    assert "(15, user15, person15@example.com)" in result
+    assert result[-3:] == ["total_rows: 20", "Executed.", "db > "]
+
+    for journal_mode in ["delete", "wal"]:
+        script = [f".journal_mode {journal_mode}", "begin", "delete from users where id = 1", "insert into users values (101, 'user101', 'person101@example.com')", "commit"]
+        script += ["begin", "delete from users where id = 2", ".exit"]
+        run_script(script,db_file=db_file)
+        result = run_script(["select * from users", ".exit"],db_file=db_file)
+        assert result[0] == "db > (2, user2, person2@example.com)"
+        assert result[-4:] == ["(101, user101, person101@example.com)", "total_rows: 20", "Executed.", "db > "]
+        run_script(["insert into users values (1, 'user1', 'person1@example.com')", "delete from users where id = 101", ".exit"],db_file=db_file)
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+
+# 测试不在事务中的语句执行完就提交，进程被杀掉也不会丢失
+def test_autocommits_each_statement(db_file=""):
+    if os.path.exists(db_file):
+        os.remove(db_file)
+    for synchronous in ["full", "normal", "off"]:
+        script = [f".synchronous {synchronous}", ".synchronous", USERS_TABLE]
+        script += [f"insert into users values ({i}, 'user{i}', 'person{i}@example.com')" for i in range(1, 31)]
+        script += ["delete from users where id = 7", "update users set username = 'changed' where id = 8", "insert into users values (8, 'a', 'b')", ".stats"]
+        result = run_script_and_kill(script,"pages_written",db_file=db_file)
+        assert result[0] == f"db > synchronous: {synchronous}"
+        assert result[1] == f"db > synchronous: {synchronous}"
+        assert not os.path.exists(db_file + "-journal")
+
+        result = run_script(["select * from users", ".exit"],db_file=db_file,is_remove=False)
+        assert "(8, changed, person8@example.com)" in result
+        assert "(7, user7, person7@example.com)" not in result
+        assert result[-3:] == ["total_rows: 29", "Executed.", "db > "]
+        os.remove(db_file)
+
+    result = run_script([".synchronous extra", ".exit"],db_file=db_file)
+    assert result[0] == "db > Synchronous must be off, normal or full."
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+
+# 测试 SQL 语句的解析，以及指出出错位置的错误信息
+def test_parses_sql_statements(db_file=""):
+    script = [
+        USERS_TABLE,
+        "INSERT INTO users VALUES (1, 'o''brien', 'a, b (c)@example.com'), (2, 'user2', 'person2@example.com');",
+        "insert into users (email, id, username) values ('person3@example.com', 3, 'user3')",
+        "SELECT * FROM users WHERE id = 1",
+        "update users set email = 'new3@example.com' where 3 = id",
+        "select * from users",
+        "insert into users values (4, 'user4', 'person4@example.com'), (1, 'dup', 'dup')",
+        "insert into users valus (4, 'user4', 'person4@example.com')",
+        "insert into users values (4, 'user4'",
+        "select * from users where id = 'abc",
+        "select * from users where id = 1 limt",
+        "select * from users where id = #",
+        "select * from accounts",
+        "insert into users values (4, 'user4')",
+        "insert into users values (-4, 'user4', 'person4@example.com')",
+        "delete from users where username = 'user2'",
+        "explain select * from users",
+        ".exit",
+    ]
+    result = run_script(script,db_file=db_file,is_remove=True)
+
+    expected_output = [
+        "db > Executed.",
+        "db > Executed.",
+        "db > Executed.",
+        "db > (1, o'brien, a, b (c)@example.com)",
+        "total_rows: 1",
+        "Executed.",
+        "db > Executed.",
+        "db > (1, o'brien, a, b (c)@example.com)",
+        "(2, user2, person2@example.com)",
+        "(3, user3, new3@example.com)",
+        "total_rows: 3",
+        "Executed.",
+        "db > Error: Duplicate key.",
+        "db > Syntax error at position 19: near 'valus', expected VALUES.",
+        "db > Syntax error at position 37: unexpected end of input, expected ')'.",
+        "db > Syntax error at position 32: unterminated string.",
+        "db > Syntax error at position 34: near 'limt', expected end of statement.",
+        "db > Syntax error at position 32: unrecognized token '#'.",
+        "db > Error: no such table: accounts.",
+        "db > Error: 2 values for 3 columns.",
+        "db > Executed.",
+        "db > Executed.",
+        "db > Unrecognized keyword at start of 'explain select * from users'.",
+        "db > ",
+    ]
+
+    print(f"result: {result}")
+    assert result == expected_output
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+
+# 测试 CREATE TABLE 把表记录在系统表 baby_master 中，重新打开之后从系统表加载表结构
+def test_creates_tables_in_schema_catalog(db_file=""):
+    script = [
+        USERS_TABLE,
+        "create table notes (body text, author varchar(16))",
+        "create table users (id integer)",
+        "create table bad (a integer, a text)",
+        "create table bad (a text primary key, b text primary key)",
+        "insert into notes values ('hello', 'alice'), ('world', 'bob')",
+        "insert into users (username, email) values ('user1', 'person1@example.com')",
+        "insert into users values (10, 'user10', 'person10@example.com')",
+        "insert into users (username, email) values ('user11', 'person11@example.com')",
+        "select * from notes where rowid = 2",
+        "insert into baby_master values ('x', 1, 'y')",
+        "begin",
+        "create table tmp (a integer)",
+        "rollback",
+        ".tables",
+        ".exit",
+    ]
+    result = run_script(script,db_file=db_file,is_remove=True)
+
+    expected_output = [
+        "db > Executed.",
+        "db > Executed.",
+        "db > Error: table users already exists.",
+        "db > Error: duplicate column name: a.",
+        "db > Error: table bad has more than one primary key.",
+        "db > Executed.",
+        "db > Executed.",
+        "db > Executed.",
+        "db > Executed.",
+        "db > (world, bob)",
+        "total_rows: 1",
+        "Executed.",
+        "db > Error: table baby_master may not be modified.",
+        "db > Executed.",
+        "db > Executed.",
+        "db > Executed.",
+        "db > users",
+        "notes",
+        "db > ",
+    ]
+    print(f"result: {result}")
+    assert result == expected_output
+
+    # 重新打开后 schema 从 catalog 中加载
+    script = [
+        "select * from users",
+        ".schema",
+        "select * from tmp",
+        ".exit",
+    ]
+    result = run_script(script,db_file=db_file)
+
+    expected_output = [
+        "db > (1, user1, person1@example.com)",
+        "(10, user10, person10@example.com)",
+        "(11, user11, person11@example.com)",
+        "total_rows: 3",
+        "Executed.",
+        "db > " + USERS_TABLE + ";",
+        "create table notes (body text, author varchar(16));",
+        "db > Error: no such table: tmp.",
+        "db > ",
+    ]
+    print(f"result: {result}")
+    assert result == expected_output
+
+    # vacuum 搬动表的根页时要同步更新 catalog 中的 rootpage
+    script = ["create table big (id integer primary key, name varchar(255))"]
+    script += [f"insert into big values ({i}, 'name{i}')" for i in range(1, 41)]
+    script += ["create table small (v text)", "insert into small values ('kept')"]
+    script += [f"delete from big where id = {i}" for i in range(1, 41)]
+    script += [".vacuum", ".exit"]
+    run_script(script,db_file=db_file,is_remove=True)
+
+    script = [
+        "select * from baby_master",
+        "select * from small",
+        ".exit",
+    ]
+    result = run_script(script,db_file=db_file)
+
+    expected_output = [
+        "db > (big, 2, create table big (id integer primary key, name varchar(255)))",
+        "(small, 3, create table small (v text))",
+        "total_rows: 2",
+        "Executed.",
+        "db > (kept)",
+        "total_rows: 1",
+        "Executed.",
+        "db > ",
+    ]
+    print(f"result: {result}")
+    assert result == expected_output
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+
+# 测试 DROP TABLE 释放表的所有页，ALTER TABLE ADD COLUMN 之后已有的行用默认值补齐新加的列
+def test_drops_tables_and_adds_columns(db_file=""):
+    script = [USERS_TABLE]
+    script += [f"insert into users values ({i}, 'user{i}', 'person{i}@example.com')" for i in range(1, 3)]
+    script += [
+        "alter table users add column age integer default 18",
+        "alter table users add nickname varchar(8)",
+        "alter table users add column age integer",
+        "alter table users add column x integer primary key",
+        "alter table users add column z varchar(2) default 'abc'",
+        "insert into users (username, email) values ('user3', 'person3@example.com')",
+        "update users set age = 20, nickname = 'one' where id = 1",
+        "select * from users",
+        ".exit",
+    ]
+    result = run_script(script,db_file=db_file,is_remove=True)
+
+    expected_output = [
+        "db > Executed.",
+        "db > Executed.",
+        "db > Executed.",
+        "db > Executed.",
+        "db > Executed.",
+        "db > Error: duplicate column name: age.",
+        "db > Error: cannot add a PRIMARY KEY column.",
+        "db > String is too long.",
+        "db > Executed.",
+        "db > Executed.",
+        "db > (1, user1, person1@example.com, 20, one)",
+        "(2, user2, person2@example.com, 18, NULL)",
+        "(3, user3, person3@example.com, 18, NULL)",
+        "total_rows: 3",
+        "Executed.",
+        "db > ",
+    ]
+    print(f"result: {result}")
+    assert result == expected_output
+
+    # 建表语句中记录了新加的列，重新打开之后旧的行仍然可以读取
+    script = [".schema", "select * from users where id = 2", ".exit"]
+    result = run_script(script,db_file=db_file)
+
+    expected_output = [
+        "db > " + USERS_TABLE[:-1] + ", age integer default 18, nickname varchar(8));",
+        "db > (2, user2, person2@example.com, 18, NULL)",
+        "total_rows: 1",
+        "Executed.",
+        "db > ",
+    ]
+    print(f"result: {result}")
+    assert result == expected_output
+
+    # drop table 释放所有的页，vacuum 之后文件只剩文件头、系统表和 users 的根页
+    script = ["create table big (id integer primary key, name varchar(255))"]
+    script += [f"insert into big values ({i}, 'name{i}')" for i in range(1, 201)]
+    script += [
+        "begin",
+        "drop table big",
+        "rollback",
+        "select * from big where id = 150",
+        "drop table big",
+        "drop table big",
+        "drop table baby_master",
+        ".tables",
+        ".vacuum",
+        ".exit",
+    ]
+    result = run_script(script,db_file=db_file)
+
+    expected_output = [
+        "db > Executed.",
+        "db > Executed.",
+        "db > Executed.",
+        "db > (150, name150)",
+        "total_rows: 1",
+        "Executed.",
+        "db > Executed.",
+        "db > Error: no such table: big.",
+        "db > Error: table baby_master may not be modified.",
+        "db > users",
+        "db > db > ",
+    ]
+    print(f"result: {result[-11:]}")
+    assert result[-11:] == expected_output
+    print(f"file size: {os.path.getsize(db_file)}")
+    assert os.path.getsize(db_file) == 3 * 4096
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+
+# 测试记录中每一列带类型标记，插入和更新时值的类型必须和列的类型一致
+def test_stores_typed_values(db_file=""):
+    script = [
+        "create table t (id integer primary key, i integer, r real, s text, b blob, ok boolean)",
+        "insert into t values (1, -5, 2.5, 'hi', x'0aff', true), (null, 1, 3, 'x', X'', false)",
+        "insert into t (s) values ('only')",
+        "insert into t values (10, null, -1e3, null, null, null)",
+        "insert into t values (null, 1.5, 1, 's', x'00', true)",
+        "insert into t values (null, 1, 1, 's', 'blob', true)",
+        "insert into t values (null, 1, 1, 's', x'00', 1)",
+        "insert into t values (null, 1, 1, 's', x'0', true)",
+        "update t set r = 0.1, ok = false where id = 1",
+        ".exit",
+    ]
+    result = run_script(script,db_file=db_file,is_remove=True)
+
+    expected_output = [
+        "db > Executed.",
+        "db > Executed.",
+        "db > Executed.",
+        "db > Executed.",
+        "db > Error: i must be an integer.",
+        "db > Error: b must be a blob.",
+        "db > Error: ok must be a boolean.",
+        "db > Syntax error at position 40: malformed blob literal.",
+        "db > Executed.",
+        "db > ",
+    ]
+    print(f"result: {result}")
+    assert result == expected_output
+
+    # 重新打开之后按照记录中的类型标记读取每一列
+    script = [
+        "select * from t",
+        "create table d (a real default 1.5, b boolean default true, c blob default x'ab')",
+        "insert into d (a) values (2)",
+        "select * from d",
+        ".exit",
+    ]
+    result = run_script(script,db_file=db_file)
+
+    expected_output = [
+        "db > (1, -5, 0.1, hi, X'0AFF', false)",
+        "(2, 1, 3.0, x, X'', false)",
+        "(3, NULL, NULL, only, NULL, NULL)",
+        "(10, NULL, -1000.0, NULL, NULL, NULL)",
+        "total_rows: 4",
+        "Executed.",
+        "db > Executed.",
+        "db > Executed.",
+        "db > (2.0, true, X'AB')",
+        "total_rows: 1",
+        "Executed.",
+        "db > ",
+    ]
+    print(f"result: {result}")
+    assert result == expected_output
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+
+# 测试超过一页的记录存放在溢出页中，删除和 .vacuum 会回收溢出页
+def test_stores_large_values_in_overflow_pages(db_file=""):
+    big = "".join(chr(ord("a") + i % 26) for i in range(10000))
+    blob = bytes(i % 256 for i in range(3000)).hex().upper()
+    script = [
+        "create table t (id integer primary key, s text, b blob)",
+        f"insert into t values (1, '{big}', x'{blob}')",
+        "insert into t values (2, 'small', x'00')",
+        f"insert into t values (3, '{big[:5000]}', null)",
+        ".exit",
+    ]
+    run_script(script,db_file=db_file,is_remove=True)
+    print(f"file size: {os.path.getsize(db_file)}")
+    assert os.path.getsize(db_file) > 6 * 4096
+
+    script = [
+        "select * from t",
+        "update t set s = 'short', b = null where id = 1",
+        f"update t set s = '{big}' where id = 2",
+        "select * from t",
+        ".exit",
+    ]
+    result = run_script(script,db_file=db_file)
+
+    expected_output = [
+        f"db > (1, {big}, X'{blob}')",
+        "(2, small, X'00')",
+        f"(3, {big[:5000]}, NULL)",
+        "total_rows: 3",
+        "Executed.",
+        "db > Executed.",
+        "db > Executed.",
+        "db > (1, short, NULL)",
+        f"(2, {big}, X'00')",
+        f"(3, {big[:5000]}, NULL)",
+        "total_rows: 3",
+        "Executed.",
+        "db > ",
+    ]
+    assert result == expected_output
+
+    # 删除之后溢出页进入空闲链表，.vacuum 之后只剩文件头、目录表和 t 的根节点
+    script = [f"delete from t where id = {i}" for i in [1, 2, 3]]
+    script += [".vacuum", "select * from t", ".exit"]
+    result = run_script(script,db_file=db_file)
+    print(f"result: {result}")
+    assert result[-3:] == ["db > db > total_rows: 0", "Executed.", "db > "]
+    print(f"file size: {os.path.getsize(db_file)}")
+    assert os.path.getsize(db_file) == 3 * 4096
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+
+# 测试删除单元格留下的空闲块会被之后插入的单元格复用，页内空间不连续时整理页面，不需要分裂
+def test_reuses_free_space_inside_leaf(db_file=""):
+    script = [USERS_TABLE]
+    script += [wide_insert(i) for i in range(1, 15)]
+    script.append(".btree")
+    script += [f"delete from users where id = {i}" for i in [2, 4, 6, 8, 10]]
+    script += [f"insert into users values ({i}, 'user{i}', 'person{i}@example.com')" for i in range(21, 37)]
+    script += [wide_insert(2), wide_insert(4), ".btree", "select * from users", ".exit"]
+    result = run_script(script,db_file=db_file,is_remove=True)
+
+    keys = [1, 2, 3, 4, 5, 7, 9, 11, 12, 13, 14] + list(range(21, 37))
+    expected_output = ["db > Tree:", "- leaf (size 14)"]
+    expected_output += [f"  - {i}" for i in range(1, 15)]
+    expected_output += ["db > Executed."] * 23
+    expected_output += ["db > Tree:", "- leaf (size 27)"]
+    expected_output += [f"  - {i}" for i in keys]
+    print(f"result[15:]: {result[15:]}")
+    assert result[15:-30] == expected_output
+    assert result[-3:] == ["total_rows: 27", "Executed.", "db > "]
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+
+# 测试 WHERE 中的比较、布尔运算、IS NULL、LIKE、IN 和 BETWEEN，NULL 按照三值逻辑计算
+def test_filters_rows_with_where(db_file=""):
+    script = [
+        "create table t (id integer primary key, name text, score real, ok boolean)",
+        "insert into t values (1, 'alice', 3.5, true), (2, 'Bob', null, false), (3, 'carol', 7, null), (4, null, 1, true)",
+        "select * from t where score > 2",
+        "select * from t where score >= 3.5 and ok",
+        "select * from t where not ok or ok is null",
+        "select * from t where name like 'b%' or name like '_aro_'",
+        "select * from t where id in (1, 3, 5)",
+        "select * from t where id not in (1, null)",
+        "select * from t where id not between 2 and 3",
+        "select * from t where score is not null and score * 2 > 7",
+        "select * from t where name = 1",
+        "select * from t where name",
+        "select * from t where nosuch = 1",
+        "select * from t where name not 'x'",
+        ".exit",
+    ]
+    result = run_script(script,db_file=db_file,is_remove=True)
+
+    expected_output = [
+        "db > Executed.",
+        "db > Executed.",
+        "db > (1, alice, 3.5, true)",
+        "(3, carol, 7.0, NULL)",
+        "total_rows: 2",
+        "Executed.",
+        "db > (1, alice, 3.5, true)",
+        "total_rows: 1",
+        "Executed.",
+        "db > (2, Bob, NULL, false)",
+        "(3, carol, 7.0, NULL)",
+        "total_rows: 2",
+        "Executed.",
+        "db > (2, Bob, NULL, false)",
+        "(3, carol, 7.0, NULL)",
+        "total_rows: 2",
+        "Executed.",
+        "db > (1, alice, 3.5, true)",
+        "(3, carol, 7.0, NULL)",
+        "total_rows: 2",
+        "Executed.",
+        "db > total_rows: 0",
+        "Executed.",
+        "db > (1, alice, 3.5, true)",
+        "(4, NULL, 1.0, true)",
+        "total_rows: 2",
+        "Executed.",
+        "db > (3, carol, 7.0, NULL)",
+        "total_rows: 1",
+        "Executed.",
+        "db > Error: cannot compare a string with an integer.",
+        "db > Error: WHERE clause must be a boolean expression.",
+        "db > Error: no such column: nosuch.",
+        "db > Syntax error at position 32: near 'x', expected LIKE, IN or BETWEEN.",
+        "db > ",
+    ]
+    print(f"result: {result}")
+    assert result == expected_output
     print(f"{sys._getframe().f_code.co_name} passed")
 
 
+# 测试 WHERE 中主键的条件直接在 B 树中定位，只读取范围内的叶子节点，其他条件扫描整张表
+def test_scans_only_key_range(db_file=""):
+    script = [USERS_TABLE]
+    script += [f"insert into users values ({i}, 'user{i}', 'person{i}@example.com')" for i in range(1, 3001)]
+    script.append(".exit")
+    run_script(script,db_file=db_file,is_remove=True)
+
+    rows, point_reads = pages_read("select * from users where 1500 = id and username = 'user1500'", db_file)
+    assert rows == ["(1500, user1500, person1500@example.com)"]
+    rows, range_reads = pages_read("select * from users where id between 100 and 102", db_file)
+    assert rows == [f"({i}, user{i}, person{i}@example.com)" for i in range(100, 103)]
+    rows, tail_reads = pages_read("select * from users where id > 2998", db_file)
+    assert rows == ["(2999, user2999, person2999@example.com)", "(3000, user3000, person3000@example.com)"]
+    rows, empty_reads = pages_read("select * from users where id > 5 and id < 3", db_file)
+    assert rows == []
+    rows, scan_reads = pages_read("select * from users where username = 'user7' or id > 2999", db_file)
+    assert rows == ["(7, user7, person7@example.com)", "(3000, user3000, person3000@example.com)"]
+    print(f"pages read: {point_reads} {range_reads} {tail_reads} {empty_reads} {scan_reads}")
+    assert max(point_reads, range_reads, tail_reads) < 10
+    assert empty_reads < point_reads
+    assert scan_reads > 50
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+
+# 测试 select 只输出指定的列和表达式，以及内置函数
+def test_projects_columns_and_expressions(db_file=""):
+    script = [
+        "create table t (id integer primary key, name text, score real, n integer)",
+        "insert into t values (1, 'alice', 3.5, -4), (2, 'Bob', null, 7), (3, '中文字', 7, null)",
+        "select name, id from t",
+        "select name || '@' || id as addr, score * 2 doubled, n + 1 from t where id < 3",
+        "select length(name), upper(name), lower(name), abs(n), 7 / 2, 7.0 / 2 from t",
+        "select substr(name, 2), substr(name, 2, 2), substr(name, -2), substr(name, 3, -2) from t",
+        "select *, coalesce(score, n, 0) from t where id = 2",
+        "insert into t values (4, 'max', null, 9223372036854775807)",
+        "select n + 1, 1 - -n, n * 2, -n - 1, -n - 2, abs(-n - 1), -(-n - 1), n * -1 from t where id = 4",
+        "select foo(1) from t",
+        "select length(1) from t",
+        "select substr(name) from t",
+        "select coalesce(name, 1) from t",
+        ".exit",
+    ]
+    result = run_script(script,db_file=db_file,is_remove=True)
+
+    expected_output = [
+        "db > Executed.",
+        "db > Executed.",
+        "db > (alice, 1)",
+        "(Bob, 2)",
+        "(中文字, 3)",
+        "total_rows: 3",
+        "Executed.",
+        "db > (alice@1, 7.0, -3)",
+        "(Bob@2, NULL, 8)",
+        "total_rows: 2",
+        "Executed.",
+        "db > (5, ALICE, alice, 4, 3, 3.5)",
+        "(3, BOB, bob, 7, 3, 3.5)",
+        "(3, 中文字, 中文字, NULL, 3, 3.5)",
+        "total_rows: 3",
+        "Executed.",
+        "db > (lice, li, ce, al)",
+        "(ob, ob, ob, Bo)",
+        "(文字, 文字, 文字, 中文)",
+        "total_rows: 3",
+        "Executed.",
+        "db > (2, Bob, NULL, 7, 7.0)",
+        "total_rows: 1",
+        "Executed.",
+        "db > Executed.",
+        "db > (9.223372036854776e+18, 9.223372036854776e+18, 1.8446744073709552e+19, -9223372036854775808, -9.223372036854776e+18, 9.223372036854776e+18, 9.223372036854776e+18, -9223372036854775807)",
+        "total_rows: 1",
+        "Executed.",
+        "db > Error: no such function: foo.",
+        "db > Error: argument 1 of length() must be a string or a blob.",
+        "db > Error: wrong number of arguments to function substr().",
+        "db > Error: argument 2 of coalesce() must be a string.",
+        "db > ",
+    ]
+    print(f"result: {result}")
+    assert result == expected_output
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+
+# 排序的结果超过 sort_buffer_size 时写入临时文件再归并，结果和在内存中排序一样
+def test_orders_and_limits_rows(db_file=""):
+    script = [
+        "create table t (id integer primary key, name text, score integer)",
+        "insert into t values (1, 'b', 30), (2, 'a', 10), (3, 'c', null), (4, 'a', 20), (5, 'd', 10)",
+        "select * from t order by score",
+        "select name, score s from t order by s desc, 1 limit 3 offset 1",
+        "select id from t order by id desc",
+        "select * from t order by id limit 2",
+        "select * from t where id > 1 limit 2 offset 2",
+        ".sort_buffer_size 10",
+        ".sort_buffer_size",
+        "select * from t order by name, score desc",
+        "select * from t order by 4",
+        "select * from t limit -1",
+        "select * from t limit",
+        ".exit",
+    ]
+    result = run_script(script,db_file=db_file,is_remove=True)
+
+    expected_output = [
+        "db > Executed.",
+        "db > Executed.",
+        "db > (3, c, NULL)",
+        "(2, a, 10)",
+        "(5, d, 10)",
+        "(4, a, 20)",
+        "(1, b, 30)",
+        "total_rows: 5",
+        "Executed.",
+        "db > (a, 20)",
+        "(a, 10)",
+        "(d, 10)",
+        "total_rows: 3",
+        "Executed.",
+        "db > (5)",
+        "(4)",
+        "(3)",
+        "(2)",
+        "(1)",
+        "total_rows: 5",
+        "Executed.",
+        "db > (1, b, 30)",
+        "(2, a, 10)",
+        "total_rows: 2",
+        "Executed.",
+        "db > (4, a, 20)",
+        "(5, d, 10)",
+        "total_rows: 2",
+        "Executed.",
+        "db > db > sort_buffer_size: 10",
+        "db > (4, a, 20)",
+        "(2, a, 10)",
+        "(1, b, 30)",
+        "(3, c, NULL)",
+        "(5, d, 10)",
+        "total_rows: 5",
+        "Executed.",
+        "db > Error: ORDER BY term out of range - should be between 1 and 3.",
+        "db > Error: LIMIT must be a non-negative integer.",
+        "db > Syntax error at position 22: unexpected end of input, expected an expression.",
+        "db > ",
+    ]
+    print(f"result: {result}")
+    assert result == expected_output
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+
+# 按主键降序时用 cursorRetreat 从后向前扫描，取最后几行只需要读很少的页
+def test_scans_backward_for_descending_key(db_file=""):
+    script = [USERS_TABLE]
+    script += [f"insert into users values ({i}, 'user{i}', 'person{i}@example.com')" for i in range(1, 3001)]
+    script.append(".exit")
+    run_script(script,db_file=db_file,is_remove=True)
+
+    rows, last_reads = pages_read("select id from users order by id desc limit 3", db_file)
+    assert rows == ["(3000)", "(2999)", "(2998)"]
+    rows, range_reads = pages_read("select id from users where id between 1000 and 2000 order by id desc limit 2 offset 1", db_file)
+    assert rows == ["(1999)", "(1998)"]
+    rows, _ = pages_read("select id from users where id < 3 order by id desc", db_file)
+    assert rows == ["(2)", "(1)"]
+    rows, scan_reads = pages_read("select id from users order by id desc", db_file)
+    assert rows == [f"({i})" for i in range(3000, 0, -1)]
+    print(f"pages read: {last_reads} {range_reads} {scan_reads}")
+    assert max(last_reads, range_reads) < 10
+    assert scan_reads > 50
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+
+# 测试聚合函数和 GROUP BY ... HAVING，主键的 min 和 max 只读最左边和最右边的叶子节点
+def test_aggregates_and_groups_rows(db_file=""):
+    script = [
+        "create table t (id integer primary key, name text, score integer, w real)",
+        "insert into t values (1, 'b', 30, 1.5), (2, 'a', 10, null), (3, 'c', null, 2), (4, 'a', 20, 0.5), (5, 'd', 10, 1)",
+        "select count(*), count(score), sum(score), avg(score), min(name), max(name), sum(w) from t",
+        "select name, count(*) c, sum(score) from t group by name order by c desc, name",
+        "select name, count(*) from t group by name having count(*) > 1",
+        "select count(*), sum(score), avg(score) from t where id > 10",
+        "select min(id), max(id), name from t",
+        "create table big (v integer)",
+        "insert into big values (9223372036854775807), (1)",
+        "select sum(v), avg(v) from big",
+        "select count(*) from t where count(*) > 1",
+        "select sum(name) from t",
+        "select max(count(*)) from t",
+        ".exit",
+    ]
+    result = run_script(script,db_file=db_file,is_remove=True)
+
+    expected_output = [
+        "db > Executed.",
+        "db > Executed.",
+        "db > (5, 4, 70, 17.5, a, d, 5.0)",
+        "total_rows: 1",
+        "Executed.",
+        "db > (a, 2, 30)",
+        "(b, 1, 30)",
+        "(c, 1, NULL)",
+        "(d, 1, 10)",
+        "total_rows: 4",
+        "Executed.",
+        "db > (a, 2)",
+        "total_rows: 1",
+        "Executed.",
+        "db > (0, NULL, NULL)",
+        "total_rows: 1",
+        "Executed.",
+        "db > (1, 5, b)",
+        "total_rows: 1",
+        "Executed.",
+        "db > Executed.",
+        "db > Executed.",
+        "db > (9.223372036854776e+18, 4.611686018427388e+18)",
+        "total_rows: 1",
+        "Executed.",
+        "db > Error: misuse of aggregate function count().",
+        "db > Error: argument 1 of sum() must be a number.",
+        "db > Error: misuse of aggregate function count().",
+        "db > ",
+    ]
+    print(f"result: {result}")
+    assert result == expected_output
+
+    script = [USERS_TABLE]
+    script += [f"insert into users values ({i}, 'user{i}', 'person{i}@example.com')" for i in range(1, 3001)]
+    script.append(".exit")
+    run_script(script,db_file=db_file,is_remove=True)
+
+    rows, min_max_reads = pages_read("select min(id), max(id) from users", db_file)
+    assert rows == ["(1, 3000)"]
+    rows, count_reads = pages_read("select count(*), max(username) from users", db_file)
+    assert rows == ["(3000, user999)"]
+    print(f"pages read: {min_max_reads} {count_reads}")
+    assert min_max_reads < 20
+    assert count_reads > 50
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+
+# 测试 CREATE INDEX 建立的索引：唯一约束、插入更新删除时同步修改索引、WHERE 中索引列的条件使用索引扫描
+def test_creates_and_uses_indexes(db_file=""):
+    script = [
+        USERS_TABLE,
+        "insert into users values (1, 'alice', 'a@x.com'), (2, 'bob', 'b@x.com'), (3, 'carol', null), (4, 'dave', 'a@x.com')",
+        "create unique index users_email on users (email)",
+        "update users set email = 'd@x.com' where id = 4",
+        "create unique index users_email on users (email)",
+        "create index users_name on users (username)",
+        "insert into users values (5, 'eve', 'b@x.com')",
+        "insert into users values (5, 'eve', 'e@x.com'), (6, 'frank', 'e@x.com')",
+        "insert into users values (5, 'eve', 'e@x.com'), (6, 'frank', null)",
+        "update users set email = 'e@x.com' where id = 1",
+        "update users set email = 'z@x.com', username = 'zed' where id = 1",
+        "delete from users where id = 2",
+        ".btree users_email",
+        "select * from users where email = 'z@x.com'",
+        "select * from users where username >= 'd' and username < 'f' order by id desc",
+        "select * from users where email = 'a@x.com'",
+        "create index users_email on users (id)",
+        "create index users on users (id)",
+        "create index i on users (nosuch)",
+        "drop index users_name",
+        "drop index users_name",
+        ".schema",
+        ".exit",
+    ]
+    result = run_script(script,db_file=db_file,is_remove=True)
+
+    expected_output = [
+        "db > Executed.",
+        "db > Executed.",
+        "db > Error: UNIQUE constraint failed: users.email.",
+        "db > Executed.",
+        "db > Executed.",
+        "db > Executed.",
+        "db > Error: UNIQUE constraint failed: users.email.",
+        "db > Error: UNIQUE constraint failed: users.email.",
+        "db > Executed.",
+        "db > Error: UNIQUE constraint failed: users.email.",
+        "db > Executed.",
+        "db > Executed.",
+        "db > Tree:",
+        "- leaf (size 5)",
+        "  - (NULL, 3)",
+        "  - (NULL, 6)",
+        "  - (d@x.com, 4)",
+        "  - (e@x.com, 5)",
+        "  - (z@x.com, 1)",
+        "db > (1, zed, z@x.com)",
+        "total_rows: 1",
+        "Executed.",
+        "db > (5, eve, e@x.com)",
+        "(4, dave, d@x.com)",
+        "total_rows: 2",
+        "Executed.",
+        "db > total_rows: 0",
+        "Executed.",
+        "db > Error: index users_email already exists.",
+        "db > Error: there is already a table named users.",
+        "db > Error: table users has no column named nosuch.",
+        "db > Executed.",
+        "db > Error: no such index: users_name.",
+        "db > create table users (id integer primary key, username varchar(32), email varchar(255));",
+        "create unique index users_email on users (email);",
+        "db > ",
+    ]
+    print(f"result: {result}")
+    assert result == expected_output
+
+    script = [USERS_TABLE, "create index users_name on users (username)"]
+    script += [f"insert into users values ({i}, 'user{i}', 'person{i}@example.com')" for i in range(1, 3001)]
+    script.append(".exit")
+    run_script(script,db_file=db_file,is_remove=True)
+
+    rows, index_reads = pages_read("select id from users where username = 'user2024'", db_file)
+    assert rows == ["(2024)"]
+    rows, range_reads = pages_read("select id from users where username between 'user2990' and 'user2992'", db_file)
+    assert rows == ["(2990)", "(2991)", "(2992)"]
+    rows, scan_reads = pages_read("select id from users where email = 'person2024@example.com'", db_file)
+    assert rows == ["(2024)"]
+    print(f"pages read: {index_reads} {range_reads} {scan_reads}")
+    assert index_reads < 20
+    assert range_reads < 20
+    assert scan_reads > 50
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+
+# 测试建表语句中的 NOT NULL、CHECK、UNIQUE 和 DEFAULT 约束，插入和更新违反约束时报告违反的约束
+def test_enforces_column_constraints(db_file=""):
+    script = [
+        "create table p (id integer primary key, name text not null, email text unique, "
+        "age integer default 18 check (age >= 0) constraint adult check (age >= 18 or name = 'kid'))",
+        "insert into p (email) values ('a@x.com')",
+        "insert into p (name, age) values ('bob', -1)",
+        "insert into p (name, age) values ('bob', 10)",
+        "insert into p (name, age) values ('kid', 10)",
+        "insert into p (name, email) values ('ann', 'a@x.com'), ('cat', 'c@x.com')",
+        "insert into p (name, email) values ('dan', 'd@x.com'), ('eve', 'a@x.com')",
+        "insert into p (name) values ('fay'), ('gus')",
+        "update p set name = null where id = 2",
+        "update p set age = 5 where id = 2",
+        "update p set email = 'a@x.com' where id = 3",
+        "update p set email = 'b@x.com' where id = 1",
+        "select * from p",
+        ".btree baby_autoindex_p_1",
+        "drop index baby_autoindex_p_1",
+        "create index baby_autoindex_p_2 on p (name)",
+        "alter table p add column n integer not null",
+        "alter table p add column n integer default 0 check (n > 0)",
+        "alter table p add column n integer not null default 1 check (n > 0)",
+        "create table c (a integer check (a + 1))",
+        "create table c (a integer check (count(*) > 1))",
+        ".schema",
+        ".exit",
+    ]
+    result = run_script(script,db_file=db_file,is_remove=True)
+
+    expected_output = [
+        "db > Executed.",
+        "db > Error: NOT NULL constraint failed: p.name.",
+        "db > Error: CHECK constraint failed: age >= 0.",
+        "db > Error: CHECK constraint failed: adult.",
+        "db > Executed.",
+        "db > Executed.",
+        "db > Error: UNIQUE constraint failed: p.email.",
+        "db > Executed.",
+        "db > Error: NOT NULL constraint failed: p.name.",
+        "db > Error: CHECK constraint failed: adult.",
+        "db > Error: UNIQUE constraint failed: p.email.",
+        "db > Executed.",
+        "db > (1, kid, b@x.com, 10)",
+        "(2, ann, a@x.com, 18)",
+        "(3, cat, c@x.com, 18)",
+        "(4, fay, NULL, 18)",
+        "(5, gus, NULL, 18)",
+        "total_rows: 5",
+        "Executed.",
+        "db > Tree:",
+        "- leaf (size 5)",
+        "  - (NULL, 4)",
+        "  - (NULL, 5)",
+        "  - (a@x.com, 2)",
+        "  - (b@x.com, 1)",
+        "  - (c@x.com, 3)",
+        "db > Error: index associated with UNIQUE constraint cannot be dropped.",
+        "db > Error: object name reserved for internal use: baby_autoindex_p_2.",
+        "db > Error: cannot add a NOT NULL column with default value NULL.",
+        "db > Error: CHECK constraint failed: n > 0.",
+        "db > Executed.",
+        "db > Error: CHECK constraint must be a boolean expression.",
+        "db > Error: misuse of aggregate function count().",
+        "db > create table p (id integer primary key, name text not null, email text unique, "
+        "age integer default 18 check (age >= 0) constraint adult check (age >= 18 or name = 'kid'), "
+        "n integer not null default 1 check (n > 0));",
+        "db > ",
+    ]
+    print(f"result: {result}")
+    assert result == expected_output
+
+    # 重新打开数据库之后约束仍然有效
+    script = [
+        "insert into p (name, email) values ('hal', 'c@x.com')",
+        "insert into p (name, n) values ('ivy', 0)",
+        "select id, name, n from p where email = 'c@x.com'",
+        ".exit",
+    ]
+    result = run_script(script,db_file=db_file)
+    expected_output = [
+        "db > Error: UNIQUE constraint failed: p.email.",
+        "db > Error: CHECK constraint failed: n > 0.",
+        "db > (3, cat, 1)",
+        "total_rows: 1",
+        "Executed.",
+        "db > ",
+    ]
+    print(f"result: {result}")
+    assert result == expected_output
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+
+# 测试非 INTEGER 和多列的主键，B 树的 key 是主键列的值编码之后连在一起
+def test_supports_composite_and_text_primary_keys(db_file=""):
+    script = [
+        "create table kv (k text primary key, v integer)",
+        "insert into kv values ('b', 2), ('a', 1), ('c', 3)",
+        "insert into kv values ('a', 9)",
+        "insert into kv (v) values (9)",
+        "update kv set v = 20 where k = 'b'",
+        "update kv set k = 'x' where k = 'b'",
+        "delete from kv where k = 'a'",
+        "delete from kv where v = 3",
+        "select rowid from kv",
+        "select * from kv order by k desc",
+        ".btree kv",
+        "create table e (dept text, id bigint, name text, primary key (dept, id))",
+        "insert into e values ('eng', 2, 'bo'), ('eng', 1, 'al'), ('ops', 1, 'cy'), ('eng', -5, 'dee')",
+        "insert into e values ('eng', 1, 'zz')",
+        "create index e_name on e (name)",
+        "select * from e where dept = 'eng' and id > 0",
+        "select * from e where name = 'cy'",
+        "update e set name = 'al2' where id = 1 and dept = 'eng'",
+        "delete from e where dept = 'eng'",
+        ".btree e",
+        ".btree e_name",
+        "create table bad (a text, primary key (a, nosuch))",
+        "create table bad (a text primary key, b text, primary key (b))",
+        ".exit",
+    ]
+    result = run_script(script,db_file=db_file,is_remove=True)
+
+    expected_output = [
+        "db > Executed.",
+        "db > Executed.",
+        "db > Error: Duplicate key.",
+        "db > Error: NOT NULL constraint failed: kv.k.",
+        "db > Executed.",
+        "db > Error: k cannot be updated.",
+        "db > Executed.",
+        "db > Executed.",
+        "db > Error: no such column: rowid.",
+        "db > (b, 20)",
+        "total_rows: 1",
+        "Executed.",
+        "db > Tree:",
+        "- leaf (size 1)",
+        "  - b",
+        "db > Executed.",
+        "db > Executed.",
+        "db > Error: Duplicate key.",
+        "db > Executed.",
+        "db > (eng, 1, al)",
+        "(eng, 2, bo)",
+        "total_rows: 2",
+        "Executed.",
+        "db > (ops, 1, cy)",
+        "total_rows: 1",
+        "Executed.",
+        "db > Executed.",
+        "db > Executed.",
+        "db > Tree:",
+        "- leaf (size 1)",
+        "  - (ops, 1)",
+        "db > Tree:",
+        "- leaf (size 1)",
+        "  - (cy, ops, 1)",
+        "db > Error: table bad has no column named nosuch.",
+        "db > Error: table bad has more than one primary key.",
+        "db > ",
+    ]
+    print(f"result: {result}")
+    assert result == expected_output
+
+    # 按主键的前缀只读取范围内的叶子节点，重新打开之后仍然可以按主键查找
+    script = ["create table m (region text, day integer, note text, primary key (region, day))"]
+    script += [f"insert into m values ('r{i % 3}', {i}, 'note{i}')" for i in range(3000)]
+    script.append(".exit")
+    run_script(script,db_file=db_file,is_remove=True)
+
+    rows, point_reads = pages_read("select note from m where region = 'r1' and day = 1000", db_file)
+    assert rows == ["(note1000)"]
+    rows, range_reads = pages_read("select day from m where region = 'r2' and day between 2000 and 2006", db_file)
+    assert rows == ["(2000)", "(2003)", "(2006)"]
+    rows, last_reads = pages_read("select day from m where region = 'r0' order by region desc limit 2", db_file)
+    assert rows == ["(2997)", "(2994)"]
+    rows, scan_reads = pages_read("select region from m where day = 1000", db_file)
+    assert rows == ["(r1)"]
+    print(f"pages read: {point_reads} {range_reads} {last_reads} {scan_reads}")
+    assert max(point_reads, range_reads, last_reads) < 10
+    assert scan_reads > 50
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+
+# 测试 update 和 delete 的 WHERE 和 select 一样扫描，修改满足条件的所有行
+def test_updates_and_deletes_rows_matching_where(db_file=""):
+    script = [USERS_TABLE, "create index users_name on users (username)"]
+    script += [wide_insert(i) for i in range(1, 61)]
+    script += [
+        "update users set email = 'x' where id between 10 and 12 or username = 'user40'",
+        "delete from users where id > 20 and id <= 55 and id <> 40",
+        "delete from users where username >= 'user5'",
+        "delete from users where id = 100",
+        "update users set email = null where email like 'person%'",
+        "select id, email from users where username between 'user1' and 'user2'",
+        "select count(*), count(email) from users",
+        "update users set username = 'dup' where id < 3",
+        "delete from users where email",
+        ".exit",
+    ]
+    result = run_script(script,db_file=db_file,is_remove=True)
+
+    expected_output = ["db > Executed."] * 65 + [
+        "db > Error: Row not found.",
+        "db > Executed.",
+        "db > (1, NULL)",
+        "(10, x)",
+        "(11, x)",
+        "(12, x)",
+        "(13, NULL)",
+        "(14, NULL)",
+        "(15, NULL)",
+        "(16, NULL)",
+        "(17, NULL)",
+        "(18, NULL)",
+        "(19, NULL)",
+        "(2, NULL)",
+        "total_rows: 12",
+        "Executed.",
+        "db > (16, 4)",
+        "total_rows: 1",
+        "Executed.",
+        "db > Executed.",
+        "db > Error: WHERE clause must be a boolean expression.",
+        "db > ",
+    ]
+    print(f"result: {result}")
+    assert result == expected_output
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+
+# 测试 rowid 是64位有符号整数，负数和超过32位的值都可以作为 INTEGER PRIMARY KEY
+def test_uses_64_bit_signed_rowids(db_file=""):
+    script = [
+        "create table t (id integer primary key, s text)",
+        "insert into t values (5000000000, 'big'), (-1, 'neg'), (0, 'zero')",
+        "insert into t (s) values ('next')",
+        "select * from t where id < 0 or id > 4294967296",
+        "select * from t where id > 9223372036854775807",
+        "insert into t values (9223372036854775807, 'max')",
+        "insert into t (s) values ('full')",
+        "select rowid, s from t where id >= 5000000001 order by id desc",
+        ".btree t",
+        "create index t_s on t (s)",
+        "select id from t where s = 'neg'",
+        ".exit",
+    ]
+    result = run_script(script,db_file=db_file,is_remove=True)
+
+    expected_output = [
+        "db > Executed.",
+        "db > Executed.",
+        "db > Executed.",
+        "db > (-1, neg)",
+        "(5000000000, big)",
+        "(5000000001, next)",
+        "total_rows: 3",
+        "Executed.",
+        "db > total_rows: 0",
+        "Executed.",
+        "db > Executed.",
+        "db > Error: Table full.",
+        "db > (9223372036854775807, max)",
+        "(5000000001, next)",
+        "total_rows: 2",
+        "Executed.",
+        "db > Tree:",
+        "- leaf (size 5)",
+        "  - -1",
+        "  - 0",
+        "  - 5000000000",
+        "  - 5000000001",
+        "  - 9223372036854775807",
+        "db > Executed.",
+        "db > (-1)",
+        "total_rows: 1",
+        "Executed.",
+        "db > ",
+    ]
+    print(f"result: {result}")
+    assert result == expected_output
+    print(f"{sys._getframe().f_code.co_name} passed")
+
+
+# 测试缓存很小时创建索引，排序器把索引项写入临时文件，唯一索引中有重复的值时不留下建了一半的索引
+def test_creates_index_with_small_cache_and_sort_buffer(db_file=""):
+    values = ", ".join(f"({i}, 'v{i * 7 % 300:03}')" for i in range(1, 301))
+    script = [
+        ".cache_size 3",
+        ".sort_buffer_size 100",
+        "create table t (id integer primary key, s text)",
+        f"insert into t values {values}, (301, 'v150')",
+        "create unique index t_s on t (s)",
+        ".schema",
+        "delete from t where id = 301",
+        "create unique index t_s on t (s)",
+        "select id, s from t where s >= 'v295'",
+        ".exit",
+    ]
+    result = run_script(script,db_file=db_file,is_remove=True)
+    print(f"result: {result}")
+    assert result == [
+        "db > db > db > Executed.",
+        "db > Executed.",
+        "db > Error: UNIQUE constraint failed: t.s.",
+        "db > create table t (id integer primary key, s text);",
+        "db > Executed.",
+        "db > Executed.",
+        "db > (85, v295)",
+        "(128, v296)",
+        "(171, v297)",
+        "(214, v298)",
+        "(257, v299)",
+        "total_rows: 5",
+        "Executed.",
+        "db > ",
+    ]
+    print(f"{sys._getframe().f_code.co_name} passed")
+
 if len(sys.argv)<2:
     print(f"need db file path")
     exit(0)
@@ -172,6 +1494,35 @@ if os.path.exists(db_file):
     print(f"{db_file} exists, remove it first")
     os.remove(db_file)
 
-test_prints_structure_of_7_leaf_node_btree(db_file)
+test_prints_structure_of_6_leaf_node_btree(db_file)
+test_deletes_rows_and_rebalances_btree(db_file)
+test_updates_row_in_place(db_file)
+test_reuses_free_pages_and_vacuum_truncates_file(db_file)
+test_rejects_file_that_is_not_a_database(db_file)
+test_grows_past_old_page_limit_with_small_cache(db_file)
+test_evicts_pages_during_multi_row_insert(db_file)
+test_flushes_only_dirty_pages(db_file)
+test_rolls_back_hot_journal_after_crash(db_file)
+test_recovers_committed_frames_from_wal_after_crash(db_file)
+test_rolls_back_and_commits_transactions(db_file)
+test_autocommits_each_statement(db_file)
+test_parses_sql_statements(db_file)
+test_creates_tables_in_schema_catalog(db_file)
+test_drops_tables_and_adds_columns(db_file)
+test_stores_typed_values(db_file)
+test_stores_large_values_in_overflow_pages(db_file)
+test_reuses_free_space_inside_leaf(db_file)
+test_filters_rows_with_where(db_file)
+test_scans_only_key_range(db_file)
+test_projects_columns_and_expressions(db_file)
+test_orders_and_limits_rows(db_file)
+test_scans_backward_for_descending_key(db_file)
+test_aggregates_and_groups_rows(db_file)
+test_creates_and_uses_indexes(db_file)
+test_enforces_column_constraints(db_file)
+test_supports_composite_and_text_primary_keys(db_file)
+test_updates_and_deletes_rows_matching_where(db_file)
+test_uses_64_bit_signed_rowids(db_file)
+test_creates_index_with_small_cache_and_sort_buffer(db_file)
 
 print("all tests passed.")
\ No newline at end of file
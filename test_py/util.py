@@ -15,3 +15,18 @@ def run_script(commands,bin_file="./db",db_file="",is_remove=False):
         process.stdin.close()
         raw_output = process.stdout.read()
     return raw_output.splitlines()
+
+# 执行完命令后直接杀掉进程，模拟没有正常退出时的崩溃。
+# 读到包含 marker 的输出行后才杀掉进程，保证前面的命令都已经执行。
+def run_script_and_kill(commands,marker,bin_file="./db",db_file=""):
+    raw_output = []
+    with subprocess.Popen([bin_file, db_file], stdin=subprocess.PIPE, stdout=subprocess.PIPE, stderr=subprocess.PIPE, text=True) as process:
+        for command in commands:
+            process.stdin.write(command + '\n')
+        process.stdin.flush()
+        for line in process.stdout:
+            raw_output.append(line.rstrip('\n'))
+            if marker in line:
+                break
+        process.kill()
+    return raw_output